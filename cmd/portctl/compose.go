@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/n3r/port-registry/internal/compose"
+	"github.com/n3r/port-registry/internal/ui"
+	"github.com/n3r/port-registry/pkg/portregistry"
+)
+
+func cmdCompose(ctx context.Context, c *portregistry.Client, args []string) {
+	if len(args) == 0 {
+		composeUsage()
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "import":
+		cmdComposeImport(ctx, c, args[1:])
+	case "override":
+		cmdComposeOverride(ctx, c, args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, ui.Errorf("unknown compose command: %s", args[0]))
+		composeUsage()
+		os.Exit(1)
+	}
+}
+
+func composeUsage() {
+	fmt.Fprintln(os.Stderr, ui.UsageTitle("Usage: portctl compose <command>"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, ui.UsageHeader("Commands:"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("import", "Register the host ports published by a compose file"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("override", "Write an override file that publishes the allocated ports"))
+}
+
+// composeFile returns the ports of the compose file at path, or of the one
+// in the current directory if path is empty.
+func composeFile(path string) (string, []compose.Port) {
+	if path == "" {
+		var err error
+		if path, err = compose.Find("."); err != nil {
+			fail(err)
+		}
+	}
+	ports, err := compose.Load(path)
+	if err != nil {
+		fail(err)
+	}
+	return path, ports
+}
+
+// composeTarget fills in app and instance, or exits if they cannot be detected.
+func composeTarget(app, instance *string) {
+	if *app == "" {
+		*app = detectAppName()
+	}
+	if *instance == "" {
+		*instance = detectInstanceName()
+	}
+	if *app == "" || *instance == "" {
+		fmt.Fprintln(os.Stderr, ui.Error("--app and --instance are required (could not auto-detect)"))
+		os.Exit(1)
+	}
+}
+
+// Actions of compose import.
+const (
+	importAdd      = "add"      // allocate the port
+	importKeep     = "keep"     // already registered
+	importSkip     = "skip"     // the host port is already in the plan
+	importConflict = "conflict" // held by another service, or the service holds another port
+)
+
+// composeImport is what compose import does with one published port.
+type composeImport struct {
+	port   compose.Port
+	action string
+	detail string
+	exit   int // exit code for a conflict
+}
+
+func cmdComposeImport(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("compose import", flag.ExitOnError)
+	file := fs.String("f", "", "compose file (default: compose.yaml or docker-compose.yml in the current directory)")
+	app := fs.String("app", "", "application name (default: repo or folder name)")
+	instance := fs.String("instance", "", "instance name (default: worktree or branch name)")
+	var labels stringList
+	fs.Var(&labels, "label", "label as key=value for the new allocations (repeatable)")
+	dryRun := fs.Bool("dry-run", false, "show what would be registered without changing anything")
+	fs.Parse(args)
+
+	labelMap, err := parseLabels(labels)
+	if err != nil {
+		fail(err)
+	}
+	path, ports := composeFile(*file)
+	ports = compose.Published(ports)
+	composeTarget(app, instance)
+	if len(ports) == 0 {
+		fmt.Println(ui.Infof("%s publishes no fixed host ports", path))
+		return
+	}
+
+	plan, err := planComposeImport(ctx, c, *app, *instance, ports)
+	if err != nil {
+		fail(err)
+	}
+	printComposePlan(plan)
+
+	var reqs []portregistry.AllocateRequest
+	code := 0
+	for _, p := range plan {
+		switch p.action {
+		case importAdd:
+			reqs = append(reqs, portregistry.AllocateRequest{
+				App:      *app,
+				Instance: *instance,
+				Service:  p.port.Name,
+				Port:     p.port.Published,
+				Proto:    p.port.Protocol,
+				Force:    true, // the project already uses these ports, so exclusions do not apply
+				Ensure:   true,
+				Labels:   labelMap,
+				Git:      detectGit(),
+			})
+		case importConflict:
+			if code == 0 {
+				code = p.exit
+			}
+		}
+	}
+
+	switch {
+	case len(reqs) == 0:
+		fmt.Println(ui.Info("Nothing to import"))
+	case *dryRun:
+		fmt.Println(ui.Infof("Dry run: %d port(s) would be registered for %s/%s", len(reqs), *app, *instance))
+	default:
+		allocateBatch(ctx, c, reqs)
+		fmt.Println(ui.Successf("Registered %d port(s) for %s/%s", len(reqs), *app, *instance))
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// planComposeImport compares ports with the registry. A port is added unless
+// the service is already registered, or the port belongs to someone else.
+func planComposeImport(ctx context.Context, c *portregistry.Client, app, instance string, ports []compose.Port) ([]composeImport, error) {
+	allocs, err := c.List(ctx, portregistry.Filter{App: app, Instance: instance})
+	if err != nil {
+		return nil, err
+	}
+	registered := make(map[string]portregistry.Allocation, len(allocs))
+	for _, a := range allocs {
+		registered[a.Service] = a
+	}
+
+	plan := make([]composeImport, 0, len(ports))
+	planned := make(map[string]string)
+	for _, p := range ports {
+		// tcp and udp on one host port are separate allocations.
+		key := strconv.Itoa(p.Published) + "/" + p.Protocol
+		if name, ok := planned[key]; ok {
+			plan = append(plan, composeImport{port: p, action: importSkip, detail: "same host port as " + name})
+			continue
+		}
+		planned[key] = p.Name
+
+		if a, ok := registered[p.Name]; ok {
+			if a.Port == p.Published && a.Proto == p.Protocol {
+				plan = append(plan, composeImport{port: p, action: importKeep, detail: "already registered"})
+			} else {
+				plan = append(plan, composeImport{port: p, action: importConflict, exit: exitServiceAllocated,
+					detail: fmt.Sprintf("%s is registered on port %s", p.Name, formatPort(&a))})
+			}
+			continue
+		}
+		status, err := c.CheckPortProto(ctx, p.Published, p.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		if h := status.Holder; h != nil {
+			plan = append(plan, composeImport{port: p, action: importConflict, exit: exitPortTaken,
+				detail: fmt.Sprintf("allocated to %s/%s/%s (id=%d)", h.App, h.Instance, h.Service, h.ID)})
+			continue
+		}
+		plan = append(plan, composeImport{port: p, action: importAdd})
+	}
+	return plan, nil
+}
+
+func printComposePlan(plan []composeImport) {
+	rows := make([][]string, len(plan))
+	for i, p := range plan {
+		action := p.action
+		switch p.action {
+		case importAdd:
+			action = ui.StyleSuccess.Render(p.action)
+		case importConflict:
+			action = ui.StyleError.Render(p.action)
+		case importKeep, importSkip:
+			action = ui.Subtle(p.action)
+		}
+		target := strconv.Itoa(p.port.Target) + "/" + p.port.Protocol
+		rows[i] = []string{p.port.Name, strconv.Itoa(p.port.Published), target, action, p.detail}
+	}
+	fmt.Println(ui.Table([]string{"SERVICE", "PORT", "TARGET", "ACTION", "DETAIL"}, rows))
+}
+
+// overrideHeader starts every file written by compose override, which will
+// only replace a file that starts with it.
+const overrideHeader = "Generated by portctl compose override"
+
+func cmdComposeOverride(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("compose override", flag.ExitOnError)
+	file := fs.String("f", "", "compose file (default: compose.yaml or docker-compose.yml in the current directory)")
+	out := fs.String("o", "", "override file to write, or - for stdout (default: the compose file's name with .override)")
+	app := fs.String("app", "", "application name (default: repo or folder name)")
+	instance := fs.String("instance", "", "instance name (default: worktree or branch name)")
+	var labels stringList
+	fs.Var(&labels, "label", "label as key=value for the new allocations (repeatable)")
+	fs.Parse(args)
+
+	labelMap, err := parseLabels(labels)
+	if err != nil {
+		fail(err)
+	}
+	path, ports := composeFile(*file)
+	composeTarget(app, instance)
+	published := compose.Published(ports)
+	if len(published) == 0 {
+		fmt.Println(ui.Infof("%s publishes no fixed host ports", path))
+		return
+	}
+	if *out == "" {
+		*out = compose.OverridePath(path)
+	}
+	if *out != "-" {
+		checkOverrideFile(*out)
+	}
+
+	reqs := make([]portregistry.AllocateRequest, len(published))
+	for i, p := range published {
+		reqs[i] = portregistry.AllocateRequest{
+			App:      *app,
+			Instance: *instance,
+			Service:  p.Name,
+			Proto:    p.Protocol,
+			Ensure:   true,
+			Labels:   labelMap,
+			Git:      detectGit(),
+		}
+	}
+	hostPorts := make(map[string]int, len(published))
+	for _, a := range allocateBatch(ctx, c, reqs) {
+		hostPorts[a.Service] = a.Port
+	}
+
+	header := fmt.Sprintf("%s for %s/%s from %s.\nDo not edit: run it again to update.", overrideHeader, *app, *instance, filepath.Base(path))
+	data, err := compose.Override(ports, hostPorts, header)
+	if err != nil {
+		fail(err)
+	}
+	if *out == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		fail(err)
+	}
+
+	rows := make([][]string, len(published))
+	for i, p := range published {
+		rows[i] = []string{p.Name, strconv.Itoa(p.Published), strconv.Itoa(hostPorts[p.Name])}
+	}
+	fmt.Println(ui.Table([]string{"SERVICE", "COMPOSE PORT", "PORT"}, rows))
+	fmt.Println(ui.Successf("Wrote %s for %s/%s", *out, *app, *instance))
+}
+
+// checkOverrideFile exits if path exists and was not written by compose
+// override, so that a hand-written override file is never replaced.
+func checkOverrideFile(path string) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		fail(err)
+	}
+	if !bytes.HasPrefix(data, []byte("# "+overrideHeader)) {
+		fmt.Fprintln(os.Stderr, ui.Errorf("%s exists and was not written by portctl; move it or choose another file with -o", path))
+		os.Exit(1)
+	}
+}
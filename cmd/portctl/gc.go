@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/n3r/port-registry/internal/gitrepo"
+	"github.com/n3r/port-registry/internal/ui"
+	"github.com/n3r/port-registry/pkg/portregistry"
+)
+
+// staleAllocation is an allocation whose worktree or branch is gone.
+type staleAllocation struct {
+	alloc  portregistry.Allocation
+	reason string
+}
+
+func cmdGC(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	allRepos := fs.Bool("all-repos", false, "check every repository allocations were made from, not just the current one")
+	dryRun := fs.Bool("dry-run", false, "show what would be released without releasing it")
+	yes := fs.Bool("yes", false, "release without asking for confirmation")
+	fs.Parse(args)
+
+	var repos []string
+	if gitDir, err := gitrepo.CommonDir("."); err == nil {
+		repos = append(repos, gitDir)
+	}
+	if *allRepos {
+		allocs, err := c.List(ctx, portregistry.Filter{})
+		if err != nil {
+			fail(err)
+		}
+		for _, a := range allocs {
+			if a.Git != nil && !slices.Contains(repos, a.Git.Repo) {
+				repos = append(repos, a.Git.Repo)
+			}
+		}
+	} else if len(repos) == 0 {
+		fmt.Fprintln(os.Stderr, ui.Error("not in a git repository (use --all-repos to check every repository allocations were made from)"))
+		os.Exit(1)
+	}
+
+	stale := findStale(ctx, c, repos)
+	if len(stale) == 0 {
+		fmt.Println(ui.Success("No stale allocations"))
+		return
+	}
+
+	rows := make([][]string, len(stale))
+	for i, s := range stale {
+		a := s.alloc
+		rows[i] = []string{strconv.FormatInt(a.ID, 10), a.App, a.Instance, a.Service, strconv.Itoa(a.Port), s.reason}
+	}
+	fmt.Println(ui.Table([]string{"ID", "APP", "INSTANCE", "SERVICE", "PORT", "REASON"}, rows))
+
+	if *dryRun {
+		fmt.Println(ui.Infof("Dry run: %d allocation(s) would be released", len(stale)))
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Release %d allocation(s)?", len(stale))) {
+		fmt.Println(ui.Info("Nothing released"))
+		return
+	}
+	for _, s := range stale {
+		if err := c.ReleaseByID(ctx, s.alloc.ID); err != nil && !errors.Is(err, portregistry.ErrNotFound) {
+			fail(err)
+		}
+	}
+	fmt.Println(ui.Successf("Released %d allocation(s)", len(stale)))
+}
+
+// repoState is what gc knows about one repository.
+type repoState struct {
+	gone    bool
+	unknown bool // git could not read it
+	repo    *gitrepo.Repo
+}
+
+// findStale returns the allocations of repos that belong to a deleted
+// repository, branch or worktree. Allocations that record their git checkout
+// are checked against it; see staleReason. Older ones are only tied to a repository of the
+// same app name by an instance named after one of its deleted worktrees, and
+// never released otherwise.
+func findStale(ctx context.Context, c *portregistry.Client, repos []string) (stale []staleAllocation) {
+	states := make(map[string]*repoState) // git dir -> state
+	apps := make(map[string][]*repoState) // app -> states of its repos
+	for _, gitDir := range repos {
+		st := &repoState{}
+		if _, err := os.Stat(gitDir); errors.Is(err, fs.ErrNotExist) {
+			st.gone = true
+		} else if repo, err := gitrepo.Inspect(gitDir); err != nil {
+			fmt.Fprintln(os.Stderr, ui.Warningf("skipping %s: %v", gitDir, err))
+			st.unknown = true
+		} else {
+			st.repo = repo
+		}
+		states[gitDir] = st
+		app := gitrepo.AppName(gitDir)
+		apps[app] = append(apps[app], st)
+	}
+
+	seen := make(map[int64]bool)
+	check := func(f portregistry.Filter) {
+		allocs, err := c.List(ctx, f)
+		if err != nil {
+			fail(err)
+		}
+		for _, a := range allocs {
+			if seen[a.ID] {
+				continue
+			}
+			seen[a.ID] = true
+			var reason string
+			if a.Git != nil {
+				reason = staleReason(states[a.Git.Repo], a)
+			} else {
+				reason = staleLegacyReason(apps[a.App], a.Instance)
+			}
+			if reason != "" {
+				stale = append(stale, staleAllocation{alloc: a, reason: reason})
+			}
+		}
+	}
+	for _, gitDir := range slices.Sorted(maps.Keys(states)) {
+		check(portregistry.Filter{Repo: gitDir})
+	}
+	for _, app := range slices.Sorted(maps.Keys(apps)) {
+		check(portregistry.Filter{App: app})
+	}
+	return stale
+}
+
+// staleReason says why a, made from the repository in st, is stale, or
+// returns "" if it is not. st is nil for a repository that was not checked.
+// The checkout a was made from is gone if its linked worktree was deleted,
+// or, in the main worktree, if its branch was. Its instance name does not
+// matter, so instances named by hand are kept while their checkout exists.
+func staleReason(st *repoState, a portregistry.Allocation) string {
+	if st == nil || st.unknown {
+		return ""
+	}
+	if st.gone {
+		return "repository deleted"
+	}
+	g := a.Git
+	if g.Worktree != "" && filepath.Clean(g.Worktree) != filepath.Dir(g.Repo) {
+		if _, err := os.Stat(g.Worktree); errors.Is(err, fs.ErrNotExist) {
+			return "worktree deleted"
+		}
+		return ""
+	}
+	if g.Branch != "" && !st.repo.Branches[g.Branch] {
+		return "branch deleted"
+	}
+	return ""
+}
+
+// staleLegacyReason says why an allocation without git metadata is stale,
+// given the repositories named like its app. It is only stale if its
+// instance is a deleted worktree of one of them, and no branch or worktree
+// of another.
+func staleLegacyReason(repos []*repoState, instance string) string {
+	deleted := false
+	for _, st := range repos {
+		switch {
+		case st.unknown:
+			return ""
+		case st.gone:
+			continue
+		case st.repo.HasInstance(instance):
+			return ""
+		case st.repo.Deleted[instance]:
+			deleted = true
+		}
+	}
+	if deleted {
+		return "worktree deleted"
+	}
+	return ""
+}
+
+// confirm asks a yes/no question on the terminal; anything but yes is no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+func git(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func TestFindStale(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	repo := filepath.Join(root, "shop")
+	os.Mkdir(repo, 0o755)
+	git(t, repo, "init", "-q", "-b", "main")
+	git(t, repo, "commit", "-q", "--allow-empty", "-m", "init")
+	git(t, repo, "worktree", "add", "-q", "--detach", filepath.Join(root, "shop-gone"))
+	git(t, repo, "worktree", "add", "-q", "--detach", filepath.Join(root, "shop-live"))
+	os.RemoveAll(filepath.Join(root, "shop-gone"))
+	gitDir := filepath.Join(repo, ".git")
+
+	s, c := testServer(t)
+	for _, r := range []model.AllocateRequest{
+		{App: "shop", Instance: "main", Service: "old"},
+		{App: "shop", Instance: "dev", Service: "old"},       // named by hand, so it cannot be tied to the repository
+		{App: "shop", Instance: "shop-gone", Service: "old"}, // a deleted worktree of it
+		{App: "shop", Instance: "x", Service: "gone", Git: &model.GitInfo{Repo: filepath.Join(root, "deleted", ".git")}},
+		{App: "shop", Instance: "dev", Service: "web", Git: &model.GitInfo{Repo: gitDir, Worktree: repo, Branch: "main"}},
+		{App: "shop", Instance: "feature", Service: "web", Git: &model.GitInfo{Repo: gitDir, Worktree: repo, Branch: "feature"}},
+		{App: "shop", Instance: "detached", Service: "web", Git: &model.GitInfo{Repo: gitDir, Worktree: repo}},
+		{App: "shop", Instance: "shop-live", Service: "web", Git: &model.GitInfo{Repo: gitDir, Worktree: filepath.Join(root, "shop-live"), Branch: "deleted-branch"}},
+		{App: "shop", Instance: "wt", Service: "web", Git: &model.GitInfo{Repo: gitDir, Worktree: filepath.Join(root, "shop-gone"), Branch: "main"}},
+	} {
+		if _, err := s.Allocate(r, 3000, 3999); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stale := findStale(context.Background(), c, []string{gitDir, filepath.Join(root, "deleted", ".git")})
+	var got []string
+	for _, st := range stale {
+		got = append(got, st.alloc.Instance+"/"+st.alloc.Service+": "+st.reason)
+	}
+	slices.Sort(got)
+	want := []string{
+		"feature/web: branch deleted",
+		"shop-gone/old: worktree deleted",
+		"wt/web: worktree deleted",
+		"x/gone: repository deleted",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -1,25 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/n3r/port-registry/internal/client"
 	"github.com/n3r/port-registry/internal/config"
-	"github.com/n3r/port-registry/internal/model"
+	"github.com/n3r/port-registry/internal/dotenv"
+	"github.com/n3r/port-registry/internal/gitrepo"
+	"github.com/n3r/port-registry/internal/manifest"
 	"github.com/n3r/port-registry/internal/skill"
-	"github.com/n3r/port-registry/internal/store"
 	"github.com/n3r/port-registry/internal/ui"
 	"github.com/n3r/port-registry/internal/version"
+	"github.com/n3r/port-registry/pkg/portregistry"
 )
 
 const (
@@ -40,14 +48,14 @@ func main() {
 		fmt.Println(ui.Bold("portctl") + " " + ui.Subtle(version.String()))
 		return
 	case "start":
-		cmdStart()
+		cmdStart(os.Args[2:])
 		return
 	case "stop":
 		cmdStop()
 		return
 	case "restart":
 		cmdStop()
-		cmdStart()
+		cmdStart(os.Args[2:])
 		return
 	case "status":
 		cmdStatus()
@@ -57,278 +65,1531 @@ func main() {
 		return
 	}
 
-	addr := os.Getenv("PORT_REGISTRY_ADDR")
-	if addr == "" {
-		addr = fmt.Sprintf("127.0.0.1:%d", config.DefaultServerPort)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	c := newClient(serverAddr())
+
+	switch os.Args[1] {
+	case "allocate", "ensure":
+		cmdAllocate(ctx, c, os.Args[1], os.Args[2:])
+	case "run":
+		cmdRun(ctx, c, os.Args[2:])
+	case "release":
+		cmdRelease(ctx, c, os.Args[2:])
+	case "renew":
+		cmdRenew(ctx, c, os.Args[2:])
+	case "list":
+		cmdList(ctx, c, os.Args[2:])
+	case "env":
+		cmdEnv(ctx, c, os.Args[2:])
+	case "history":
+		cmdHistory(ctx, c, os.Args[2:])
+	case "watch":
+		cmdWatch(ctx, c, os.Args[2:])
+	case "audit":
+		cmdAudit(ctx, c, os.Args[2:])
+	case "who":
+		cmdWho(ctx, c, os.Args[2:])
+	case "check":
+		cmdCheck(ctx, c, os.Args[2:])
+	case "range":
+		cmdRange(ctx, c, os.Args[2:])
+	case "apply":
+		cmdApply(ctx, c, os.Args[2:])
+	case "diff":
+		cmdDiff(ctx, c, os.Args[2:])
+	case "gc":
+		cmdGC(ctx, c, os.Args[2:])
+	case "compose":
+		cmdCompose(ctx, c, os.Args[2:])
+	case "exclude":
+		cmdExclude(ctx, c, os.Args[2:])
+	case "token":
+		cmdToken(ctx, c, os.Args[2:])
+	case "health":
+		cmdHealth(ctx, c)
+	default:
+		fmt.Fprintln(os.Stderr, ui.Errorf("unknown command: %s", os.Args[1]))
+		usage()
+		os.Exit(1)
+	}
+}
+
+// serverAddr is $PORT_REGISTRY_ADDR (host:port or unix:///path), or the
+// default local TCP address.
+func serverAddr() string {
+	if addr := os.Getenv("PORT_REGISTRY_ADDR"); addr != "" {
+		return addr
+	}
+	return fmt.Sprintf("127.0.0.1:%d", config.DefaultServerPort)
+}
+
+// newClient returns a client for addr that authenticates with
+// $PORT_REGISTRY_TOKEN and records changes under defaultActor.
+func newClient(addr string, opts ...portregistry.Option) *portregistry.Client {
+	opts = append([]portregistry.Option{
+		portregistry.WithToken(os.Getenv("PORT_REGISTRY_TOKEN")),
+		portregistry.WithActor(defaultActor()),
+		portregistry.WithUserAgent("portctl/" + version.Version),
+	}, opts...)
+	return portregistry.New(addr, opts...)
+}
+
+// defaultActor is $PORT_REGISTRY_ACTOR, falling back to the OS user name.
+func defaultActor() string {
+	if a := os.Getenv("PORT_REGISTRY_ACTOR"); a != "" {
+		return a
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, ui.UsageTitle("Usage: portctl <command> [flags]"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, ui.UsageHeader("Server lifecycle:"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("start", "Start the port-registry daemon"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("stop", "Stop the port-registry daemon"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("restart", "Restart the port-registry daemon"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("status", "Show port-registry daemon status"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, ui.UsageHeader("Commands:"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("allocate", "Allocate a port"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("ensure", "Allocate a port unless the service already has one"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("run", "Run a command with allocated ports in its environment"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("release", "Release port(s)"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("renew", "Renew lease(s) on allocated port(s)"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("list", "List allocations"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("env", "Print allocated ports as environment variables"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("history", "Show allocation history"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("watch", "Print allocation changes as they happen"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("check", "Check if a port is available"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("who", "Show which process listens on a port"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("audit", "Compare allocations with the ports actually listening"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("apply", "Allocate and release ports to match "+manifest.FileName))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("diff", "Show what apply would change"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("gc", "Release ports of deleted worktrees and branches"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("compose", "Register the ports of a Docker Compose file"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("range", "Manage auto-assignment port ranges"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("exclude", "Manage ports excluded from auto-assignment"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("token", "Manage API tokens"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("health", "Check server health"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("version", "Print version and exit"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, ui.UsageHeader("Skills:"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("skill", "Manage agent skills"))
+}
+
+func detectAppName() string {
+	// The common dir is the main repo's .git dir, even from linked worktrees.
+	if gitDir, err := gitrepo.CommonDir("."); err == nil {
+		return gitrepo.AppName(gitDir)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(cwd)
+}
+
+// detectGit describes the current git checkout for the allocations made from
+// it, or returns nil outside a repository.
+var detectGit = sync.OnceValue(gitrepo.Current)
+
+func detectInstanceName() string {
+	wtOut, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return ""
+	}
+	worktreeRoot := strings.TrimSpace(string(wtOut))
+
+	cdOut, err := exec.Command("git", "rev-parse", "--path-format=absolute", "--git-common-dir").Output()
+	if err != nil {
+		return ""
+	}
+	mainRoot := filepath.Dir(strings.TrimSpace(string(cdOut)))
+
+	if worktreeRoot != mainRoot {
+		// Linked worktree — use the worktree directory name.
+		return filepath.Base(worktreeRoot)
+	}
+
+	// Main worktree — use the current branch name.
+	brOut, err := exec.Command("git", "branch", "--show-current").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(brOut))
+}
+
+// stringList is a flag.Value that collects repeated flags, e.g. --service web --service db.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// allocateFlags are the flags that describe an allocation, shared by
+// allocate and run.
+type allocateFlags struct {
+	app      *string
+	instance *string
+	services stringList
+	port     *int
+	proto    *string
+	ttl      *time.Duration
+	force    *bool
+	labels   stringList
+}
+
+func addAllocateFlags(fs *flag.FlagSet) *allocateFlags {
+	f := &allocateFlags{
+		app:      fs.String("app", "", "application name (default: repo or folder name)"),
+		instance: fs.String("instance", "", "instance name (default: worktree or branch name)"),
+	}
+	fs.Var(&f.services, "service", "service name (required; repeat to allocate several services atomically)")
+	f.port = fs.Int("port", 0, "specific port to allocate (0 = auto-assign)")
+	f.proto = fs.String("proto", "", "protocol to reserve the port for: tcp, udp or both (default tcp)")
+	f.ttl = fs.Duration("ttl", 0, "lease duration, e.g. 2h (0 = never expires)")
+	f.force = fs.Bool("force", false, "allow a --port that is on the exclusion list")
+	fs.Var(&f.labels, "label", "label as key=value (repeatable)")
+	return f
+}
+
+// requests returns one request per service, auto-detecting the app and
+// instance if they were not given. It exits if the flags are incomplete.
+func (f *allocateFlags) requests(fs *flag.FlagSet, ensure bool) []portregistry.AllocateRequest {
+	labelMap, err := parseLabels(f.labels)
+	if err != nil {
+		fail(err)
+	}
+
+	if *f.app == "" {
+		*f.app = detectAppName()
+	}
+	if *f.instance == "" {
+		*f.instance = detectInstanceName()
+	}
+	if *f.app == "" || *f.instance == "" || len(f.services) == 0 {
+		fmt.Fprintln(os.Stderr, ui.Error("--app, --instance, and --service are required (could not auto-detect missing values)"))
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(f.services) > 1 && *f.port != 0 {
+		fmt.Fprintln(os.Stderr, ui.Error("--port cannot be combined with multiple --service flags"))
+		os.Exit(1)
+	}
+
+	reqs := make([]portregistry.AllocateRequest, len(f.services))
+	for i, svc := range f.services {
+		reqs[i] = portregistry.AllocateRequest{
+			App:      *f.app,
+			Instance: *f.instance,
+			Service:  svc,
+			Port:     *f.port,
+			Proto:    *f.proto,
+			Force:    *f.force,
+			Ensure:   ensure,
+			Labels:   labelMap,
+			Git:      detectGit(),
+		}
+		if *f.ttl > 0 {
+			reqs[i].TTL = f.ttl.String()
+		}
+	}
+	return reqs
+}
+
+// allocateBatch allocates reqs atomically, or prints why it failed and exits.
+func allocateBatch(ctx context.Context, c *portregistry.Client, reqs []portregistry.AllocateRequest) []portregistry.Allocation {
+	allocs, err := c.AllocateBatch(ctx, reqs)
+	var apiErr *portregistry.Error
+	if errors.As(err, &apiErr) && apiErr.Index != nil {
+		failed := reqs[*apiErr.Index]
+		fmt.Fprintln(os.Stderr, ui.Errorf("no ports allocated: %s/%s/%s failed", failed.App, failed.Instance, failed.Service))
+		exitAllocateError(err)
+	}
+	if err != nil {
+		fail(err)
+	}
+	return allocs
+}
+
+// cmdAllocate implements allocate, and ensure, which is allocate --ensure.
+func cmdAllocate(ctx context.Context, c *portregistry.Client, name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	f := addAllocateFlags(fs)
+	ensure := fs.Bool("ensure", name == "ensure", "succeed with the existing port if the service already has one")
+	quiet := fs.Bool("quiet", false, "print only the port number(s)")
+	fs.Parse(args)
+
+	reqs := f.requests(fs, *ensure)
+	if len(reqs) > 1 {
+		allocs := allocateBatch(ctx, c, reqs)
+		// The batch response does not say which services already had a port.
+		verb := "Allocated"
+		if *ensure {
+			verb = "Ensured"
+		}
+		for i := range allocs {
+			printAllocated(&allocs[i], verb, *quiet)
+		}
+		return
+	}
+
+	var alloc *portregistry.Allocation
+	var existed bool
+	var err error
+	if *ensure {
+		alloc, existed, err = c.Ensure(ctx, reqs[0])
+	} else {
+		alloc, err = c.Allocate(ctx, reqs[0])
+	}
+	if err != nil {
+		exitAllocateError(err)
+	}
+	verb := "Allocated"
+	if existed {
+		verb = "Kept"
+	}
+	printAllocated(alloc, verb, *quiet)
+}
+
+// parseLabels converts repeated key=value flags to a map; nil if there are none.
+func parseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q: want key=value", l)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// formatLabels renders labels as sorted key=value pairs.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Exit codes, so scripts can tell failures apart without parsing messages.
+// 2 is left to the flag package, which uses it for usage errors.
+const (
+	exitError            = 1 // any other failure
+	exitServiceAllocated = 3
+	exitPortTaken        = 4
+	exitPortBusy         = 5
+	exitPortExcluded     = 6
+	exitRangeExhausted   = 7
+	exitNotFound         = 8
+	exitAuth             = 9  // missing, invalid or insufficient token
+	exitUnreachable      = 10 // the server could not be reached
+)
+
+var codeExits = map[string]int{
+	portregistry.CodeServiceAllocated: exitServiceAllocated,
+	portregistry.CodePortTaken:        exitPortTaken,
+	portregistry.CodePortBusy:         exitPortBusy,
+	portregistry.CodePortExcluded:     exitPortExcluded,
+	portregistry.CodeRangeExhausted:   exitRangeExhausted,
+	portregistry.CodeNotFound:         exitNotFound,
+	portregistry.CodeUnauthorized:     exitAuth,
+	portregistry.CodeForbidden:        exitAuth,
+}
+
+// exitCode returns the exit code for a failed request.
+func exitCode(err error) int {
+	var apiErr *portregistry.Error
+	if errors.As(err, &apiErr) {
+		if code, ok := codeExits[apiErr.Code]; ok {
+			return code
+		}
+		return exitError
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && !errors.Is(err, context.Canceled) {
+		return exitUnreachable
+	}
+	return exitError
+}
+
+// fail prints err and exits with its exit code.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
+	os.Exit(exitCode(err))
+}
+
+// exitAllocateError prints an allocation failure and exits.
+func exitAllocateError(err error) {
+	var apiErr *portregistry.Error
+	if !errors.As(err, &apiErr) {
+		fail(err)
+	}
+	holder := apiErr.Holder
+	switch {
+	case apiErr.Code == portregistry.CodeServiceAllocated && holder != nil:
+		fmt.Fprintln(os.Stderr, ui.Errorf("%s/%s/%s is already allocated on port %s %s",
+			holder.App, holder.Instance, holder.Service, formatPort(holder), ui.Subtle(fmt.Sprintf("(id=%d)", holder.ID))))
+	case apiErr.Code == portregistry.CodePortTaken && holder != nil:
+		fmt.Fprintln(os.Stderr, ui.Errorf("port %s is already allocated to %s/%s/%s %s",
+			formatPort(holder), holder.App, holder.Instance, holder.Service, ui.Subtle(fmt.Sprintf("(id=%d)", holder.ID))))
+	case apiErr.Code == portregistry.CodePortBusy:
+		fmt.Fprintln(os.Stderr, ui.Errorf("port %d is in use on the system %s",
+			apiErr.Port, ui.Subtle(fmt.Sprintf("(see portctl who --port %d)", apiErr.Port))))
+	case apiErr.Code == portregistry.CodePortExcluded:
+		fmt.Fprintln(os.Stderr, ui.Errorf("port %d is excluded from allocation %s", apiErr.Port, ui.Subtle("(use --force to override)")))
+	case apiErr.Code == portregistry.CodeRangeExhausted && apiErr.Range != nil:
+		fmt.Fprintln(os.Stderr, ui.Errorf("no free ports in range %d-%d %s",
+			apiErr.Range.Min, apiErr.Range.Max, ui.Subtle("(see portctl range)")))
+	default:
+		fail(err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// printAllocated reports alloc, or with quiet only its port, for scripts.
+func printAllocated(alloc *portregistry.Allocation, verb string, quiet bool) {
+	if quiet {
+		fmt.Println(alloc.Port)
+		return
+	}
+	fmt.Println(ui.Successf("%s port %s for %s/%s/%s %s",
+		verb, formatPort(alloc), alloc.App, alloc.Instance, alloc.Service, ui.Subtle(fmt.Sprintf("(id=%d)", alloc.ID))+leaseSuffix(alloc)))
+}
+
+// formatPort returns a's port with its protocol unless that is tcp, e.g.
+// 5353/udp or 53/tcp+udp.
+func formatPort(a *portregistry.Allocation) string {
+	switch a.Proto {
+	case portregistry.ProtoUDP:
+		return fmt.Sprintf("%d/udp", a.Port)
+	case portregistry.ProtoBoth:
+		return fmt.Sprintf("%d/tcp+udp", a.Port)
+	}
+	return strconv.Itoa(a.Port)
+}
+
+// leaseSuffix describes when a lease expires, or returns "" for permanent allocations.
+func leaseSuffix(a *portregistry.Allocation) string {
+	if a.ExpiresAt == nil {
+		return ""
+	}
+	return " " + ui.Subtle("expires "+a.ExpiresAt.Format("2006-01-02 15:04:05"))
+}
+
+// cmdRun allocates or reuses ports for a command, passes them to it as
+// environment variables, and optionally releases them when it exits.
+func cmdRun(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	f := addAllocateFlags(fs)
+	name := fs.String("name", defaultEnvName, "variable name template; {app}, {instance} and {service} are replaced")
+	release := fs.Bool("release", false, "release the ports this run allocated when the command exits")
+	fs.Parse(args)
+
+	command := fs.Args()
+	if len(command) == 0 {
+		fmt.Fprintln(os.Stderr, ui.Error("usage: portctl run [flags] --service <name>... -- <command> [args...]"))
+		os.Exit(1)
+	}
+	reqs := f.requests(fs, true)
+
+	// Check the variable names before allocating anything.
+	planned := make([]portregistry.Allocation, len(reqs))
+	for i, r := range reqs {
+		planned[i] = portregistry.Allocation{App: r.App, Instance: r.Instance, Service: r.Service}
+	}
+	if _, err := envVars(planned, *name); err != nil {
+		fail(err)
+	}
+
+	// Remember which services already had a port, so that --release keeps them.
+	before, err := c.List(ctx, portregistry.Filter{App: *f.app, Instance: *f.instance})
+	if err != nil {
+		fail(err)
+	}
+	existed := make(map[int64]bool, len(before))
+	for _, a := range before {
+		existed[a.ID] = true
+	}
+
+	allocs := allocateBatch(ctx, c, reqs)
+	vars, err := envVars(allocs, *name)
+	if err != nil {
+		fail(err)
+	}
+	for _, a := range allocs {
+		verb := "Allocated"
+		if existed[a.ID] {
+			verb = "Kept"
+		}
+		fmt.Fprintln(os.Stderr, ui.Successf("%s port %s for %s/%s/%s %s",
+			verb, formatPort(&a), a.App, a.Instance, a.Service, ui.Subtle("as "+envName(*name, a))))
+	}
+
+	code := runCommand(command, vars)
+	if *release {
+		releaseNew(ctx, c, allocs, existed)
+	}
+	os.Exit(code)
+}
+
+// releaseNew releases the allocations that did not exist before the run,
+// warning about those it cannot release.
+func releaseNew(ctx context.Context, c *portregistry.Client, allocs []portregistry.Allocation, existed map[int64]bool) {
+	// The context is cancelled if the command was interrupted, but the
+	// ports should still be released.
+	ctx = context.WithoutCancel(ctx)
+	for _, a := range allocs {
+		if existed[a.ID] {
+			continue
+		}
+		if err := c.ReleaseByID(ctx, a.ID); err != nil && !errors.Is(err, portregistry.ErrNotFound) {
+			fmt.Fprintln(os.Stderr, ui.Warningf("could not release port %d: %v", a.Port, err))
+		}
+	}
+}
+
+// runCommand runs command with vars added to its environment, forwarding
+// the signals portctl receives, and returns its exit status the way a shell
+// would: 128+n if it was killed by signal n, and 127 if it could not start.
+func runCommand(command []string, vars []dotenv.Var) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	for _, v := range vars {
+		cmd.Env = append(cmd.Env, v.Key+"="+v.Value)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
+		return 127
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
+		return exitError
+	}
+	return 0
+}
+
+func cmdRenew(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("renew", flag.ExitOnError)
+	id := fs.Int64("id", 0, "allocation ID to renew")
+	app := fs.String("app", "", "application name (default: repo or folder name)")
+	instance := fs.String("instance", "", "instance name (default: worktree or branch name)")
+	service := fs.String("service", "", "service name")
+	ttl := fs.Duration("ttl", 0, "new lease duration (0 = reuse each lease's original TTL)")
+	fs.Parse(args)
+
+	if *id != 0 {
+		alloc, err := c.Renew(ctx, *id, *ttl)
+		if errors.Is(err, portregistry.ErrNotFound) {
+			fmt.Fprintln(os.Stderr, ui.Errorf("allocation %d not found", *id))
+			os.Exit(exitNotFound)
+		} else if err != nil {
+			fail(err)
+		}
+		fmt.Println(ui.Successf("Renewed port %d for %s/%s/%s%s",
+			alloc.Port, alloc.App, alloc.Instance, alloc.Service, leaseSuffix(alloc)))
+		return
+	}
+
+	if *app == "" {
+		*app = detectAppName()
+	}
+	if *instance == "" {
+		*instance = detectInstanceName()
+	}
+	if *app == "" {
+		fmt.Fprintln(os.Stderr, ui.Error("--id or --app is required (could not auto-detect app)"))
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	allocs, err := c.List(ctx, portregistry.Filter{
+		App:      *app,
+		Instance: *instance,
+		Service:  *service,
+	})
+	if err != nil {
+		fail(err)
+	}
+
+	renewed := 0
+	for _, a := range allocs {
+		// Without --ttl only existing leases can be renewed; permanent allocations are left alone.
+		if a.ExpiresAt == nil && *ttl == 0 {
+			continue
+		}
+		alloc, err := c.Renew(ctx, a.ID, *ttl)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, ui.Errorf("renew %s/%s/%s: %v", a.App, a.Instance, a.Service, err))
+			os.Exit(exitCode(err))
+		}
+		fmt.Println(ui.Successf("Renewed port %d for %s/%s/%s%s",
+			alloc.Port, alloc.App, alloc.Instance, alloc.Service, leaseSuffix(alloc)))
+		renewed++
+	}
+	if renewed == 0 {
+		fmt.Println(ui.Info("No leases to renew"))
+	}
+}
+
+func cmdRelease(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	id := fs.Int64("id", 0, "allocation ID to release")
+	app := fs.String("app", "", "application name (default: repo or folder name)")
+	instance := fs.String("instance", "", "instance name (default: worktree or branch name)")
+	service := fs.String("service", "", "service name")
+	port := fs.Int("port", 0, "port to release")
+	var labels stringList
+	fs.Var(&labels, "label", "filter by label key=value (repeatable)")
+	fs.Parse(args)
+
+	labelMap, err := parseLabels(labels)
+	if err != nil {
+		fail(err)
+	}
+
+	if *app == "" {
+		*app = detectAppName()
+	}
+	if *instance == "" {
+		*instance = detectInstanceName()
+	}
+
+	if *id != 0 {
+		if err := c.ReleaseByID(ctx, *id); errors.Is(err, portregistry.ErrNotFound) {
+			fmt.Fprintln(os.Stderr, ui.Errorf("allocation %d not found", *id))
+			os.Exit(exitNotFound)
+		} else if err != nil {
+			fail(err)
+		}
+		fmt.Println(ui.Successf("Released allocation %d", *id))
+		return
+	}
+
+	if *app == "" && *port == 0 {
+		fmt.Fprintln(os.Stderr, ui.Error("--id, --app, or --port is required"))
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	n, err := c.ReleaseByFilter(ctx, portregistry.ReleaseRequest{
+		App:      *app,
+		Instance: *instance,
+		Service:  *service,
+		Port:     *port,
+		Labels:   labelMap,
+	})
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(ui.Successf("Released %d allocation(s)", n))
+}
+
+func cmdList(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	app := fs.String("app", "", "filter by application (default: repo or folder name)")
+	instance := fs.String("instance", "", "filter by instance (default: worktree or branch name)")
+	service := fs.String("service", "", "filter by service")
+	repo := fs.String("repo", "", "filter by the git repository at this path, instead of app and instance")
+	var labels stringList
+	fs.Var(&labels, "label", "filter by label key=value (repeatable)")
+	showGit := fs.Bool("git", false, "show the repository, branch and commit of each allocation")
+	jsonOut := fs.Bool("json", false, "output as JSON")
+	fs.Parse(args)
+
+	labelMap, err := parseLabels(labels)
+	if err != nil {
+		fail(err)
+	}
+
+	var gitDir string
+	if *repo != "" {
+		if gitDir, err = gitrepo.CommonDir(*repo); err != nil {
+			fail(fmt.Errorf("%s: %w", *repo, err))
+		}
+	} else {
+		if *app == "" {
+			*app = detectAppName()
+		}
+		if *instance == "" {
+			*instance = detectInstanceName()
+		}
+	}
+
+	allocs, err := c.List(ctx, portregistry.Filter{
+		App:      *app,
+		Instance: *instance,
+		Service:  *service,
+		Repo:     gitDir,
+		Labels:   labelMap,
+	})
+	if err != nil {
+		fail(err)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(allocs)
+		return
+	}
+
+	if len(allocs) == 0 {
+		fmt.Println(ui.Info("No allocations"))
+		return
+	}
+
+	rows := make([][]string, len(allocs))
+	for i, a := range allocs {
+		expires := "-"
+		if a.ExpiresAt != nil {
+			expires = a.ExpiresAt.Format("2006-01-02 15:04:05")
+		}
+		rows[i] = []string{
+			fmt.Sprintf("%d", a.ID),
+			a.App,
+			a.Instance,
+			a.Service,
+			formatPort(&a),
+			a.CreatedAt.Format("2006-01-02 15:04:05"),
+			expires,
+			formatLabels(a.Labels),
+		}
+		if *showGit {
+			rows[i] = append(rows[i], formatGit(a.Git)...)
+		}
+	}
+	headers := []string{"ID", "APP", "INSTANCE", "SERVICE", "PORT", "CREATED", "EXPIRES", "LABELS"}
+	if *showGit {
+		headers = append(headers, "REPO", "BRANCH", "COMMIT")
+	}
+	fmt.Println(ui.Table(headers, rows))
+}
+
+// formatGit returns the repository directory, branch and short commit of g.
+func formatGit(g *portregistry.GitInfo) []string {
+	if g == nil {
+		return []string{"-", "-", "-"}
+	}
+	branch, commit := g.Branch, g.Commit
+	if branch == "" {
+		branch = "-"
+	}
+	if len(commit) > 7 {
+		commit = commit[:7]
+	} else if commit == "" {
+		commit = "-"
+	}
+	return []string{filepath.Dir(g.Repo), branch, commit}
+}
+
+// defaultEnvName is the --name template of portctl env.
+const defaultEnvName = "{service}_PORT"
+
+func cmdEnv(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("env", flag.ExitOnError)
+	app := fs.String("app", "", "application name (default: repo or folder name)")
+	instance := fs.String("instance", "", "instance name (default: worktree or branch name)")
+	service := fs.String("service", "", "only this service")
+	var labels stringList
+	fs.Var(&labels, "label", "filter by label key=value (repeatable)")
+	name := fs.String("name", defaultEnvName, "variable name template; {app}, {instance} and {service} are replaced")
+	format := fs.String("format", "dotenv", "output format: dotenv, export, fish or json")
+	write := fs.String("write", "", "update these variables in a .env file instead of printing them")
+	fs.Parse(args)
+
+	labelMap, err := parseLabels(labels)
+	if err != nil {
+		fail(err)
+	}
+	switch *format {
+	case "dotenv", "export", "fish", "json":
+	default:
+		fmt.Fprintln(os.Stderr, ui.Errorf("unknown format %q: want dotenv, export, fish or json", *format))
+		os.Exit(1)
+	}
+
+	if *app == "" {
+		*app = detectAppName()
+	}
+	if *instance == "" {
+		*instance = detectInstanceName()
+	}
+
+	allocs, err := c.List(ctx, portregistry.Filter{
+		App:      *app,
+		Instance: *instance,
+		Service:  *service,
+		Labels:   labelMap,
+	})
+	if err != nil {
+		fail(err)
+	}
+	vars, err := envVars(allocs, *name)
+	if err != nil {
+		fail(err)
+	}
+
+	if *write != "" {
+		if err := dotenv.WriteFile(*write, vars); err != nil {
+			fail(err)
+		}
+		fmt.Println(ui.Successf("Wrote %d variable(s) to %s", len(vars), *write))
+		return
+	}
+	if len(vars) == 0 {
+		fmt.Fprintln(os.Stderr, ui.Info("No allocations"))
+	}
+	printEnv(vars, *format)
+}
+
+// envVars maps allocations to variables named by the template tmpl, sorted
+// by name. Two allocations may not map to the same name.
+func envVars(allocs []portregistry.Allocation, tmpl string) ([]dotenv.Var, error) {
+	vars := make([]dotenv.Var, 0, len(allocs))
+	owner := make(map[string]portregistry.Allocation, len(allocs))
+	for _, a := range allocs {
+		key := envName(tmpl, a)
+		if prev, ok := owner[key]; ok {
+			return nil, fmt.Errorf("%s/%s/%s and %s/%s/%s both map to %s; use a --name template with {app} or {instance}",
+				prev.App, prev.Instance, prev.Service, a.App, a.Instance, a.Service, key)
+		}
+		owner[key] = a
+		vars = append(vars, dotenv.Var{Key: key, Value: strconv.Itoa(a.Port)})
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Key < vars[j].Key })
+	return vars, nil
+}
+
+// envName expands tmpl for a and turns the result into a valid variable
+// name: upper case, with any character other than a letter, digit or
+// underscore replaced by an underscore.
+func envName(tmpl string, a portregistry.Allocation) string {
+	name := strings.NewReplacer("{app}", a.App, "{instance}", a.Instance, "{service}", a.Service).Replace(tmpl)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// printEnv prints vars in format. Values are port numbers, so none need quoting.
+func printEnv(vars []dotenv.Var, format string) {
+	if format == "json" {
+		m := make(map[string]string, len(vars))
+		for _, v := range vars {
+			m[v.Key] = v.Value
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(m)
+		return
+	}
+	for _, v := range vars {
+		switch format {
+		case "export":
+			fmt.Printf("export %s=%s\n", v.Key, v.Value)
+		case "fish":
+			fmt.Printf("set -gx %s %s\n", v.Key, v.Value)
+		default:
+			fmt.Printf("%s=%s\n", v.Key, v.Value)
+		}
+	}
+}
+
+func cmdHistory(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	app := fs.String("app", "", "filter by application (default: repo or folder name, unless --port is set)")
+	instance := fs.String("instance", "", "filter by instance")
+	service := fs.String("service", "", "filter by service")
+	port := fs.Int("port", 0, "filter by port")
+	since := fs.String("since", "", "only events after this time (RFC 3339) or duration ago (e.g. 24h)")
+	limit := fs.Int("limit", 50, "show at most this many recent events (0 = all)")
+	jsonOut := fs.Bool("json", false, "output as JSON")
+	fs.Parse(args)
+
+	f := portregistry.EventFilter{
+		App:      *app,
+		Instance: *instance,
+		Service:  *service,
+		Port:     *port,
+		Limit:    *limit,
+	}
+	if f.App == "" && f.Port == 0 {
+		f.App = detectAppName()
+	}
+	if *since != "" {
+		if t, err := time.Parse(time.RFC3339, *since); err == nil {
+			f.Since = t
+		} else if d, err := time.ParseDuration(*since); err == nil {
+			f.Since = time.Now().Add(-d)
+		} else {
+			fmt.Fprintln(os.Stderr, ui.Errorf("invalid --since %q: want an RFC 3339 time or a duration", *since))
+			os.Exit(1)
+		}
+	}
+
+	events, err := c.ListEvents(ctx, f)
+	if err != nil {
+		fail(err)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(events)
+		return
+	}
+
+	if len(events) == 0 {
+		fmt.Println(ui.Info("No events"))
+		return
+	}
+
+	rows := make([][]string, len(events))
+	for i, e := range events {
+		port := "-"
+		if e.Port != 0 {
+			port = strconv.Itoa(e.Port)
+		}
+		rows[i] = []string{
+			e.CreatedAt.Format("2006-01-02 15:04:05"),
+			e.Type,
+			e.App,
+			e.Instance,
+			e.Service,
+			port,
+			orDash(e.Actor),
+			orDash(e.Source),
+			e.Detail,
+		}
+	}
+	fmt.Println(ui.Table(
+		[]string{"TIME", "EVENT", "APP", "INSTANCE", "SERVICE", "PORT", "ACTOR", "SOURCE", "DETAIL"},
+		rows,
+	))
+}
+
+func cmdWatch(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	app := fs.String("app", "", "watch an application (default: repo or folder name)")
+	instance := fs.String("instance", "", "watch an instance")
+	all := fs.Bool("all", false, "watch every application")
+	jsonOut := fs.Bool("json", false, "print one JSON event per line")
+	fs.Parse(args)
+
+	f := portregistry.EventFilter{App: *app, Instance: *instance}
+	if *all {
+		f.App, f.Instance = "", ""
+	} else if f.App == "" {
+		f.App = detectAppName()
+	}
+
+	stream, err := c.Watch(ctx, f)
+	if err != nil {
+		fail(err)
+	}
+	if !*jsonOut {
+		scope := "all apps"
+		if f.App != "" {
+			scope = f.App
+			if f.Instance != "" {
+				scope += "/" + f.Instance
+			}
+		}
+		fmt.Fprintln(os.Stderr, ui.Subtle("Watching "+scope+" (Ctrl-C to stop)"))
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for e := range stream.Events {
+		if *jsonOut {
+			enc.Encode(e)
+			continue
+		}
+		line := fmt.Sprintf("%s  %-8s %s/%s/%s  port %d",
+			e.CreatedAt.Format("2006-01-02 15:04:05"), e.Type, e.App, e.Instance, e.Service, e.Port)
+		if e.Actor != "" {
+			line += "  by " + e.Actor
+		}
+		if e.Type == portregistry.EventRelease {
+			fmt.Println(ui.Subtle(line))
+		} else {
+			fmt.Println(line)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		fail(err)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func cmdCheck(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	port := fs.Int("port", 0, "port to check (required)")
+	proto := fs.String("proto", portregistry.ProtoTCP, "protocol to check: tcp, udp or both (either)")
+	fs.Parse(args)
+
+	if *port == 0 {
+		fmt.Fprintln(os.Stderr, ui.Error("--port is required"))
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	status, err := c.CheckPortProto(ctx, *port, *proto)
+	if err != nil {
+		fail(err)
+	}
+
+	if status.Available {
+		fmt.Println(ui.Successf("Port %d is available for %s", *port, *proto))
+		os.Exit(0)
+	}
+
+	fmt.Println(ui.Warningf("Port %s is allocated to %s/%s/%s %s",
+		formatPort(status.Holder), status.Holder.App, status.Holder.Instance, status.Holder.Service,
+		ui.Subtle(fmt.Sprintf("(id=%d)", status.Holder.ID))))
+	os.Exit(1)
+}
+
+// cmdWho shows the processes listening on a port of the server's host, and
+// the port's allocation. It exits 1 if nothing listens.
+func cmdWho(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("who", flag.ExitOnError)
+	port := fs.Int("port", 0, "port to look up (required)")
+	jsonOut := fs.Bool("json", false, "output as JSON")
+	fs.Parse(args)
+
+	if *port == 0 {
+		fmt.Fprintln(os.Stderr, ui.Error("--port is required"))
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	pl, err := c.PortListeners(ctx, *port)
+	if err != nil {
+		fail(err)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(pl)
+		if len(pl.Listeners) == 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(pl.Listeners) > 0 {
+		rows := make([][]string, len(pl.Listeners))
+		for i, l := range pl.Listeners {
+			pid := "-"
+			if l.PID != 0 {
+				pid = strconv.Itoa(l.PID)
+			}
+			rows[i] = []string{l.Proto, l.Address, pid, orDash(l.Process), orDash(l.Container), orDash(strings.Join(l.Cmdline, " "))}
+		}
+		fmt.Println(ui.Table([]string{"PROTO", "ADDRESS", "PID", "PROCESS", "CONTAINER", "COMMAND"}, rows))
+	}
+
+	for _, a := range pl.Allocations {
+		fmt.Println(ui.Infof("Port %s is allocated to %s/%s/%s %s",
+			formatPort(&a), a.App, a.Instance, a.Service, ui.Subtle(fmt.Sprintf("(id=%d)", a.ID))))
+	}
+	if len(pl.Allocations) == 0 && len(pl.Listeners) > 0 {
+		fmt.Println(ui.Warningf("Port %d is not allocated in the registry", *port))
+	}
+	if len(pl.Listeners) == 0 {
+		fmt.Println(ui.Infof("Nothing is listening on port %d", *port))
+		os.Exit(1)
 	}
-	c := client.New(addr)
+}
 
-	switch os.Args[1] {
-	case "allocate":
-		cmdAllocate(c, os.Args[2:])
-	case "release":
-		cmdRelease(c, os.Args[2:])
-	case "list":
-		cmdList(c, os.Args[2:])
-	case "check":
-		cmdCheck(c, os.Args[2:])
-	case "health":
-		cmdHealth(c)
-	default:
-		fmt.Fprintln(os.Stderr, ui.Errorf("unknown command: %s", os.Args[1]))
-		usage()
-		os.Exit(1)
+// cmdAudit reports the differences between the allocations and the ports
+// listening on the server's host. It exits 1 if there are any.
+func cmdAudit(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "output as JSON")
+	fs.Parse(args)
+
+	findings, err := c.Audit(ctx)
+	if err != nil {
+		fail(err)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(findings)
+		if len(findings) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(findings) == 0 {
+		fmt.Println(ui.Success("Allocations match the listening ports"))
+		return
 	}
+
+	rows := make([][]string, len(findings))
+	for i, f := range findings {
+		owner := "-"
+		a := f.Allocation
+		if a != nil {
+			owner = fmt.Sprintf("%s/%s/%s", a.App, a.Instance, a.Service)
+		}
+		var kind, detail string
+		switch f.Kind {
+		case portregistry.AuditNotListening:
+			kind, detail = ui.StyleWarning.Render(f.Kind), "nothing listens on the port"
+		case portregistry.AuditUnregistered:
+			kind, detail = ui.StyleWarning.Render(f.Kind), describeListeners(f.Listeners)
+		case portregistry.AuditRepoMismatch:
+			kind = ui.StyleError.Render(f.Kind)
+			detail = describeListeners(f.Listeners) + " runs from " + filepath.Dir(f.Repo)
+			if a != nil && a.Git != nil {
+				detail += ", allocated from " + filepath.Dir(a.Git.Repo)
+			}
+		default:
+			kind = f.Kind
+		}
+		rows[i] = []string{strconv.Itoa(f.Port), kind, owner, detail}
+	}
+	fmt.Println(ui.Table([]string{"PORT", "KIND", "ALLOCATION", "DETAIL"}, rows))
+	fmt.Println(ui.Warningf("%d finding(s)", len(findings)))
+	os.Exit(1)
 }
 
-func usage() {
-	fmt.Fprintln(os.Stderr, ui.UsageTitle("Usage: portctl <command> [flags]"))
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, ui.UsageHeader("Server lifecycle:"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("start", "Start the port-registry daemon"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("stop", "Stop the port-registry daemon"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("restart", "Restart the port-registry daemon"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("status", "Show port-registry daemon status"))
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, ui.UsageHeader("Commands:"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("allocate", "Allocate a port"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("release", "Release port(s)"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("list", "List allocations"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("check", "Check if a port is available"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("health", "Check server health"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("version", "Print version and exit"))
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, ui.UsageHeader("Skills:"))
-	fmt.Fprintln(os.Stderr, ui.UsageCommand("skill", "Manage agent skills"))
+// describeListeners names the processes of listeners, e.g. "python3 (pid 42)".
+func describeListeners(listeners []portregistry.Listener) string {
+	var names []string
+	for _, l := range listeners {
+		name := "unknown process"
+		if l.PID != 0 {
+			name = fmt.Sprintf("%s (pid %d)", l.Process, l.PID)
+		}
+		if l.Container != "" {
+			name += " in container " + l.Container
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
 }
 
-func detectAppName() string {
-	// --git-common-dir returns the main repo's .git dir, even from linked worktrees.
-	out, err := exec.Command("git", "rev-parse", "--path-format=absolute", "--git-common-dir").Output()
-	if err == nil {
-		gitDir := strings.TrimSpace(string(out)) // e.g. /path/to/repo/.git
-		return filepath.Base(filepath.Dir(gitDir))
+func cmdRange(ctx context.Context, c *portregistry.Client, args []string) {
+	if len(args) == 0 {
+		rangeUsage()
+		os.Exit(1)
 	}
-	cwd, err := os.Getwd()
-	if err != nil {
-		return ""
+	switch args[0] {
+	case "list":
+		cmdRangeList(ctx, c, args[1:])
+	case "set":
+		cmdRangeSet(ctx, c, args[1:])
+	case "unset":
+		cmdRangeUnset(ctx, c, args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, ui.Errorf("unknown range command: %s", args[0]))
+		rangeUsage()
+		os.Exit(1)
 	}
-	return filepath.Base(cwd)
 }
 
-func detectInstanceName() string {
-	wtOut, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+func cmdRangeList(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("range list", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "output as JSON")
+	fs.Parse(args)
+
+	ranges, err := c.ListRanges(ctx)
 	if err != nil {
-		return ""
+		fail(err)
 	}
-	worktreeRoot := strings.TrimSpace(string(wtOut))
 
-	cdOut, err := exec.Command("git", "rev-parse", "--path-format=absolute", "--git-common-dir").Output()
-	if err != nil {
-		return ""
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(ranges)
+		return
 	}
-	mainRoot := filepath.Dir(strings.TrimSpace(string(cdOut)))
 
-	if worktreeRoot != mainRoot {
-		// Linked worktree — use the worktree directory name.
-		return filepath.Base(worktreeRoot)
+	rows := [][]string{{ui.Subtle("(default)"), fmt.Sprintf("%d-%d", ranges.Default.Min, ranges.Default.Max)}}
+	for _, r := range ranges.Apps {
+		rows = append(rows, []string{r.App, fmt.Sprintf("%d-%d", r.Min, r.Max)})
 	}
+	fmt.Println(ui.Table([]string{"APP", "RANGE"}, rows))
+}
 
-	// Main worktree — use the current branch name.
-	brOut, err := exec.Command("git", "branch", "--show-current").Output()
+func cmdRangeSet(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("range set", flag.ExitOnError)
+	app := fs.String("app", "", "application name (default: repo or folder name)")
+	pos := parseArgs(fs, args)
+
+	if *app == "" {
+		*app = detectAppName()
+	}
+	if *app == "" || len(pos) != 1 {
+		fmt.Fprintln(os.Stderr, ui.Error("usage: portctl range set [--app <name>] <min>-<max>"))
+		os.Exit(1)
+	}
+	min, max, err := config.ParsePortRange(pos[0])
 	if err != nil {
-		return ""
+		fail(err)
 	}
-	return strings.TrimSpace(string(brOut))
+
+	if err := c.SetRange(ctx, portregistry.PortRange{App: *app, Min: min, Max: max}); err != nil {
+		fail(err)
+	}
+	fmt.Println(ui.Successf("Set range %d-%d for %s", min, max, *app))
 }
 
-func cmdAllocate(c *client.Client, args []string) {
-	fs := flag.NewFlagSet("allocate", flag.ExitOnError)
+func cmdRangeUnset(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("range unset", flag.ExitOnError)
 	app := fs.String("app", "", "application name (default: repo or folder name)")
-	instance := fs.String("instance", "", "instance name (default: worktree or branch name)")
-	service := fs.String("service", "", "service name (required)")
-	port := fs.Int("port", 0, "specific port to allocate (0 = auto-assign)")
 	fs.Parse(args)
 
 	if *app == "" {
 		*app = detectAppName()
 	}
-	if *instance == "" {
-		*instance = detectInstanceName()
-	}
-	if *app == "" || *instance == "" || *service == "" {
-		fmt.Fprintln(os.Stderr, ui.Error("--app, --instance, and --service are required (could not auto-detect missing values)"))
-		fs.Usage()
+	if *app == "" {
+		fmt.Fprintln(os.Stderr, ui.Error("--app is required (could not auto-detect)"))
 		os.Exit(1)
 	}
 
-	alloc, err := c.Allocate(model.AllocateRequest{
-		App:      *app,
-		Instance: *instance,
-		Service:  *service,
-		Port:     *port,
-	})
-	if err == store.ErrServiceAllocated {
-		fmt.Fprintln(os.Stderr, ui.Errorf("%s/%s/%s is already allocated on port %d %s",
-			alloc.App, alloc.Instance, alloc.Service, alloc.Port, ui.Subtle(fmt.Sprintf("(id=%d)", alloc.ID))))
-		os.Exit(1)
+	if err := c.DeleteRange(ctx, *app); errors.Is(err, portregistry.ErrNotFound) {
+		fmt.Fprintln(os.Stderr, ui.Errorf("no range set for %s", *app))
+		os.Exit(exitNotFound)
+	} else if err != nil {
+		fail(err)
+	}
+	fmt.Println(ui.Successf("Removed range for %s %s", *app, ui.Subtle("(using the default range)")))
+}
+
+func rangeUsage() {
+	fmt.Fprintln(os.Stderr, ui.UsageTitle("Usage: portctl range <command>"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, ui.UsageHeader("Commands:"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("list", "Show the default range and per-app ranges"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("set", "Set the app's range, e.g. range set --app myapp 40000-40999"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("unset", "Remove the app's range and fall back to the default"))
+}
+
+// parseArgs parses fs, allowing flags to follow positional arguments
+// (e.g. "exclude add 5432 --reason postgres"), and returns the positionals.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var pos []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return pos
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
 	}
-	if err == store.ErrPortTaken {
-		fmt.Fprintln(os.Stderr, ui.Errorf("port %d is already allocated to %s/%s/%s %s",
-			alloc.Port, alloc.App, alloc.Instance, alloc.Service, ui.Subtle(fmt.Sprintf("(id=%d)", alloc.ID))))
+}
+
+func cmdExclude(ctx context.Context, c *portregistry.Client, args []string) {
+	if len(args) == 0 {
+		excludeUsage()
 		os.Exit(1)
 	}
-	if err == store.ErrPortBusy {
-		fmt.Fprintln(os.Stderr, ui.Errorf("port %d is in use on the system", *port))
+	switch args[0] {
+	case "list":
+		cmdExcludeList(ctx, c, args[1:])
+	case "add":
+		cmdExcludeAdd(ctx, c, args[1:])
+	case "remove":
+		cmdExcludeRemove(ctx, c, args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, ui.Errorf("unknown exclude command: %s", args[0]))
+		excludeUsage()
 		os.Exit(1)
 	}
+}
+
+func cmdExcludeList(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("exclude list", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "output as JSON")
+	fs.Parse(args)
+
+	excl, err := c.ListExclusions(ctx)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
-		os.Exit(1)
+		fail(err)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(excl)
+		return
 	}
 
-	fmt.Println(ui.Successf("Allocated port %d for %s/%s/%s %s",
-		alloc.Port, alloc.App, alloc.Instance, alloc.Service, ui.Subtle(fmt.Sprintf("(id=%d)", alloc.ID))))
+	if len(excl) == 0 {
+		fmt.Println(ui.Info("No exclusions"))
+		return
+	}
+
+	rows := make([][]string, len(excl))
+	for i, e := range excl {
+		rows[i] = []string{fmt.Sprintf("%d", e.ID), formatPortRange(e.Min, e.Max), e.Reason}
+	}
+	fmt.Println(ui.Table([]string{"ID", "PORTS", "REASON"}, rows))
 }
 
-func cmdRelease(c *client.Client, args []string) {
-	fs := flag.NewFlagSet("release", flag.ExitOnError)
-	id := fs.Int64("id", 0, "allocation ID to release")
-	app := fs.String("app", "", "application name (default: repo or folder name)")
-	instance := fs.String("instance", "", "instance name (default: worktree or branch name)")
-	service := fs.String("service", "", "service name")
-	port := fs.Int("port", 0, "port to release")
-	fs.Parse(args)
+func cmdExcludeAdd(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("exclude add", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the ports are excluded")
+	pos := parseArgs(fs, args)
 
-	if *app == "" {
-		*app = detectAppName()
+	if len(pos) != 1 {
+		fmt.Fprintln(os.Stderr, ui.Error("usage: portctl exclude add <port|min-max> [--reason <text>]"))
+		os.Exit(1)
 	}
-	if *instance == "" {
-		*instance = detectInstanceName()
+	min, max, err := config.ParsePortRange(pos[0])
+	if err != nil {
+		fail(err)
 	}
 
-	if *id != 0 {
-		if err := c.ReleaseByID(*id); err == store.ErrNotFound {
-			fmt.Fprintln(os.Stderr, ui.Errorf("allocation %d not found", *id))
+	excl, err := c.AddExclusion(ctx, portregistry.Exclusion{Min: min, Max: max, Reason: *reason})
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(ui.Successf("Excluded %s %s", formatPortRange(excl.Min, excl.Max), ui.Subtle(fmt.Sprintf("(id=%d)", excl.ID))))
+}
+
+func cmdExcludeRemove(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("exclude remove", flag.ExitOnError)
+	id := fs.Int64("id", 0, "exclusion ID to remove")
+	pos := parseArgs(fs, args)
+
+	if *id == 0 {
+		if len(pos) != 1 {
+			fmt.Fprintln(os.Stderr, ui.Error("usage: portctl exclude remove <port|min-max> | --id <number>"))
 			os.Exit(1)
-		} else if err != nil {
-			fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
+		}
+		min, max, err := config.ParsePortRange(pos[0])
+		if err != nil {
+			fail(err)
+		}
+		excl, err := c.ListExclusions(ctx)
+		if err != nil {
+			fail(err)
+		}
+		for _, e := range excl {
+			if e.Min == min && e.Max == max {
+				*id = e.ID
+				break
+			}
+		}
+		if *id == 0 {
+			fmt.Fprintln(os.Stderr, ui.Errorf("no exclusion matches %s %s", pos[0], ui.Subtle("(see portctl exclude list)")))
 			os.Exit(1)
 		}
-		fmt.Println(ui.Successf("Released allocation %d", *id))
-		return
 	}
 
-	if *app == "" && *port == 0 {
-		fmt.Fprintln(os.Stderr, ui.Error("--id, --app, or --port is required"))
-		fs.Usage()
-		os.Exit(1)
+	if err := c.DeleteExclusion(ctx, *id); errors.Is(err, portregistry.ErrNotFound) {
+		fmt.Fprintln(os.Stderr, ui.Errorf("exclusion %d not found", *id))
+		os.Exit(exitNotFound)
+	} else if err != nil {
+		fail(err)
 	}
+	fmt.Println(ui.Successf("Removed exclusion %d", *id))
+}
 
-	n, err := c.ReleaseByFilter(model.ReleaseRequest{
-		App:      *app,
-		Instance: *instance,
-		Service:  *service,
-		Port:     *port,
-	})
-	if err != nil {
-		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
+func formatPortRange(min, max int) string {
+	if min == max {
+		return strconv.Itoa(min)
+	}
+	return fmt.Sprintf("%d-%d", min, max)
+}
+
+func excludeUsage() {
+	fmt.Fprintln(os.Stderr, ui.UsageTitle("Usage: portctl exclude <command>"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, ui.UsageHeader("Commands:"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("list", "List excluded ports and ranges"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("add", "Exclude a port or range, e.g. exclude add 5432 --reason postgres"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("remove", "Remove an exclusion by port/range or --id"))
+}
+
+func cmdToken(ctx context.Context, c *portregistry.Client, args []string) {
+	if len(args) == 0 {
+		tokenUsage()
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "create":
+		cmdTokenCreate(ctx, c, args[1:])
+	case "list":
+		cmdTokenList(ctx, c, args[1:])
+	case "revoke":
+		cmdTokenRevoke(ctx, c, args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, ui.Errorf("unknown token command: %s", args[0]))
+		tokenUsage()
 		os.Exit(1)
 	}
-	fmt.Println(ui.Successf("Released %d allocation(s)", n))
 }
 
-func cmdList(c *client.Client, args []string) {
-	fs := flag.NewFlagSet("list", flag.ExitOnError)
-	app := fs.String("app", "", "filter by application (default: repo or folder name)")
-	instance := fs.String("instance", "", "filter by instance (default: worktree or branch name)")
-	service := fs.String("service", "", "filter by service")
-	jsonOut := fs.Bool("json", false, "output as JSON")
+func cmdTokenCreate(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("token create", flag.ExitOnError)
+	name := fs.String("name", "", "token name, recorded as the actor of its changes (required)")
+	scope := fs.String("scope", portregistry.ScopeAllocate, "read, allocate or admin")
+	appPrefix := fs.String("app-prefix", "", "restrict access to apps with this name prefix")
 	fs.Parse(args)
 
-	if *app == "" {
-		*app = detectAppName()
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, ui.Error("--name is required"))
+		fs.Usage()
+		os.Exit(1)
 	}
-	if *instance == "" {
-		*instance = detectInstanceName()
+
+	created, err := c.CreateToken(ctx, portregistry.CreateTokenRequest{Name: *name, Scope: *scope, AppPrefix: *appPrefix})
+	if err != nil {
+		fail(err)
 	}
+	fmt.Fprintln(os.Stderr, ui.Successf("Created %s token %q %s", created.Scope, created.Name, ui.Subtle(fmt.Sprintf("(id=%d)", created.ID))))
+	fmt.Fprintln(os.Stderr, ui.Info("Store it now; it cannot be shown again. Use it with PORT_REGISTRY_TOKEN."))
+	fmt.Println(created.Secret)
+}
 
-	allocs, err := c.List(store.Filter{
-		App:      *app,
-		Instance: *instance,
-		Service:  *service,
-	})
+func cmdTokenList(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("token list", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "output as JSON")
+	fs.Parse(args)
+
+	tokens, err := c.ListTokens(ctx)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
-		os.Exit(1)
+		fail(err)
 	}
 
 	if *jsonOut {
 		enc := json.NewEncoder(os.Stdout)
 		enc.SetIndent("", "  ")
-		enc.Encode(allocs)
+		enc.Encode(tokens)
 		return
 	}
 
-	if len(allocs) == 0 {
-		fmt.Println(ui.Info("No allocations"))
+	if len(tokens) == 0 {
+		fmt.Println(ui.Info("No tokens"))
 		return
 	}
 
-	rows := make([][]string, len(allocs))
-	for i, a := range allocs {
+	rows := make([][]string, len(tokens))
+	for i, t := range tokens {
 		rows[i] = []string{
-			fmt.Sprintf("%d", a.ID),
-			a.App,
-			a.Instance,
-			a.Service,
-			fmt.Sprintf("%d", a.Port),
-			a.CreatedAt.Format("2006-01-02 15:04:05"),
+			fmt.Sprintf("%d", t.ID),
+			t.Name,
+			t.Scope,
+			orDash(t.AppPrefix),
+			t.CreatedAt.Format("2006-01-02 15:04:05"),
 		}
 	}
-	fmt.Println(ui.Table(
-		[]string{"ID", "APP", "INSTANCE", "SERVICE", "PORT", "CREATED"},
-		rows,
-	))
+	fmt.Println(ui.Table([]string{"ID", "NAME", "SCOPE", "APP PREFIX", "CREATED"}, rows))
 }
 
-func cmdCheck(c *client.Client, args []string) {
-	fs := flag.NewFlagSet("check", flag.ExitOnError)
-	port := fs.Int("port", 0, "port to check (required)")
-	fs.Parse(args)
+func cmdTokenRevoke(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("token revoke", flag.ExitOnError)
+	pos := parseArgs(fs, args)
 
-	if *port == 0 {
-		fmt.Fprintln(os.Stderr, ui.Error("--port is required"))
-		fs.Usage()
+	if len(pos) != 1 {
+		fmt.Fprintln(os.Stderr, ui.Error("usage: portctl token revoke <id>"))
 		os.Exit(1)
 	}
-
-	status, err := c.CheckPort(*port)
+	id, err := strconv.ParseInt(pos[0], 10, 64)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
+		fmt.Fprintln(os.Stderr, ui.Errorf("invalid token id %q", pos[0]))
 		os.Exit(1)
 	}
 
-	if status.Available {
-		fmt.Println(ui.Successf("Port %d is available", *port))
-		os.Exit(0)
+	if err := c.DeleteToken(ctx, id); errors.Is(err, portregistry.ErrNotFound) {
+		fmt.Fprintln(os.Stderr, ui.Errorf("token %d not found", id))
+		os.Exit(exitNotFound)
+	} else if err != nil {
+		fail(err)
 	}
+	fmt.Println(ui.Successf("Revoked token %d", id))
+}
 
-	fmt.Println(ui.Warningf("Port %d is allocated to %s/%s/%s %s",
-		*port, status.Holder.App, status.Holder.Instance, status.Holder.Service,
-		ui.Subtle(fmt.Sprintf("(id=%d)", status.Holder.ID))))
-	os.Exit(1)
+func tokenUsage() {
+	fmt.Fprintln(os.Stderr, ui.UsageTitle("Usage: portctl token <command>"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, ui.UsageHeader("Commands:"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("create", "Create a token, e.g. token create --name ci --scope read"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("list", "List tokens"))
+	fmt.Fprintln(os.Stderr, ui.UsageCommand("revoke", "Revoke a token by ID"))
 }
 
-func cmdHealth(c *client.Client) {
-	if err := c.Health(); err != nil {
-		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
-		os.Exit(1)
+func cmdHealth(ctx context.Context, c *portregistry.Client) {
+	if err := c.Health(ctx); err != nil {
+		fail(err)
 	}
 	fmt.Println(ui.Success("Healthy"))
 }
 
-func cmdStart() {
+// cmdStart starts the server in the background. Extra arguments are passed
+// through as server flags, e.g. portctl start -auth.
+func cmdStart(serverArgs []string) {
 	// Check if already running.
 	if pid, ok := readPID(); ok {
 		if isProcessAlive(pid) {
@@ -363,8 +1624,13 @@ func cmdStart() {
 		os.Exit(1)
 	}
 
-	// Start detached process.
-	cmd := exec.Command(serverBin)
+	// Start detached process, listening wherever the client will connect.
+	addr := serverAddr()
+	var args []string
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		args = append(args, "-socket", path)
+	}
+	cmd := exec.Command(serverBin, append(args, serverArgs...)...)
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
@@ -376,19 +1642,14 @@ func cmdStart() {
 	logFile.Close()
 
 	// Wait briefly for the server to become healthy.
-	addr := fmt.Sprintf("127.0.0.1:%d", config.DefaultServerPort)
-	healthURL := "http://" + addr + "/healthz"
-	healthClient := &http.Client{Timeout: time.Second}
+	c := newClient(addr, portregistry.WithRetries(0))
+	ctx := context.Background()
 	healthy := false
 	for i := 0; i < startHealthRetries; i++ {
 		time.Sleep(startHealthInterval)
-		resp, err := healthClient.Get(healthURL)
-		if err == nil {
-			resp.Body.Close()
-			if resp.StatusCode == 200 {
-				healthy = true
-				break
-			}
+		if c.Health(ctx) == nil {
+			healthy = true
+			break
 		}
 	}
 
@@ -418,8 +1679,7 @@ func cmdStop() {
 	// Send SIGTERM.
 	proc, err := os.FindProcess(pid)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, ui.Errorf("%v", err))
-		os.Exit(1)
+		fail(err)
 	}
 	if err := proc.Signal(syscall.SIGTERM); err != nil {
 		fmt.Fprintln(os.Stderr, ui.Errorf("failed to stop port-registry: %v", err))
@@ -455,17 +1715,10 @@ func cmdStatus() {
 	}
 
 	// Check health endpoint.
-	addr := fmt.Sprintf("127.0.0.1:%d", config.DefaultServerPort)
-	healthURL := "http://" + addr + "/healthz"
-	healthClient := &http.Client{Timeout: time.Second}
-	resp, err := healthClient.Get(healthURL)
-	if err == nil {
-		resp.Body.Close()
-		if resp.StatusCode == 200 {
-			fmt.Println(ui.Successf("Server is running %s",
-				ui.Subtle(fmt.Sprintf("(pid %d)", pid))+" "+ui.StyleSuccess.Render("healthy")))
-			return
-		}
+	if newClient(serverAddr()).Health(context.Background()) == nil {
+		fmt.Println(ui.Successf("Server is running %s",
+			ui.Subtle(fmt.Sprintf("(pid %d)", pid))+" "+ui.StyleSuccess.Render("healthy")))
+		return
 	}
 
 	fmt.Println(ui.Warningf("Server is running %s",
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/n3r/port-registry/internal/dotenv"
+	"github.com/n3r/port-registry/internal/handler"
+	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
+	"github.com/n3r/port-registry/pkg/portregistry"
+)
+
+func needShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not installed")
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	needShell(t)
+	out := filepath.Join(t.TempDir(), "env")
+	vars := []dotenv.Var{{Key: "WEB_PORT", Value: "3000"}}
+	if code := runCommand([]string{"sh", "-c", `echo "$WEB_PORT" > "$1"; exit 3`, "sh", out}, vars); code != 3 {
+		t.Errorf("expected the command's exit code 3, got %d", code)
+	}
+	if data, _ := os.ReadFile(out); strings.TrimSpace(string(data)) != "3000" {
+		t.Errorf("expected WEB_PORT=3000 in the command's environment, got %q", data)
+	}
+
+	if code := runCommand([]string{"sh", "-c", "kill -KILL $$"}, nil); code != 128+int(syscall.SIGKILL) {
+		t.Errorf("expected 128+SIGKILL for a killed command, got %d", code)
+	}
+	if code := runCommand([]string{filepath.Join(t.TempDir(), "missing")}, nil); code != 127 {
+		t.Errorf("expected 127 for a command that cannot start, got %d", code)
+	}
+}
+
+func TestRunCommandForwardsSignals(t *testing.T) {
+	needShell(t)
+	started := filepath.Join(t.TempDir(), "started")
+	go func() {
+		for range 100 {
+			if _, err := os.Stat(started); err == nil {
+				self, _ := os.FindProcess(os.Getpid())
+				self.Signal(syscall.SIGTERM)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	code := runCommand([]string{"sh", "-c", `touch "$1"; exec sleep 10`, "sh", started}, nil)
+	if code != 128+int(syscall.SIGTERM) {
+		t.Errorf("expected the forwarded SIGTERM to end the command with %d, got %d", 128+int(syscall.SIGTERM), code)
+	}
+}
+
+// testServer returns a client of a server backed by a fresh store.
+func testServer(t *testing.T) (*store.SQLiteStore, *portregistry.Client) {
+	t.Helper()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PortChecker = nil
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(handler.New(s).Routes())
+	t.Cleanup(srv.Close)
+	return s, portregistry.New(srv.Listener.Addr().String())
+}
+
+func TestReleaseNew(t *testing.T) {
+	s, c := testServer(t)
+
+	kept, _ := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "db"}, 3000, 3999)
+	added, _ := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "web"}, 3000, 3999)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // as after an interrupt
+	releaseNew(ctx, c, []portregistry.Allocation{*kept, *added}, map[int64]bool{kept.ID: true})
+
+	allocs, err := s.List(store.Filter{App: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 1 || allocs[0].ID != kept.ID {
+		t.Errorf("expected only the existing allocation to remain, got %+v", allocs)
+	}
+}
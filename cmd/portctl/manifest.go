@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/n3r/port-registry/internal/manifest"
+	"github.com/n3r/port-registry/internal/ui"
+	"github.com/n3r/port-registry/pkg/portregistry"
+)
+
+// manifestFlags are the flags shared by apply and diff.
+type manifestFlags struct {
+	file     *string
+	app      *string
+	instance *string
+}
+
+func addManifestFlags(fs *flag.FlagSet) *manifestFlags {
+	return &manifestFlags{
+		file:     fs.String("f", "", "manifest file (default: "+manifest.FileName+" at the repository root)"),
+		app:      fs.String("app", "", "application name (default: the manifest's app, or repo or folder name)"),
+		instance: fs.String("instance", "", "instance name (default: worktree or branch name)"),
+	}
+}
+
+// load reads the manifest and fills in app and instance.
+func (f *manifestFlags) load() *manifest.Manifest {
+	if *f.file == "" {
+		*f.file = manifestPath()
+	}
+	m, err := manifest.Load(*f.file)
+	if err != nil {
+		fail(err)
+	}
+	if *f.app == "" {
+		*f.app = m.App
+	}
+	if *f.app == "" {
+		*f.app = detectAppName()
+	}
+	if *f.instance == "" {
+		*f.instance = detectInstanceName()
+	}
+	if *f.app == "" || *f.instance == "" {
+		fmt.Fprintln(os.Stderr, ui.Error("--app and --instance are required (could not auto-detect)"))
+		os.Exit(1)
+	}
+	return m
+}
+
+// manifestPath returns the manifest at the root of the current repository,
+// or in the current directory outside one.
+func manifestPath() string {
+	out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return manifest.FileName
+	}
+	return filepath.Join(strings.TrimSpace(string(out)), manifest.FileName)
+}
+
+// diffManifest compares the manifest with the instance's allocations.
+func diffManifest(ctx context.Context, c *portregistry.Client, m *manifest.Manifest, app, instance string) []manifest.Change {
+	allocs, err := c.List(ctx, portregistry.Filter{App: app, Instance: instance})
+	if err != nil {
+		fail(err)
+	}
+	return m.Diff(allocs)
+}
+
+func printChanges(changes []manifest.Change) {
+	rows := make([][]string, len(changes))
+	for i, ch := range changes {
+		port := ""
+		if ch.Alloc != nil {
+			port = strconv.Itoa(ch.Alloc.Port)
+		}
+		action := ch.Action
+		switch ch.Action {
+		case manifest.Add:
+			action = ui.StyleSuccess.Render(ch.Action)
+		case manifest.Release:
+			action = ui.StyleError.Render(ch.Action)
+		case manifest.Drift:
+			action = ui.StyleWarning.Render(ch.Action)
+		case manifest.Keep:
+			action = ui.Subtle(ch.Action)
+		}
+		rows[i] = []string{ch.Service, port, action, ch.Detail}
+	}
+	fmt.Println(ui.Table([]string{"SERVICE", "PORT", "ACTION", "DETAIL"}, rows))
+}
+
+func cmdDiff(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	f := addManifestFlags(fs)
+	fs.Parse(args)
+
+	m := f.load()
+	changes := diffManifest(ctx, c, m, *f.app, *f.instance)
+	printChanges(changes)
+
+	var add, release, drift int
+	for _, ch := range changes {
+		switch ch.Action {
+		case manifest.Add:
+			add++
+		case manifest.Release:
+			release++
+		case manifest.Drift:
+			drift++
+		}
+	}
+	if add+release+drift == 0 {
+		fmt.Println(ui.Successf("%s/%s matches %s", *f.app, *f.instance, *f.file))
+		return
+	}
+	fmt.Println(ui.Infof("%d to allocate, %d to release, %d drifted", add, release, drift))
+}
+
+func cmdApply(ctx context.Context, c *portregistry.Client, args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	f := addManifestFlags(fs)
+	fs.Parse(args)
+
+	m := f.load()
+	changes := diffManifest(ctx, c, m, *f.app, *f.instance)
+	printChanges(changes)
+
+	var reqs []portregistry.AllocateRequest
+	var releases []manifest.Change
+	drift := 0
+	for _, ch := range changes {
+		switch ch.Action {
+		case manifest.Add:
+			req := m.Request(*f.app, *f.instance, ch.Service)
+			req.Git = detectGit()
+			reqs = append(reqs, req)
+		case manifest.Release:
+			releases = append(releases, ch)
+		case manifest.Drift:
+			drift++
+		}
+	}
+
+	// Allocate first: if that fails, nothing has been released either.
+	if len(reqs) > 0 {
+		for _, a := range allocateBatch(ctx, c, reqs) {
+			printAllocated(&a, "Allocated", false)
+		}
+	}
+	for _, ch := range releases {
+		if err := c.ReleaseByID(ctx, ch.Alloc.ID); err != nil {
+			fail(err)
+		}
+		fmt.Println(ui.Successf("Released port %d for %s/%s/%s", ch.Alloc.Port, ch.Alloc.App, ch.Alloc.Instance, ch.Alloc.Service))
+	}
+	if len(reqs)+len(releases) == 0 {
+		fmt.Println(ui.Info("Nothing to change"))
+	}
+	if drift > 0 {
+		fmt.Println(ui.Warningf("%d allocation(s) differ from %s and were kept; release them to reallocate", drift, *f.file))
+	}
+}
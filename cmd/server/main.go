@@ -15,15 +15,33 @@ import (
 
 	"github.com/n3r/port-registry/internal/config"
 	"github.com/n3r/port-registry/internal/handler"
+	"github.com/n3r/port-registry/internal/metrics"
 	"github.com/n3r/port-registry/internal/store"
 	"github.com/n3r/port-registry/internal/version"
+	"github.com/n3r/port-registry/pkg/model"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "token":
+			runToken(os.Args[2:])
+			return
+		}
+	}
+
 	showVersion := flag.Bool("version", false, "print version and exit")
 	port := flag.Int("port", config.DefaultServerPort, "server listen port")
 	dbPath := flag.String("db", config.DefaultDBPath(), "SQLite database path")
 	pidFile := flag.String("pidfile", config.DefaultPIDPath(), "PID file path")
+	portRange := flag.String("range", fmt.Sprintf("%d-%d", config.DefaultPortMin, config.DefaultPortMax), "default auto-assignment port range (min-max)")
+	reapInterval := flag.Duration("reap-interval", config.DefaultReapInterval, "how often to delete expired leases")
+	socketPath := flag.String("socket", "", "also listen on a Unix socket at this path (mode 0600)")
+	listenTCP := flag.Bool("tcp", true, "listen on 127.0.0.1:<port>; disable to serve only on -socket")
+	auth := flag.Bool("auth", false, "require a bearer token on /v1 routes (create one with: port-registry token create)")
 	flag.Parse()
 
 	if *showVersion {
@@ -31,6 +49,14 @@ func main() {
 		return
 	}
 
+	portMin, portMax, err := config.ParsePortRange(*portRange)
+	if err != nil {
+		log.Fatalf("invalid -range: %v", err)
+	}
+	if !*listenTCP && *socketPath == "" {
+		log.Fatal("-tcp=false requires -socket")
+	}
+
 	// Ensure DB directory exists.
 	if err := os.MkdirAll(filepath.Dir(*dbPath), 0755); err != nil {
 		log.Fatalf("failed to create db directory: %v", err)
@@ -42,22 +68,45 @@ func main() {
 	}
 	defer s.Close()
 
-	h := handler.New(s)
+	// Graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	opts := []handler.Option{
+		handler.WithPortRange(portMin, portMax),
+		handler.WithMetrics(metrics.NewRegistry()),
+	}
+	if *auth {
+		opts = append(opts, handler.WithAuth())
+		if tokens, err := s.ListTokens(); err == nil && len(tokens) == 0 {
+			log.Println("auth enabled but no tokens exist; create one with: port-registry token create -name admin -scope admin")
+		}
+	}
+	h := handler.New(s, opts...)
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("127.0.0.1:%d", *port),
 		Handler:      h.Routes(),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
+		// Request contexts end on shutdown, which closes open watch streams.
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
-	// Graceful shutdown.
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
-
-	ln, err := net.Listen("tcp", srv.Addr)
-	if err != nil {
-		log.Fatalf("failed to listen on %s: %v", srv.Addr, err)
+	var listeners []net.Listener
+	if *listenTCP {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v", srv.Addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	if *socketPath != "" {
+		ln, err := listenUnix(*socketPath)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v", *socketPath, err)
+		}
+		listeners = append(listeners, ln)
 	}
 
 	// Write PID file.
@@ -69,12 +118,16 @@ func main() {
 	}
 	defer os.Remove(*pidFile)
 
-	go func() {
-		log.Printf("port-registry listening on %s", srv.Addr)
-		if err := srv.Serve(ln); err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
-		}
-	}()
+	go reapExpired(ctx, s, *reapInterval)
+
+	for _, ln := range listeners {
+		go func() {
+			log.Printf("port-registry listening on %s", listenerAddr(ln))
+			if err := srv.Serve(ln); err != http.ErrServerClosed {
+				log.Fatalf("server error: %v", err)
+			}
+		}()
+	}
 
 	<-ctx.Done()
 	log.Println("shutting down...")
@@ -83,3 +136,153 @@ func main() {
 	defer cancel()
 	srv.Shutdown(shutdownCtx)
 }
+
+// listenUnix listens on a Unix socket that only the current user can connect
+// to. A socket left behind by a crashed server is replaced; one that still
+// accepts connections is not.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the socket with no group or other permissions, so that it is
+	// never reachable by other users, even briefly.
+	old := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func listenerAddr(ln net.Listener) string {
+	if ln.Addr().Network() == "unix" {
+		return "unix://" + ln.Addr().String()
+	}
+	return ln.Addr().String()
+}
+
+// runMigrate implements "port-registry migrate": report or advance the schema
+// version without starting the server.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := fs.String("db", config.DefaultDBPath(), "SQLite database path")
+	status := fs.Bool("status", false, "print applied and pending migrations")
+	to := fs.Int("to", store.LatestVersion(), "schema version to migrate to")
+	fs.Parse(args)
+
+	if err := os.MkdirAll(filepath.Dir(*dbPath), 0755); err != nil {
+		log.Fatalf("failed to create db directory: %v", err)
+	}
+	s, err := store.OpenSQLite(*dbPath)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+	defer s.Close()
+
+	if !*status {
+		if err := s.MigrateTo(*to); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	fmt.Printf("schema version %d (latest %d)\n", current, store.LatestVersion())
+	if !*status {
+		return
+	}
+
+	migrations, err := s.MigrationStatus()
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	for _, m := range migrations {
+		applied := "pending"
+		if m.AppliedAt != nil {
+			applied = "applied " + m.AppliedAt.Local().Format(time.DateTime)
+		}
+		fmt.Printf("  %3d  %-28s %s\n", m.Version, m.Name, applied)
+	}
+}
+
+// runToken implements "port-registry token create", which bootstraps the first
+// token of a server running with -auth. Later tokens can be managed over the
+// API with portctl token.
+func runToken(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		fmt.Fprintln(os.Stderr, "usage: port-registry token create -name <name> [-scope read|allocate|admin] [-app-prefix <prefix>] [-db <path>]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("token create", flag.ExitOnError)
+	dbPath := fs.String("db", config.DefaultDBPath(), "SQLite database path")
+	name := fs.String("name", "", "token name, recorded as the actor of its changes (required)")
+	scope := fs.String("scope", model.ScopeAdmin, "read, allocate or admin")
+	appPrefix := fs.String("app-prefix", "", "restrict access to apps with this name prefix")
+	fs.Parse(args[1:])
+
+	if *name == "" {
+		log.Fatal("-name is required")
+	}
+	switch *scope {
+	case model.ScopeRead, model.ScopeAllocate, model.ScopeAdmin:
+	default:
+		log.Fatalf("invalid -scope %q: must be read, allocate or admin", *scope)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*dbPath), 0755); err != nil {
+		log.Fatalf("failed to create db directory: %v", err)
+	}
+	s, err := store.NewSQLite(*dbPath)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+	defer s.Close()
+
+	_, secret, err := s.CreateToken(model.Token{Name: *name, Scope: *scope, AppPrefix: *appPrefix})
+	if err != nil {
+		log.Fatalf("create token: %v", err)
+	}
+	fmt.Println(secret)
+}
+
+// reapExpired periodically deletes leases whose TTL has elapsed without renewal.
+func reapExpired(ctx context.Context, s store.Store, interval time.Duration) {
+	s = s.WithOrigin(model.Origin{Source: "reaper"})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := s.DeleteExpired(now)
+			if err != nil {
+				log.Printf("reaper: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("reaper: released %d expired allocation(s)", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// socketPath returns a path for a Unix socket in a fresh directory. Socket
+// paths are limited to about 100 bytes, which t.TempDir can exceed.
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "pr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "sock", "registry.sock")
+}
+
+func TestListenUnix(t *testing.T) {
+	path := socketPath(t)
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected mode 0600, got %o", perm)
+	}
+
+	// A server still accepting connections keeps its socket.
+	if _, err := listenUnix(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("expected an in-use error for a live socket, got %v", err)
+	}
+
+	// A socket left behind by a crashed server is replaced.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected a stale socket file: %v", err)
+	}
+	ln, err = listenUnix(path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := socketPath(t)
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("expected a not-a-socket error, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Error("expected the regular file to be left alone")
+	}
+}
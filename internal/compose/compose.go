@@ -0,0 +1,422 @@
+// Package compose reads the published ports of a Docker Compose file.
+package compose
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/n3r/port-registry/internal/dotenv"
+)
+
+// DefaultFiles are the file names Docker Compose looks for, in order.
+var DefaultFiles = []string{"compose.yaml", "compose.yml", "docker-compose.yml", "docker-compose.yaml"}
+
+// Port is a container port published on the host.
+type Port struct {
+	Service   string // the compose service
+	Name      string // the registry service name; see Parse
+	HostIP    string // empty for all interfaces
+	Published int    // 0 if Docker picks the host port
+	Target    int
+	Protocol  string // tcp or udp
+}
+
+// String returns p in the short syntax, e.g. "127.0.0.1:8080:80/udp".
+func (p Port) String() string {
+	s := strconv.Itoa(p.Target)
+	if p.Published != 0 || p.HostIP != "" {
+		published := ""
+		if p.Published != 0 {
+			published = strconv.Itoa(p.Published)
+		}
+		s = published + ":" + s
+	}
+	if p.HostIP != "" {
+		host := p.HostIP
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		s = host + ":" + s
+	}
+	if p.Protocol != "" && p.Protocol != "tcp" {
+		s += "/" + p.Protocol
+	}
+	return s
+}
+
+// Find returns the first of DefaultFiles that exists in dir.
+func Find(dir string) (string, error) {
+	for _, name := range DefaultFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no compose file in %s (looked for %s)", dir, strings.Join(DefaultFiles, ", "))
+}
+
+// Load parses the compose file at path, interpolating variables from the
+// environment and, as Compose does, from a .env file next to it.
+func Load(path string) ([]Port, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	env, err := os.ReadFile(filepath.Join(filepath.Dir(path), ".env"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	vars := dotenv.Parse(env)
+	ports, err := Parse(data, func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		v, ok := vars[name]
+		return v, ok
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ports, nil
+}
+
+type file struct {
+	Services map[string]struct {
+		Ports []yaml.Node `yaml:"ports"`
+	} `yaml:"services"`
+}
+
+// longPort is the long syntax of a ports entry.
+type longPort struct {
+	Target    string `yaml:"target"`
+	Published string `yaml:"published"`
+	HostIP    string `yaml:"host_ip"`
+	Protocol  string `yaml:"protocol"`
+}
+
+// Parse returns the ports published by compose data, in both the short
+// ("8080:80") and long syntax, sorted by service and host port. Ports that
+// Docker assigns itself ("80", "127.0.0.1::80") have Published 0 and come
+// first. Variables are interpolated with lookup.
+//
+// For ports on a fixed host port, Name is the compose service name if the
+// service publishes one such port, and the service name and target port,
+// e.g. "web-443", otherwise.
+func Parse(data []byte, lookup func(string) (string, bool)) ([]Port, error) {
+	var f file
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	var ports []Port
+	for service, svc := range f.Services {
+		var own []Port
+		for _, n := range svc.Ports {
+			p, err := parseEntry(&n, lookup)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: line %d: %w", service, n.Line, err)
+			}
+			for i := range p {
+				p[i].Service = service
+			}
+			own = append(own, p...)
+		}
+		nameAll(own)
+		ports = append(ports, own...)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Service != ports[j].Service {
+			return ports[i].Service < ports[j].Service
+		}
+		if ports[i].Published != ports[j].Published {
+			return ports[i].Published < ports[j].Published
+		}
+		if ports[i].Protocol != ports[j].Protocol {
+			return ports[i].Protocol < ports[j].Protocol
+		}
+		return ports[i].Target < ports[j].Target
+	})
+	return ports, nil
+}
+
+// nameAll sets the registry names of the fixed ports of one service.
+func nameAll(ports []Port) {
+	var fixed []*Port
+	for i := range ports {
+		if ports[i].Published != 0 {
+			fixed = append(fixed, &ports[i])
+		}
+	}
+	if len(fixed) == 1 {
+		fixed[0].Name = fixed[0].Service
+		return
+	}
+	seen := make(map[string]int)
+	for _, p := range fixed {
+		p.Name = p.Service + "-" + strconv.Itoa(p.Target)
+		seen[p.Name]++
+	}
+	for _, p := range fixed {
+		if seen[p.Name] > 1 {
+			p.Name += "-" + p.Protocol
+		}
+	}
+}
+
+// Published returns the ports of ports that are on a fixed host port.
+func Published(ports []Port) []Port {
+	var fixed []Port
+	for _, p := range ports {
+		if p.Published != 0 {
+			fixed = append(fixed, p)
+		}
+	}
+	return fixed
+}
+
+func parseEntry(n *yaml.Node, lookup func(string) (string, bool)) ([]Port, error) {
+	var lp longPort
+	switch n.Kind {
+	case yaml.ScalarNode:
+		s, err := Interpolate(n.Value, lookup)
+		if err != nil {
+			return nil, err
+		}
+		return parseShort(s)
+	case yaml.MappingNode:
+		if err := n.Decode(&lp); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid ports entry")
+	}
+
+	for _, field := range []*string{&lp.Target, &lp.Published, &lp.HostIP, &lp.Protocol} {
+		s, err := Interpolate(*field, lookup)
+		if err != nil {
+			return nil, err
+		}
+		*field = s
+	}
+	target, err := parseRange(lp.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q", lp.Target)
+	}
+	var published [2]int
+	if lp.Published != "" {
+		if published, err = parseRange(lp.Published); err != nil {
+			return nil, fmt.Errorf("invalid published port %q", lp.Published)
+		}
+	}
+	return expand(lp.HostIP, published, target, lp.Protocol)
+}
+
+// parseShort parses [[host_ip:]published:]target[/protocol], where the
+// ports may be ranges such as 8000-8010.
+func parseShort(s string) ([]Port, error) {
+	spec, protocol, _ := strings.Cut(s, "/")
+
+	var hostIP string
+	if strings.HasPrefix(spec, "[") { // [::1]:8080:80
+		end := strings.Index(spec, "]:")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		hostIP, spec = spec[1:end], spec[end+2:]
+	}
+	parts := strings.Split(spec, ":")
+	var published, target string
+	switch len(parts) {
+	case 1:
+		target = parts[0]
+	case 2:
+		published, target = parts[0], parts[1]
+	case 3:
+		if hostIP != "" {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		hostIP, published, target = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid port %q", s)
+	}
+	var pr [2]int
+	if published != "" {
+		var err error
+		if pr, err = parseRange(published); err != nil {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	tr, err := parseRange(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", s)
+	}
+	return expand(hostIP, pr, tr, protocol)
+}
+
+// expand pairs each published port of a range with its target. A zero
+// published range leaves the host ports to Docker. A published range for a
+// single target lets Docker pick one of its ports, which cannot be
+// registered in advance, so it is rejected.
+func expand(hostIP string, published, target [2]int, protocol string) ([]Port, error) {
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	n := target[1] - target[0]
+	if published[0] != 0 {
+		m := published[1] - published[0]
+		if n == 0 && m != 0 {
+			return nil, fmt.Errorf("host port range %d-%d for the single container port %d is not supported; publish one host port", published[0], published[1], target[0])
+		}
+		if m != n {
+			return nil, fmt.Errorf("port ranges %d-%d and %d-%d differ in size", published[0], published[1], target[0], target[1])
+		}
+		n = m
+	}
+	ports := make([]Port, 0, n+1)
+	for i := 0; i <= n; i++ {
+		p := Port{HostIP: hostIP, Target: target[0], Protocol: protocol}
+		if target[1] != target[0] {
+			p.Target += i
+		}
+		if published[0] != 0 {
+			p.Published = published[0] + i
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// parseRange parses a port or a first-last range of ports.
+func parseRange(s string) ([2]int, error) {
+	lo, hi, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	first, err := strconv.Atoi(lo)
+	if err != nil {
+		return [2]int{}, err
+	}
+	last := first
+	if isRange {
+		if last, err = strconv.Atoi(hi); err != nil {
+			return [2]int{}, err
+		}
+	}
+	if first < 1 || last > 65535 || first > last {
+		return [2]int{}, fmt.Errorf("port out of range")
+	}
+	return [2]int{first, last}, nil
+}
+
+// Interpolate expands variables in s as Compose does: $NAME and ${NAME},
+// ${NAME:-default} and ${NAME-default} for unset (or, with the colon,
+// empty) variables, ${NAME:+alt} and ${NAME+alt} for set ones, and
+// ${NAME:?message} and ${NAME?message} to require them. $$ is a literal $.
+func Interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch next := s[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", s)
+			}
+			v, err := expandBraced(s[i+2:end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i = end
+		case isNameByte(next, true):
+			j := i + 1
+			for j < len(s) && isNameByte(s[j], j == i+1) {
+				j++
+			}
+			v, _ := lookup(s[i+1 : j])
+			b.WriteString(v)
+			i = j - 1
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// closingBrace returns the index of the } that closes a ${ whose contents
+// start at i, allowing nested ${...} in defaults.
+func closingBrace(s string, i int) int {
+	depth := 1
+	for ; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func expandBraced(expr string, lookup func(string) (string, bool)) (string, error) {
+	n := 0
+	for n < len(expr) && isNameByte(expr[n], n == 0) {
+		n++
+	}
+	name, op := expr[:n], expr[n:]
+	if name == "" {
+		return "", fmt.Errorf("invalid variable ${%s}", expr)
+	}
+	value, set := lookup(name)
+	if op == "" {
+		return value, nil
+	}
+
+	colon := strings.HasPrefix(op, ":")
+	if colon {
+		op = op[1:]
+		set = set && value != ""
+	}
+	if op == "" {
+		return "", fmt.Errorf("invalid variable ${%s}", expr)
+	}
+	arg := op[1:]
+	switch op[0] {
+	case '-':
+		if set {
+			return value, nil
+		}
+		return Interpolate(arg, lookup)
+	case '+':
+		if !set {
+			return "", nil
+		}
+		return Interpolate(arg, lookup)
+	case '?':
+		if set {
+			return value, nil
+		}
+		msg, err := Interpolate(arg, lookup)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("required variable %s is missing a value: %s", name, msg)
+	}
+	return "", fmt.Errorf("invalid variable ${%s}", expr)
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
@@ -0,0 +1,156 @@
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testFile = `
+services:
+  db:
+    image: postgres
+    ports:
+      - "${DB_PORT:-5432}:5432"
+  web:
+    ports:
+      - 3000
+      - "127.0.0.1::9229"
+      - "8080:80"
+      - target: 443
+        published: ${HTTPS_PORT}
+        host_ip: 127.0.0.1
+  dns:
+    ports:
+      - "5353:53/udp"
+      - "5353:53"
+  workers:
+    ports:
+      - "[::1]:9000-9001:9000-9001"
+  internal:
+    expose: ["8000"]
+`
+
+func TestParse(t *testing.T) {
+	env := map[string]string{"HTTPS_PORT": "8443"}
+	ports, err := Parse([]byte(testFile), func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Port{
+		{Service: "db", Name: "db", Published: 5432, Target: 5432, Protocol: "tcp"},
+		{Service: "dns", Name: "dns-53-tcp", Published: 5353, Target: 53, Protocol: "tcp"},
+		{Service: "dns", Name: "dns-53-udp", Published: 5353, Target: 53, Protocol: "udp"},
+		{Service: "web", Target: 3000, Protocol: "tcp"},
+		{Service: "web", HostIP: "127.0.0.1", Target: 9229, Protocol: "tcp"},
+		{Service: "web", Name: "web-80", Published: 8080, Target: 80, Protocol: "tcp"},
+		{Service: "web", Name: "web-443", HostIP: "127.0.0.1", Published: 8443, Target: 443, Protocol: "tcp"},
+		{Service: "workers", Name: "workers-9000", HostIP: "::1", Published: 9000, Target: 9000, Protocol: "tcp"},
+		{Service: "workers", Name: "workers-9001", HostIP: "::1", Published: 9001, Target: 9001, Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("got:\n%+v\nwant:\n%+v", ports, want)
+	}
+}
+
+func TestPublished(t *testing.T) {
+	ports, err := Parse([]byte(testFile), func(string) (string, bool) { return "8443", true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range Published(ports) {
+		if p.Published == 0 || p.Name == "" {
+			t.Errorf("expected only named fixed ports, got %+v", p)
+		}
+	}
+	if n := len(Published(ports)); n != 7 {
+		t.Errorf("expected 7 fixed ports, got %d", n)
+	}
+}
+
+func TestPortString(t *testing.T) {
+	for _, tc := range []struct {
+		port Port
+		want string
+	}{
+		{Port{Target: 80, Protocol: "tcp"}, "80"},
+		{Port{Published: 8080, Target: 80, Protocol: "tcp"}, "8080:80"},
+		{Port{HostIP: "127.0.0.1", Target: 80}, "127.0.0.1::80"},
+		{Port{HostIP: "::1", Published: 5353, Target: 53, Protocol: "udp"}, "[::1]:5353:53/udp"},
+	} {
+		if got := tc.port.String(); got != tc.want {
+			t.Errorf("%+v: expected %q, got %q", tc.port, tc.want, got)
+		}
+		if tc.port.Published == 0 {
+			continue
+		}
+		parsed, err := parseShort(tc.port.String())
+		if err != nil || len(parsed) != 1 || parsed[0].Published != tc.port.Published {
+			t.Errorf("%s does not parse back: %+v, %v", tc.want, parsed, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, entry := range []string{`"80:abc"`, `"70000:80"`, `"8000-8002:80-81"`, `"${REQUIRED:?set it}:80"`, `"${UNTERMINATED:80"`} {
+		_, err := Parse([]byte("services:\n  s:\n    ports:\n      - "+entry+"\n"), func(string) (string, bool) { return "", false })
+		if err == nil {
+			t.Errorf("%s: expected an error", entry)
+		}
+	}
+
+	_, err := Parse([]byte("services:\n  s:\n    ports:\n      - 8000-8010:80\n"), func(string) (string, bool) { return "", false })
+	if err == nil || !strings.Contains(err.Error(), "host port range 8000-8010") {
+		t.Errorf("expected a host range for one container port to be rejected, got %v", err)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"SET": "x", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	for in, want := range map[string]string{
+		"$SET-$UNSET.":             "x-.",
+		"${SET}":                   "x",
+		"$$SET":                    "$SET",
+		"${UNSET:-d}":              "d",
+		"${EMPTY:-d}":              "d",
+		"${EMPTY-d}":               "",
+		"${UNSET-${SET}}":          "x",
+		"${SET:+alt}|${UNSET+alt}": "alt|",
+		"cost: 5$":                 "cost: 5$",
+	} {
+		got, err := Interpolate(in, lookup)
+		if err != nil || got != want {
+			t.Errorf("%q: expected %q, got %q, %v", in, want, got, err)
+		}
+	}
+	if _, err := Interpolate("${UNSET:?is required}", lookup); err == nil || !strings.Contains(err.Error(), "is required") {
+		t.Errorf("expected a required-variable error, got %v", err)
+	}
+}
+
+func TestLoadReadsDotEnv(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "compose.yaml"), []byte("services:\n  web:\n    ports: [\"${WEB_PORT_TEST}:80\"]\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("WEB_PORT_TEST=8081\n"), 0o644)
+
+	path, err := Find(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 1 || ports[0].Published != 8081 {
+		t.Fatalf("expected port 8081 from .env, got %+v", ports)
+	}
+}
@@ -0,0 +1,69 @@
+package compose
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OverridePath returns the override file Docker Compose reads along with the
+// compose file at path, e.g. docker-compose.override.yml for
+// docker-compose.yml.
+func OverridePath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".override" + ext
+}
+
+// Override returns a compose override file that publishes ports on new host
+// ports, looked up by Port.Name in hostPorts. Ports without a new host port
+// keep theirs. Each service that publishes a fixed port gets its whole ports
+// list replaced with the !override tag, so its original host ports are not
+// bound as well. comment becomes the file's header.
+func Override(ports []Port, hostPorts map[string]int, comment string) ([]byte, error) {
+	services := &yaml.Node{Kind: yaml.MappingNode}
+	lists := make(map[string]*yaml.Node)
+	for _, p := range Published(ports) {
+		if lists[p.Service] != nil {
+			continue
+		}
+		list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!override"}
+		lists[p.Service] = list
+		services.Content = append(services.Content,
+			scalar(p.Service),
+			&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{scalar("ports"), list}})
+	}
+	for _, p := range ports {
+		list := lists[p.Service]
+		if list == nil {
+			continue
+		}
+		if port, ok := hostPorts[p.Name]; ok && p.Published != 0 {
+			p.Published = port
+		}
+		entry := scalar(p.String())
+		entry.Style = yaml.DoubleQuotedStyle
+		list.Content = append(list.Content, entry)
+	}
+
+	doc := &yaml.Node{
+		Kind:        yaml.DocumentNode,
+		HeadComment: comment,
+		Content:     []*yaml.Node{{Kind: yaml.MappingNode, Content: []*yaml.Node{scalar("services"), services}}},
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func scalar(s string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+}
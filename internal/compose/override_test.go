@@ -0,0 +1,52 @@
+package compose
+
+import (
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	ports, err := Parse([]byte(testFile), func(string) (string, bool) { return "8443", true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Override(ports, map[string]int{"db": 4521, "web-80": 4522, "web-443": 4523}, "Generated for tests.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Generated for tests.
+
+services:
+  db:
+    ports: !override
+      - "4521:5432"
+  dns:
+    ports: !override
+      - "5353:53"
+      - "5353:53/udp"
+  web:
+    ports: !override
+      - "3000"
+      - "127.0.0.1::9229"
+      - "4522:80"
+      - "127.0.0.1:4523:443"
+  workers:
+    ports: !override
+      - "[::1]:9000:9000"
+      - "[::1]:9001:9001"
+`
+	if string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestOverridePath(t *testing.T) {
+	for path, want := range map[string]string{
+		"docker-compose.yml":     "docker-compose.override.yml",
+		"compose.yaml":           "compose.override.yaml",
+		"deploy/compose.dev.yml": "deploy/compose.dev.override.yml",
+	} {
+		if got := OverridePath(path); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	DefaultServerPort = 51234
-	DefaultPortMin    = 1
-	DefaultPortMax    = 65535
+	DefaultServerPort   = 51234
+	DefaultPortMin      = 1024 // skip privileged ports when auto-assigning
+	DefaultPortMax      = 65535
+	DefaultReapInterval = time.Minute
 )
 
 func DefaultDBPath() string {
@@ -34,3 +39,24 @@ func DefaultLogPath() string {
 	}
 	return filepath.Join(home, ".port-registry", "port-registry.log")
 }
+
+// ParsePortRange parses a "min-max" range such as "40000-40999". A single port
+// such as "5432" is a range of one.
+func ParsePortRange(s string) (min, max int, err error) {
+	lo, hi, found := strings.Cut(strings.TrimSpace(s), "-")
+	min, err = strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	max = min
+	if found {
+		max, err = strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q: must be within 1-65535 with min <= max", s)
+	}
+	return min, max, nil
+}
@@ -0,0 +1,152 @@
+// Package dotenv reads .env files and updates them in place, leaving every
+// line it does not set untouched.
+package dotenv
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Var is a variable assignment.
+type Var struct {
+	Key   string
+	Value string
+}
+
+// Update returns data with vars set. An existing assignment of a key, with or
+// without a leading "export", gets the new value in place; keys that are not
+// assigned yet are appended in order. Comments, blank lines and other keys are
+// kept as they are.
+func Update(data []byte, vars []Var) []byte {
+	pending := make(map[string]string, len(vars))
+	for _, v := range vars {
+		pending[v.Key] = v.Value
+	}
+
+	var out bytes.Buffer
+	lines := strings.SplitAfter(string(data), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		prefix, key, ok := assignment(line)
+		value, managed := pending[key]
+		if !ok || !managed {
+			out.WriteString(line)
+			continue
+		}
+		out.WriteString(prefix + key + "=" + value + "\n")
+		delete(pending, key)
+	}
+
+	if len(pending) > 0 && out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	for _, v := range vars {
+		if value, ok := pending[v.Key]; ok {
+			out.WriteString(v.Key + "=" + value + "\n")
+			delete(pending, v.Key)
+		}
+	}
+	return out.Bytes()
+}
+
+// assignment splits a KEY=value line into everything before the key (indent
+// and an optional "export ") and the key itself.
+func assignment(line string) (prefix, key string, ok bool) {
+	rest := strings.TrimLeft(line, " \t")
+	if after, found := strings.CutPrefix(rest, "export "); found {
+		rest = strings.TrimLeft(after, " \t")
+	}
+	key, _, ok = strings.Cut(rest, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || strings.HasPrefix(key, "#") || strings.ContainsAny(key, " \t") {
+		return "", "", false
+	}
+	return line[:len(line)-len(rest)], key, true
+}
+
+// Parse returns the variables assigned in dotenv data. Values may be quoted:
+// single quotes are literal, and double quotes allow the escapes \n, \t,
+// \" and \\. An unquoted value ends at a " #" comment.
+func Parse(data []byte) map[string]string {
+	vars := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		prefix, key, ok := assignment(line)
+		if !ok {
+			continue
+		}
+		_, value, _ := strings.Cut(line[len(prefix):], "=")
+		vars[key] = parseValue(strings.TrimSpace(value))
+	}
+	return vars
+}
+
+func parseValue(v string) string {
+	if len(v) >= 2 && v[0] == '\'' {
+		if end := strings.IndexByte(v[1:], '\''); end >= 0 {
+			return v[1 : end+1]
+		}
+	}
+	if len(v) >= 2 && v[0] == '"' {
+		var b strings.Builder
+		for i := 1; i < len(v); i++ {
+			switch c := v[i]; {
+			case c == '"':
+				return b.String()
+			case c == '\\' && i+1 < len(v):
+				i++
+				switch v[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(v[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// WriteFile applies Update to the file at path, creating it if it does not
+// exist. The file is replaced atomically and keeps its permissions.
+func WriteFile(path string, vars []Var) error {
+	mode := fs.FileMode(0o644)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(Update(data, vars)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,72 @@
+package dotenv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	in := "# database\nPOSTGRES_PORT=5432\nDEBUG=1\n  export REDIS_PORT = 6379\nPOSTGRES_PORT_NOTE=x\n"
+	got := string(Update([]byte(in), []Var{
+		{Key: "REDIS_PORT", Value: "4522"},
+		{Key: "WEB_PORT", Value: "4523"},
+		{Key: "POSTGRES_PORT", Value: "4521"},
+	}))
+	want := "# database\nPOSTGRES_PORT=4521\nDEBUG=1\n  export REDIS_PORT=4522\nPOSTGRES_PORT_NOTE=x\nWEB_PORT=4523\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUpdateNoTrailingNewline(t *testing.T) {
+	got := string(Update([]byte("A=1"), []Var{{Key: "B", Value: "2"}}))
+	if got != "A=1\nB=2\n" {
+		t.Errorf("got %q", got)
+	}
+	got = string(Update(nil, []Var{{Key: "B", Value: "2"}}))
+	if got != "B=2\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	vars := Parse([]byte("# comment\nA=1\nexport B = two # note\nC='$literal # x'\nD=\"line\\nbreak \\\"q\\\"\"\nE=\nnot a var\n"))
+	want := map[string]string{"A": "1", "B": "two", "C": "$literal # x", "D": "line\nbreak \"q\"", "E": ""}
+	if len(vars) != len(want) {
+		t.Fatalf("expected %d variables, got %v", len(want), vars)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, vars[k])
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := WriteFile(path, []Var{{Key: "A", Value: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, []Var{{Key: "A", Value: "2"}, {Key: "B", Value: "3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "A=2\nB=3\n" {
+		t.Errorf("got %q", data)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected mode 0600 to be kept, got %o", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,152 @@
+// Package gitrepo describes git checkouts, and finds the instances a
+// repository still has: its branches and linked worktrees.
+package gitrepo
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// CommonDir returns the absolute common git dir of the repository that
+// contains dir, e.g. /src/api/.git also from a linked worktree of it.
+func CommonDir(dir string) (string, error) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--path-format=absolute", "--git-common-dir").Output()
+	if err != nil {
+		return "", gitError(err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Find returns the common git dir of the repository that contains dir, or ""
+// outside one. Unlike CommonDir it only reads files, so it works where git is
+// not installed, such as on a server inspecting other processes.
+func Find(dir string) string {
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		dotGit := filepath.Join(dir, ".git")
+		if fi, err := os.Stat(dotGit); err == nil {
+			if fi.IsDir() {
+				return dotGit
+			}
+			// A linked worktree's .git file points to its git dir, whose
+			// commondir file points to the main one.
+			data, err := os.ReadFile(dotGit)
+			if err != nil {
+				return ""
+			}
+			gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+			if !ok {
+				return ""
+			}
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			common, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+			if err != nil {
+				return filepath.Clean(gitDir) // e.g. a submodule
+			}
+			c := strings.TrimSpace(string(common))
+			if filepath.IsAbs(c) {
+				return filepath.Clean(c)
+			}
+			return filepath.Join(gitDir, c)
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return ""
+		}
+	}
+}
+
+// Current describes the checkout of the current directory, or returns nil
+// outside a git repository.
+func Current() *model.GitInfo {
+	gitDir, err := CommonDir(".")
+	if err != nil {
+		return nil
+	}
+	info := &model.GitInfo{Repo: gitDir}
+	if out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output(); err == nil {
+		info.Worktree = strings.TrimSpace(string(out))
+	}
+	if out, err := exec.Command("git", "branch", "--show-current").Output(); err == nil {
+		info.Branch = strings.TrimSpace(string(out))
+	}
+	if out, err := exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD").Output(); err == nil {
+		info.Commit = strings.TrimSpace(string(out))
+	}
+	return info
+}
+
+// AppName returns the app name of the repository with the common git dir
+// gitDir: the name of the directory that contains it.
+func AppName(gitDir string) string {
+	return filepath.Base(filepath.Dir(gitDir))
+}
+
+// Repo is what a repository has: its local branches, and its linked
+// worktrees by directory name.
+type Repo struct {
+	Branches  map[string]bool
+	Worktrees map[string]bool // linked worktrees whose directory exists
+	Deleted   map[string]bool // linked worktrees whose directory was deleted, until git prunes them
+}
+
+// Inspect lists the branches and linked worktrees of the repository with the
+// common git dir gitDir.
+func Inspect(gitDir string) (*Repo, error) {
+	r := &Repo{Branches: make(map[string]bool), Worktrees: make(map[string]bool), Deleted: make(map[string]bool)}
+
+	out, err := exec.Command("git", "-C", gitDir, "for-each-ref", "--format=%(refname:short)", "refs/heads/").Output()
+	if err != nil {
+		return nil, gitError(err)
+	}
+	for _, branch := range strings.Fields(string(out)) {
+		r.Branches[branch] = true
+	}
+
+	out, err = exec.Command("git", "-C", gitDir, "worktree", "list", "--porcelain").Output()
+	if err != nil {
+		return nil, gitError(err)
+	}
+	for i, wt := range strings.Split(strings.TrimSpace(string(out)), "\n\n") {
+		if i == 0 {
+			continue // the main worktree is named after its branch
+		}
+		path, prunable := "", false
+		for _, line := range strings.Split(wt, "\n") {
+			if p, ok := strings.CutPrefix(line, "worktree "); ok {
+				path = p
+			}
+			if strings.HasPrefix(line, "prunable") {
+				prunable = true
+			}
+		}
+		switch {
+		case path == "":
+		case prunable:
+			r.Deleted[filepath.Base(path)] = true
+		default:
+			r.Worktrees[filepath.Base(path)] = true
+		}
+	}
+	return r, nil
+}
+
+// HasInstance reports whether name is one of the repository's branches or
+// existing linked worktrees, which are the instance names portctl detects.
+func (r *Repo) HasInstance(name string) bool {
+	return r.Branches[name] || r.Worktrees[name]
+}
+
+// gitError adds git's own message to a failed command's error.
+func gitError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return errors.New("git: " + strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
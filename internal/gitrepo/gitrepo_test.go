@@ -0,0 +1,77 @@
+package gitrepo
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func git(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	repo := filepath.Join(root, "shop")
+	os.Mkdir(repo, 0o755)
+	git(t, repo, "init", "-q", "-b", "main")
+	git(t, repo, "commit", "-q", "--allow-empty", "-m", "init")
+	git(t, repo, "branch", "feature/login")
+	git(t, repo, "worktree", "add", "-q", "-b", "wt-branch", filepath.Join(root, "shop-payments"))
+	git(t, repo, "worktree", "add", "-q", "--detach", filepath.Join(root, "shop-gone"))
+	if err := os.RemoveAll(filepath.Join(root, "shop-gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	gitDir := filepath.Join(repo, ".git")
+	if got, err := CommonDir(filepath.Join(root, "shop-payments")); err != nil || !sameFile(got, gitDir) {
+		t.Errorf("expected common dir %s from the worktree, got %s, %v", gitDir, got, err)
+	}
+	for _, dir := range []string{repo, filepath.Join(root, "shop-payments")} {
+		if got := Find(dir); !sameFile(got, gitDir) {
+			t.Errorf("expected to find %s from %s, got %q", gitDir, dir, got)
+		}
+	}
+	if got := Find(root); got != "" {
+		t.Errorf("expected no repository at %s, got %s", root, got)
+	}
+	if got := AppName(gitDir); got != "shop" {
+		t.Errorf("expected app shop, got %s", got)
+	}
+	got, err := Inspect(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Repo{
+		Branches:  map[string]bool{"main": true, "feature/login": true, "wt-branch": true},
+		Worktrees: map[string]bool{"shop-payments": true},
+		Deleted:   map[string]bool{"shop-gone": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !got.HasInstance("shop-payments") || got.HasInstance("shop-gone") {
+		t.Error("expected instances for existing worktrees only")
+	}
+
+	if _, err := Inspect(filepath.Join(root, "missing", ".git")); err == nil {
+		t.Error("expected an error for a missing repository")
+	}
+}
+
+// sameFile compares paths that may differ by symlinks, such as /tmp on macOS.
+func sameFile(a, b string) bool {
+	fa, err1 := os.Stat(a)
+	fb, err2 := os.Stat(b)
+	return err1 == nil && err2 == nil && os.SameFile(fa, fb)
+}
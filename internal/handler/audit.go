@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"cmp"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/n3r/port-registry/internal/gitrepo"
+	"github.com/n3r/port-registry/internal/procnet"
+	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// Audit compares every allocation with the sockets listening on the
+// server's host.
+func (h *Handler) Audit(w http.ResponseWriter, r *http.Request) {
+	allocs, err := h.store.List(store.Filter{})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	ranges, err := h.store.ListRanges()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	excl, err := h.store.ListExclusions()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	listeners, err := findListeners(func(procnet.Socket) bool { return true })
+	if err != nil {
+		writeListenerError(w, err)
+		return
+	}
+	listeners = slices.DeleteFunc(listeners, func(l model.Listener) bool { return l.PID == os.Getpid() }) // the registry itself
+
+	// A port is managed if auto-assignment could hand it out.
+	managed := func(port int) bool {
+		for _, e := range excl {
+			if port >= e.Min && port <= e.Max {
+				return false
+			}
+		}
+		if port >= h.portMin && port <= h.portMax {
+			return true
+		}
+		return slices.ContainsFunc(ranges, func(pr model.PortRange) bool { return port >= pr.Min && port <= pr.Max })
+	}
+	findings := audit(allocs, listeners, managed)
+	if t := tokenFrom(r); t != nil && t.AppPrefix != "" {
+		// Restricted tokens see only their apps' allocations, not host-wide
+		// listeners that no allocation explains.
+		findings = slices.DeleteFunc(findings, func(f model.AuditFinding) bool {
+			return f.Allocation == nil || !canSee(r, f.Allocation.App)
+		})
+	}
+	for _, f := range findings {
+		redactListeners(r, f.Listeners)
+	}
+	writeJSON(w, http.StatusOK, findings)
+}
+
+// audit returns the findings for allocs and listeners, sorted by port.
+func audit(allocs []model.Allocation, listeners []model.Listener, managed func(port int) bool) []model.AuditFinding {
+	byPort := make(map[int][]model.Listener)
+	for _, l := range listeners {
+		byPort[l.Port] = append(byPort[l.Port], l)
+	}
+
+	findings := []model.AuditFinding{}
+	allocsByPort := make(map[int][]model.Allocation)
+	for _, a := range allocs {
+		allocsByPort[a.Port] = append(allocsByPort[a.Port], a)
+		ls := slices.DeleteFunc(slices.Clone(byPort[a.Port]), func(l model.Listener) bool { return !covers(a, l) })
+		if len(ls) == 0 {
+			findings = append(findings, model.AuditFinding{Kind: model.AuditNotListening, Port: a.Port, Allocation: &a})
+			continue
+		}
+		if a.Git == nil {
+			continue
+		}
+		// Group the listeners by the repository they run from, ignoring
+		// those whose working directory is unknown or in a container.
+		others := make(map[string][]model.Listener)
+		for _, l := range ls {
+			if l.Cwd == "" || l.Container != "" {
+				continue
+			}
+			if repo := gitrepo.Find(l.Cwd); repo != "" && !sameRepo(repo, a.Git.Repo) {
+				others[repo] = append(others[repo], l)
+			}
+		}
+		for _, repo := range slices.Sorted(maps.Keys(others)) {
+			findings = append(findings, model.AuditFinding{Kind: model.AuditRepoMismatch, Port: a.Port, Allocation: &a, Listeners: others[repo], Repo: repo})
+		}
+	}
+	for port, ls := range byPort {
+		if !managed(port) {
+			continue
+		}
+		ls = slices.DeleteFunc(slices.Clone(ls), func(l model.Listener) bool {
+			return slices.ContainsFunc(allocsByPort[port], func(a model.Allocation) bool { return covers(a, l) })
+		})
+		if len(ls) > 0 {
+			findings = append(findings, model.AuditFinding{Kind: model.AuditUnregistered, Port: port, Listeners: ls})
+		}
+	}
+	slices.SortStableFunc(findings, func(a, b model.AuditFinding) int {
+		return cmp.Or(cmp.Compare(a.Port, b.Port), strings.Compare(a.Kind, b.Kind))
+	})
+	return findings
+}
+
+// covers reports whether allocation a is for the protocol l listens on.
+func covers(a model.Allocation, l model.Listener) bool {
+	return a.Proto == model.ProtoBoth || a.Proto == strings.TrimSuffix(l.Proto, "6")
+}
+
+// sameRepo reports whether two common git dirs are the same directory.
+func sameRepo(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	fa, err1 := os.Stat(a)
+	fb, err2 := os.Stat(b)
+	return err1 == nil && err2 == nil && os.SameFile(fa, fb)
+}
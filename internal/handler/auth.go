@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// scopeRank orders scopes so that each includes the ones below it.
+var scopeRank = map[string]int{
+	model.ScopeRead:     1,
+	model.ScopeAllocate: 2,
+	model.ScopeAdmin:    3,
+}
+
+type tokenKey struct{}
+
+// tokenFrom returns the token that authenticated r, or nil when auth is disabled.
+func tokenFrom(r *http.Request) *model.Token {
+	t, _ := r.Context().Value(tokenKey{}).(*model.Token)
+	return t
+}
+
+// authenticate rejects requests without a valid bearer token.
+func (h *Handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || secret == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Code: model.CodeUnauthorized, Error: "missing bearer token"})
+			return
+		}
+		t, err := h.store.LookupToken(secret)
+		if err == store.ErrNotFound {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Code: model.CodeUnauthorized, Error: "invalid token"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, t)))
+	})
+}
+
+// require rejects requests whose token lacks scope. It does nothing when auth
+// is disabled.
+func (h *Handler) require(scope string) func(http.Handler) http.Handler {
+	return h.requireToken(scope, false)
+}
+
+// requireGlobal is require for settings shared by every app, which tokens
+// restricted to an app prefix may not change.
+func (h *Handler) requireGlobal(scope string) func(http.Handler) http.Handler {
+	return h.requireToken(scope, true)
+}
+
+func (h *Handler) requireToken(scope string, global bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !h.auth {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := tokenFrom(r)
+			if scopeRank[t.Scope] < scopeRank[scope] {
+				writeJSON(w, http.StatusForbidden, model.ErrorResponse{Code: model.CodeForbidden, Error: "token lacks " + scope + " scope"})
+				return
+			}
+			if global && t.AppPrefix != "" {
+				writeJSON(w, http.StatusForbidden, model.ErrorResponse{Code: model.CodeForbidden, Error: "token is restricted to apps with prefix " + strconv.Quote(t.AppPrefix)})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// canSee reports whether the request's token covers app. Tokens restricted to
+// an app prefix neither see nor change other apps' allocations and history.
+func canSee(r *http.Request, app string) bool {
+	t := tokenFrom(r)
+	return t == nil || strings.HasPrefix(app, t.AppPrefix)
+}
+
+// visibleHolder returns holder, or nil if the request may not see it.
+func visibleHolder(r *http.Request, holder *model.Allocation) *model.Allocation {
+	if holder == nil || !canSee(r, holder.App) {
+		return nil
+	}
+	return holder
+}
+
+// allowApp reports whether the request may change app's allocations and
+// ranges, writing a 403 response if not.
+func allowApp(w http.ResponseWriter, r *http.Request, app string) bool {
+	if canSee(r, app) {
+		return true
+	}
+	t := tokenFrom(r)
+	writeJSON(w, http.StatusForbidden, model.ErrorResponse{Code: model.CodeForbidden, Error: "token is restricted to apps with prefix " + strconv.Quote(t.AppPrefix)})
+	return false
+}
+
+// allowAllocation is allowApp for the allocation with the given ID.
+func (h *Handler) allowAllocation(w http.ResponseWriter, r *http.Request, id int64) bool {
+	if t := tokenFrom(r); t == nil || t.AppPrefix == "" {
+		return true
+	}
+	a, err := h.store.GetByID(id)
+	if err == store.ErrNotFound {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Code: model.CodeNotFound, Error: "allocation not found"})
+		return false
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return false
+	}
+	return allowApp(w, r, a.App)
+}
+
+func (h *Handler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.store.ListTokens()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	if tokens == nil {
+		tokens = []model.Token{}
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func (h *Handler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	var req model.CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid JSON"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "name is required"})
+		return
+	}
+	if _, ok := scopeRank[req.Scope]; !ok {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "scope must be read, allocate or admin"})
+		return
+	}
+
+	t, secret, err := h.store.CreateToken(model.Token{Name: req.Name, Scope: req.Scope, AppPrefix: req.AppPrefix})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, model.CreateTokenResponse{Token: *t, Secret: secret})
+}
+
+func (h *Handler) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid id"})
+		return
+	}
+	if err := h.store.DeleteToken(id); err == store.ErrNotFound {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Code: model.CodeNotFound, Error: "token not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
@@ -3,43 +3,125 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/n3r/port-registry/internal/config"
-	"github.com/n3r/port-registry/internal/model"
+	"github.com/n3r/port-registry/internal/metrics"
 	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
 )
 
 type Handler struct {
 	store   store.Store
 	portMin int
 	portMax int
+	auth    bool
+	metrics *metrics.Registry
+	stats   *handlerMetrics
 }
 
-func New(s store.Store) *Handler {
-	return &Handler{
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithPortRange sets the global auto-assignment range used for apps without
+// their own range.
+func WithPortRange(min, max int) Option {
+	return func(h *Handler) {
+		h.portMin = min
+		h.portMax = max
+	}
+}
+
+// WithAuth requires a bearer token with a sufficient scope on every /v1 route.
+func WithAuth() Option {
+	return func(h *Handler) {
+		h.auth = true
+	}
+}
+
+func New(s store.Store, opts ...Option) *Handler {
+	h := &Handler{
 		store:   s,
 		portMin: config.DefaultPortMin,
 		portMax: config.DefaultPortMax,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.metrics != nil {
+		h.instrument(h.metrics)
+	}
+	return h
 }
 
 func (h *Handler) Routes() chi.Router {
 	r := chi.NewRouter()
+	if h.metrics != nil {
+		r.Use(h.observeRequests)
+		// Metric labels include every app's name, so scraping needs a read
+		// token without an app prefix when auth is enabled.
+		if h.auth {
+			r.With(h.authenticate, h.requireGlobal(model.ScopeRead)).Method(http.MethodGet, "/metrics", h.metrics)
+		} else {
+			r.Method(http.MethodGet, "/metrics", h.metrics)
+		}
+	}
 	r.Get("/healthz", h.Health)
 	r.Route("/v1", func(r chi.Router) {
-		r.Post("/allocations", h.Allocate)
-		r.Get("/allocations", h.List)
-		r.Delete("/allocations", h.ReleaseByFilter)
-		r.Delete("/allocations/{id}", h.ReleaseByID)
-		r.Get("/ports/{port}", h.CheckPort)
+		if h.auth {
+			r.Use(h.authenticate)
+		}
+		read := r.With(h.require(model.ScopeRead))
+		alloc := r.With(h.require(model.ScopeAllocate))
+		admin := r.With(h.require(model.ScopeAdmin))
+		global := r.With(h.requireGlobal(model.ScopeAdmin))
+
+		alloc.Post("/allocations", h.Allocate)
+		alloc.Post("/allocations/batch", h.AllocateBatch)
+		read.Get("/allocations", h.List)
+		alloc.Delete("/allocations", h.ReleaseByFilter)
+		alloc.Delete("/allocations/{id}", h.ReleaseByID)
+		alloc.Post("/allocations/{id}/renew", h.Renew)
+		read.Get("/ports/{port}", h.CheckPort)
+		read.Get("/ports/{port}/listener", h.PortListener)
+		read.Get("/audit", h.Audit)
+		read.Get("/ranges", h.ListRanges)
+		admin.Put("/ranges/{app}", h.SetRange)
+		admin.Delete("/ranges/{app}", h.DeleteRange)
+		read.Get("/exclusions", h.ListExclusions)
+		global.Post("/exclusions", h.AddExclusion)
+		global.Delete("/exclusions/{id}", h.DeleteExclusion)
+		read.Get("/events", h.ListEvents)
+		read.Get("/watch", h.Watch)
+		read.Get("/openapi.json", h.OpenAPI)
+		global.Get("/tokens", h.ListTokens)
+		global.Post("/tokens", h.CreateToken)
+		global.Delete("/tokens/{id}", h.DeleteToken)
 	})
 	return r
 }
 
+// storeFor returns the store attributed to the request's actor and client.
+// With auth enabled the actor is the token's name rather than the
+// client-supplied header.
+func (h *Handler) storeFor(r *http.Request) store.Store {
+	source := r.UserAgent()
+	if source == "" {
+		source = r.RemoteAddr
+	}
+	actor := r.Header.Get(model.ActorHeader)
+	if t := tokenFrom(r); t != nil {
+		actor = t.Name
+	}
+	return h.store.WithOrigin(model.Origin{Actor: actor, Source: source})
+}
+
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	if err := h.store.Ping(); err != nil {
 		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "error", "detail": err.Error()})
@@ -51,48 +133,144 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) Allocate(w http.ResponseWriter, r *http.Request) {
 	var req model.AllocateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "invalid JSON"})
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid JSON"})
 		return
 	}
-	req.App = strings.TrimSpace(req.App)
-	req.Instance = strings.TrimSpace(req.Instance)
-	req.Service = strings.TrimSpace(req.Service)
-	if req.App == "" || req.Instance == "" || req.Service == "" {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "app, instance, and service are required"})
+	if err := validateAllocate(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: err.Error()})
 		return
 	}
-	if req.Port != 0 && (req.Port < 1 || req.Port > 65535) {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "port must be between 1 and 65535"})
+	if !allowApp(w, r, req.App) {
+		return
+	}
+
+	var alloc *model.Allocation
+	var existed bool
+	var err error
+	if req.Ensure {
+		alloc, existed, err = h.storeFor(r).Ensure(req, h.portMin, h.portMax)
+	} else {
+		alloc, err = h.storeFor(r).Allocate(req, h.portMin, h.portMax)
+	}
+	if err != nil {
+		writeAllocateError(w, err, visibleHolder(r, alloc), req.Port, nil)
 		return
 	}
 
-	alloc, err := h.store.Allocate(req, h.portMin, h.portMax)
-	if err == store.ErrServiceAllocated {
-		writeJSON(w, http.StatusConflict, model.ErrorResponse{
-			Error:  "service already allocated",
-			Holder: alloc,
-		})
+	if existed {
+		writeJSON(w, http.StatusOK, alloc)
 		return
 	}
-	if err == store.ErrPortTaken {
-		writeJSON(w, http.StatusConflict, model.ErrorResponse{
-			Error:  "port already allocated",
-			Holder: alloc,
-		})
+	writeJSON(w, http.StatusCreated, alloc)
+}
+
+func (h *Handler) AllocateBatch(w http.ResponseWriter, r *http.Request) {
+	var req model.BatchAllocateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid JSON"})
+		return
+	}
+	if len(req.Allocations) == 0 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "allocations must not be empty"})
 		return
 	}
-	if err == store.ErrPortBusy {
-		writeJSON(w, http.StatusConflict, model.ErrorResponse{
-			Error: "port in use on system",
-		})
+
+	seen := make(map[string]bool)
+	for i := range req.Allocations {
+		a := &req.Allocations[i]
+		if err := validateAllocate(a); err != nil {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: err.Error(), Index: &i})
+			return
+		}
+		if !allowApp(w, r, a.App) {
+			return
+		}
+		key := a.App + "/" + a.Instance + "/" + a.Service
+		if seen[key] {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "duplicate service " + key, Index: &i})
+			return
+		}
+		seen[key] = true
+	}
+
+	allocs, err := h.storeFor(r).AllocateBatch(req.Allocations, h.portMin, h.portMax)
+	var batchErr *store.BatchError
+	if errors.As(err, &batchErr) {
+		writeAllocateError(w, batchErr.Err, visibleHolder(r, batchErr.Holder), req.Allocations[batchErr.Index].Port, &batchErr.Index)
 		return
 	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Error: err.Error()})
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
 		return
 	}
 
-	writeJSON(w, http.StatusCreated, alloc)
+	writeJSON(w, http.StatusCreated, allocs)
+}
+
+// validateAllocate normalizes req in place and reports the first invalid field.
+func validateAllocate(req *model.AllocateRequest) error {
+	req.App = strings.TrimSpace(req.App)
+	req.Instance = strings.TrimSpace(req.Instance)
+	req.Service = strings.TrimSpace(req.Service)
+	if req.App == "" || req.Instance == "" || req.Service == "" {
+		return errors.New("app, instance, and service are required")
+	}
+	if req.Port != 0 && (req.Port < 1 || req.Port > 65535) {
+		return errors.New("port must be between 1 and 65535")
+	}
+	req.Proto = strings.ToLower(strings.TrimSpace(req.Proto))
+	if req.Proto != "" && !validProto(req.Proto) {
+		return errors.New("proto must be tcp, udp or both")
+	}
+	if req.Git != nil && strings.TrimSpace(req.Git.Repo) == "" {
+		return errors.New("git.repo is required with git")
+	}
+	if r := req.Range; r != nil && (r.Min < 1 || r.Max > 65535 || r.Min > r.Max) {
+		return errors.New("range must be within 1-65535 with min <= max")
+	}
+	if req.TTL != "" {
+		if _, err := parseTTL(req.TTL); err != nil {
+			return err
+		}
+	}
+	for k := range req.Labels {
+		if strings.TrimSpace(k) == "" || strings.Contains(k, "=") {
+			return errors.New("label keys must be non-empty and must not contain '='")
+		}
+	}
+	return nil
+}
+
+func validProto(proto string) bool {
+	return proto == model.ProtoTCP || proto == model.ProtoUDP || proto == model.ProtoBoth
+}
+
+// writeAllocateError maps a store allocation error to its HTTP response.
+// port is the requested port, 0 for auto-assignment, and index identifies the
+// failing entry of a batch request and is nil otherwise.
+func writeAllocateError(w http.ResponseWriter, err error, holder *model.Allocation, port int, index *int) {
+	resp := model.ErrorResponse{Error: err.Error(), Port: port, Index: index}
+	var exhausted *store.RangeExhaustedError
+	switch {
+	case err == store.ErrServiceAllocated:
+		resp.Code, resp.Holder = model.CodeServiceAllocated, holder
+	case err == store.ErrPortTaken:
+		resp.Code, resp.Holder = model.CodePortTaken, holder
+	case err == store.ErrPortBusy:
+		resp.Code = model.CodePortBusy
+	case err == store.ErrPortExcluded:
+		resp.Code = model.CodePortExcluded
+	case errors.As(err, &exhausted):
+		resp.Code = model.CodeRangeExhausted
+		resp.Range = &model.PortRange{Min: exhausted.Min, Max: exhausted.Max}
+	default:
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error(), Index: index})
+		return
+	}
+	if resp.Holder != nil {
+		resp.Port = resp.Holder.Port
+	}
+	writeJSON(w, http.StatusConflict, resp)
 }
 
 func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
@@ -100,13 +278,26 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 		App:      r.URL.Query().Get("app"),
 		Instance: r.URL.Query().Get("instance"),
 		Service:  r.URL.Query().Get("service"),
+		Repo:     r.URL.Query().Get("repo"),
+	}
+	for _, sel := range r.URL.Query()["label"] {
+		k, v, ok := strings.Cut(sel, "=")
+		if !ok || k == "" {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid label selector " + strconv.Quote(sel) + ": want key=value"})
+			return
+		}
+		if f.Labels == nil {
+			f.Labels = make(map[string]string)
+		}
+		f.Labels[k] = v
 	}
 
 	allocs, err := h.store.List(f)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Error: err.Error()})
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
 		return
 	}
+	allocs = slices.DeleteFunc(allocs, func(a model.Allocation) bool { return !canSee(r, a.App) })
 	if allocs == nil {
 		allocs = []model.Allocation{}
 	}
@@ -116,7 +307,11 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ReleaseByFilter(w http.ResponseWriter, r *http.Request) {
 	var req model.ReleaseRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "invalid JSON"})
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid JSON"})
+		return
+	}
+	// App-restricted tokens must name an app they own.
+	if !allowApp(w, r, req.App) {
 		return
 	}
 
@@ -125,15 +320,16 @@ func (h *Handler) ReleaseByFilter(w http.ResponseWriter, r *http.Request) {
 		Instance: req.Instance,
 		Service:  req.Service,
 		Port:     req.Port,
+		Labels:   req.Labels,
 	}
 
-	n, err := h.store.DeleteByFilter(f)
+	n, err := h.storeFor(r).DeleteByFilter(f)
 	if errors.Is(err, store.ErrFilterRequired) {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: err.Error()})
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeFilterRequired, Error: err.Error()})
 		return
 	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Error: err.Error()})
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
 		return
 	}
 
@@ -144,44 +340,287 @@ func (h *Handler) ReleaseByID(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "invalid id"})
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid id"})
+		return
+	}
+	if !h.allowAllocation(w, r, id) {
 		return
 	}
 
-	if err := h.store.DeleteByID(id); err == store.ErrNotFound {
-		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "allocation not found"})
+	if err := h.storeFor(r).DeleteByID(id); err == store.ErrNotFound {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Code: model.CodeNotFound, Error: "allocation not found"})
 		return
 	} else if err != nil {
-		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Error: err.Error()})
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
 		return
 	}
 
 	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 }
 
-func (h *Handler) CheckPort(w http.ResponseWriter, r *http.Request) {
-	portStr := chi.URLParam(r, "port")
-	port, err := strconv.Atoi(portStr)
+func (h *Handler) Renew(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid id"})
+		return
+	}
+
+	// The body is optional: an empty body renews with the lease's original TTL.
+	var req model.RenewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid JSON"})
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		ttl, err = parseTTL(req.TTL)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: err.Error()})
+			return
+		}
+	}
+
+	if !h.allowAllocation(w, r, id) {
+		return
+	}
+
+	alloc, err := h.storeFor(r).Renew(id, ttl)
+	if err == store.ErrNotFound {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Code: model.CodeNotFound, Error: "allocation not found"})
+		return
+	}
+	if err == store.ErrNoLease {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeNoLease, Error: "allocation has no lease; specify a ttl"})
+		return
+	}
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "invalid port"})
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
 		return
 	}
+
+	writeJSON(w, http.StatusOK, alloc)
+}
+
+// portParam reads the {port} URL parameter, or writes an error and returns
+// false if it is not a valid port.
+func portParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	port, err := strconv.Atoi(chi.URLParam(r, "port"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid port"})
+		return 0, false
+	}
 	if port < 1 || port > 65535 {
-		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "port must be between 1 and 65535"})
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "port must be between 1 and 65535"})
+		return 0, false
+	}
+	return port, true
+}
+
+func (h *Handler) CheckPort(w http.ResponseWriter, r *http.Request) {
+	port, ok := portParam(w, r)
+	if !ok {
+		return
+	}
+
+	proto := r.URL.Query().Get("proto")
+	if proto == "" {
+		proto = model.ProtoTCP
+	}
+	if !validProto(proto) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "proto must be tcp, udp or both"})
 		return
 	}
 
-	alloc, err := h.store.GetByPort(port)
+	alloc, err := h.store.GetByPort(port, proto)
 	if err == store.ErrNotFound {
 		writeJSON(w, http.StatusOK, model.PortStatus{Port: port, Available: true})
 		return
 	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Error: err.Error()})
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, model.PortStatus{Port: port, Available: false, Holder: visibleHolder(r, alloc)})
+}
+
+func (h *Handler) ListRanges(w http.ResponseWriter, r *http.Request) {
+	ranges, err := h.store.ListRanges()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	ranges = slices.DeleteFunc(ranges, func(pr model.PortRange) bool { return !canSee(r, pr.App) })
+	if ranges == nil {
+		ranges = []model.PortRange{}
+	}
+	writeJSON(w, http.StatusOK, model.RangesResponse{
+		Default: model.PortRange{Min: h.portMin, Max: h.portMax},
+		Apps:    ranges,
+	})
+}
+
+func (h *Handler) SetRange(w http.ResponseWriter, r *http.Request) {
+	var req model.PortRange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid JSON"})
+		return
+	}
+	req.App = strings.TrimSpace(chi.URLParam(r, "app"))
+	if req.App == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "app is required"})
+		return
+	}
+	if req.Min < 1 || req.Max > 65535 || req.Min > req.Max {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "range must be within 1-65535 with min <= max"})
+		return
+	}
+	if !allowApp(w, r, req.App) {
+		return
+	}
+
+	if err := h.store.SetRange(req); err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (h *Handler) DeleteRange(w http.ResponseWriter, r *http.Request) {
+	app := chi.URLParam(r, "app")
+	if !allowApp(w, r, app) {
+		return
+	}
+	if err := h.store.DeleteRange(app); err == store.ErrNotFound {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Code: model.CodeNotFound, Error: "range not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *Handler) ListExclusions(w http.ResponseWriter, r *http.Request) {
+	excl, err := h.store.ListExclusions()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
 		return
 	}
+	if excl == nil {
+		excl = []model.Exclusion{}
+	}
+	writeJSON(w, http.StatusOK, excl)
+}
 
-	writeJSON(w, http.StatusOK, model.PortStatus{Port: port, Available: false, Holder: alloc})
+func (h *Handler) AddExclusion(w http.ResponseWriter, r *http.Request) {
+	var req model.Exclusion
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid JSON"})
+		return
+	}
+	if req.Max == 0 {
+		req.Max = req.Min
+	}
+	if req.Min < 1 || req.Max > 65535 || req.Min > req.Max {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "range must be within 1-65535 with min <= max"})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	excl, err := h.store.AddExclusion(req)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, excl)
+}
+
+func (h *Handler) DeleteExclusion(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid id"})
+		return
+	}
+
+	if err := h.store.DeleteExclusion(id); err == store.ErrNotFound {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Code: model.CodeNotFound, Error: "exclusion not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *Handler) ListEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := store.EventFilter{
+		App:      q.Get("app"),
+		Instance: q.Get("instance"),
+		Service:  q.Get("service"),
+	}
+	if t := tokenFrom(r); t != nil {
+		f.AppPrefix = t.AppPrefix
+	}
+	if v := q.Get("port"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil || port < 1 || port > 65535 {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid port"})
+			return
+		}
+		f.Port = port
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := parseSince(v, time.Now())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: err.Error()})
+			return
+		}
+		f.Since = since
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid limit"})
+			return
+		}
+		f.Limit = limit
+	}
+
+	events, err := h.store.ListEvents(f)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	if events == nil {
+		events = []model.Event{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// parseSince accepts an RFC 3339 timestamp or a duration counted back from now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, errors.New("invalid since: must be an RFC 3339 time or a duration such as 24h")
+}
+
+func parseTTL(s string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.New("invalid ttl: must be a duration such as 30m or 2h")
+	}
+	if ttl < time.Second {
+		return 0, errors.New("ttl must be at least 1s")
+	}
+	return ttl, nil
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -1,15 +1,23 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 
-	"github.com/n3r/port-registry/internal/model"
+	"github.com/n3r/port-registry/internal/metrics"
 	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
 )
 
 func setup(t *testing.T) http.Handler {
@@ -19,6 +27,12 @@ func setup(t *testing.T) http.Handler {
 }
 
 func setupWithStore(t *testing.T) (*store.SQLiteStore, http.Handler) {
+	t.Helper()
+	s := newStore(t)
+	return s, validated(t, New(s).Routes())
+}
+
+func newStore(t *testing.T) *store.SQLiteStore {
 	t.Helper()
 	s, err := store.NewSQLite(":memory:")
 	if err != nil {
@@ -26,7 +40,17 @@ func setupWithStore(t *testing.T) (*store.SQLiteStore, http.Handler) {
 	}
 	s.PortChecker = nil // skip real system checks in tests
 	t.Cleanup(func() { s.Close() })
-	return s, New(s).Routes()
+	// Start without the seeded exclusions, which depend on the host.
+	excl, err := s.ListExclusions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range excl {
+		if err := s.DeleteExclusion(e.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
 }
 
 func TestHealthz(t *testing.T) {
@@ -130,6 +154,9 @@ func TestAllocateConflict(t *testing.T) {
 	if errResp.Holder == nil {
 		t.Fatal("expected holder info in conflict response")
 	}
+	if errResp.Code != model.CodePortTaken || errResp.Port != 5000 {
+		t.Fatalf("expected code %q for port 5000, got %q for port %d", model.CodePortTaken, errResp.Code, errResp.Port)
+	}
 }
 
 func TestAllocateDuplicateService(t *testing.T) {
@@ -155,14 +182,73 @@ func TestAllocateDuplicateService(t *testing.T) {
 
 	var errResp model.ErrorResponse
 	json.NewDecoder(w.Body).Decode(&errResp)
-	if errResp.Error != "service already allocated" {
-		t.Fatalf("expected 'service already allocated' error, got %q", errResp.Error)
+	if errResp.Code != model.CodeServiceAllocated {
+		t.Fatalf("expected code %q, got %q", model.CodeServiceAllocated, errResp.Code)
 	}
 	if errResp.Holder == nil {
 		t.Fatal("expected holder info in conflict response")
 	}
 }
 
+func TestAllocateEnsure(t *testing.T) {
+	srv := setup(t)
+
+	var first model.Allocation
+	for _, want := range []int{201, 200} {
+		body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Ensure: true})
+		req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("expected %d, got %d: %s", want, w.Code, w.Body.String())
+		}
+		var alloc model.Allocation
+		json.NewDecoder(w.Body).Decode(&alloc)
+		if first.ID == 0 {
+			first = alloc
+		} else if alloc.ID != first.ID || alloc.Port != first.Port {
+			t.Fatalf("expected existing allocation %+v, got %+v", first, alloc)
+		}
+	}
+
+	// A different explicit port is still a conflict.
+	body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: first.Port + 1, Ensure: true})
+	req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 409 {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAllocatePreferredRange(t *testing.T) {
+	srv := setup(t)
+
+	for _, want := range []int{4500, 4600} {
+		body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: strconv.Itoa(want), Service: "s", Port: 4500, Preferred: true,
+			Range: &model.PortRange{Min: 4600, Max: 4699}})
+		req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != 201 {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var alloc model.Allocation
+		json.NewDecoder(w.Body).Decode(&alloc)
+		if alloc.Port != want {
+			t.Fatalf("expected port %d, got %d", want, alloc.Port)
+		}
+	}
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "x", Service: "s", Range: &model.PortRange{Min: 5000, Max: 4000}})
+	req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("expected 400 for an inverted range, got %d", w.Code)
+	}
+}
+
 func TestAllocateValidation(t *testing.T) {
 	srv := setup(t)
 
@@ -212,6 +298,174 @@ func TestCheckPort(t *testing.T) {
 	if status.Holder == nil {
 		t.Fatal("expected holder info")
 	}
+
+	// The allocation is tcp, so the port is still free for udp.
+	req = httptest.NewRequest("GET", "/v1/ports/4000?proto=udp", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	status = model.PortStatus{}
+	json.NewDecoder(w.Body).Decode(&status)
+	if !status.Available {
+		t.Fatalf("expected port to be available for udp, got %+v", status)
+	}
+
+	req = httptest.NewRequest("GET", "/v1/ports/4000?proto=sctp", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("expected 400 for an unknown protocol, got %d", w.Code)
+	}
+}
+
+func TestPortListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc")
+	}
+	srv := setup(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: port})
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body)))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/v1/ports/"+strconv.Itoa(port)+"/listener", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var pl model.PortListeners
+	json.NewDecoder(w.Body).Decode(&pl)
+	if len(pl.Listeners) != 1 {
+		t.Fatalf("expected one listener, got %+v", pl.Listeners)
+	}
+	if l := pl.Listeners[0]; l.Proto != "tcp" || l.Address != "127.0.0.1" || l.PID != os.Getpid() || len(l.Cmdline) == 0 {
+		t.Errorf("expected this test process on tcp 127.0.0.1, got %+v", l)
+	}
+	if len(pl.Allocations) != 1 || pl.Allocations[0].Service != "s" {
+		t.Errorf("expected the port's allocation, got %+v", pl.Allocations)
+	}
+
+	ln.Close()
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/v1/ports/"+strconv.Itoa(port)+"/listener", nil))
+	pl = model.PortListeners{}
+	json.NewDecoder(w.Body).Decode(&pl)
+	if w.Code != 200 || len(pl.Listeners) != 0 {
+		t.Errorf("expected no listeners once closed, got %d %+v", w.Code, pl.Listeners)
+	}
+}
+
+func TestPortListenerRedacted(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc")
+	}
+	s := newStore(t)
+	_, reader, _ := s.CreateToken(model.Token{Name: "reader", Scope: model.ScopeRead})
+	_, admin, _ := s.CreateToken(model.Token{Name: "admin", Scope: model.ScopeAdmin})
+	srv := validated(t, New(s, WithAuth()).Routes())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	path := "/v1/ports/" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) + "/listener"
+
+	get := func(token string) model.Listener {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		var pl model.PortListeners
+		json.NewDecoder(w.Body).Decode(&pl)
+		if w.Code != 200 || len(pl.Listeners) != 1 {
+			t.Fatalf("expected one listener, got %d: %s", w.Code, w.Body.String())
+		}
+		return pl.Listeners[0]
+	}
+	// Command lines and working directories may carry secrets.
+	if l := get(reader); l.PID != os.Getpid() || l.Cmdline != nil || l.Cwd != "" {
+		t.Errorf("expected the process without its command line and directory for a read token, got %+v", l)
+	}
+	if l := get(admin); len(l.Cmdline) == 0 || l.Cwd == "" {
+		t.Errorf("expected the command line and directory for an admin token, got %+v", l)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"shop/.git", "blog/.git", "blog/src"} {
+		os.MkdirAll(filepath.Join(root, dir), 0o755)
+	}
+	shop := &model.GitInfo{Repo: filepath.Join(root, "shop", ".git")}
+	allocs := []model.Allocation{
+		{ID: 1, App: "shop", Service: "web", Port: 3000, Proto: "tcp", Git: shop},
+		{ID: 2, App: "shop", Service: "db", Port: 3001, Proto: "tcp", Git: shop},
+		{ID: 3, App: "shop", Service: "api", Port: 3002, Proto: "tcp", Git: shop},
+		{ID: 4, App: "old", Service: "web", Port: 3003, Proto: "tcp"},
+		{ID: 5, App: "shop", Service: "dns", Port: 3004, Proto: "udp"},
+	}
+	listeners := []model.Listener{
+		{Proto: "tcp", Port: 3000, PID: 10, Cwd: filepath.Join(root, "shop")},
+		{Proto: "tcp", Port: 3001, PID: 11, Cwd: filepath.Join(root, "blog", "src")},
+		{Proto: "tcp", Port: 3002, PID: 12, Cwd: "/", Container: "4f6c3d2e1b0a"},
+		{Proto: "udp6", Port: 3004, PID: 15},
+		{Proto: "tcp", Port: 3004, PID: 16},
+		{Proto: "tcp", Port: 4000, PID: 13},
+		{Proto: "tcp6", Port: 4000, PID: 13},
+		{Proto: "udp", Port: 5353, PID: 14},
+	}
+	managed := func(port int) bool { return port < 5000 }
+
+	got := audit(allocs, listeners, managed)
+	var summary []string
+	for _, f := range got {
+		summary = append(summary, f.Kind+" "+strconv.Itoa(f.Port)+" "+strconv.Itoa(len(f.Listeners))+" "+f.Repo)
+	}
+	want := []string{
+		"repo_mismatch 3001 1 " + filepath.Join(root, "blog", ".git"),
+		"not_listening 3003 0 ",
+		"unregistered 3004 1 ",
+		"unregistered 4000 2 ",
+	}
+	if strings.Join(summary, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got findings\n%s\nwant\n%s", strings.Join(summary, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestAuditRoute(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc")
+	}
+	srv := setup(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close() // nothing listens on it now
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: port})
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body)))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/v1/audit", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var findings []model.AuditFinding
+	json.NewDecoder(w.Body).Decode(&findings)
+	for _, f := range findings {
+		if f.Port == port && f.Kind == model.AuditNotListening {
+			return
+		}
+	}
+	t.Errorf("expected port %d to be reported as not listening, got %+v", port, findings)
 }
 
 func TestReleaseByID(t *testing.T) {
@@ -403,4 +657,721 @@ func TestReleaseFilterNoFilter(t *testing.T) {
 	if w.Code != 400 {
 		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
 	}
+	var errResp model.ErrorResponse
+	json.NewDecoder(w.Body).Decode(&errResp)
+	if errResp.Code != model.CodeFilterRequired {
+		t.Fatalf("expected code %q, got %q", model.CodeFilterRequired, errResp.Code)
+	}
+}
+
+func TestAllocateRangeExhausted(t *testing.T) {
+	srv := validated(t, New(newStore(t), WithPortRange(20000, 20000)).Routes())
+
+	for i, want := range []int{201, 409} {
+		body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s" + strconv.Itoa(i)})
+		req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("allocation %d: expected %d, got %d: %s", i, want, w.Code, w.Body.String())
+		}
+		if want != 409 {
+			continue
+		}
+		var errResp model.ErrorResponse
+		json.NewDecoder(w.Body).Decode(&errResp)
+		if errResp.Code != model.CodeRangeExhausted {
+			t.Fatalf("expected code %q, got %q", model.CodeRangeExhausted, errResp.Code)
+		}
+		if errResp.Range == nil || errResp.Range.Min != 20000 || errResp.Range.Max != 20000 {
+			t.Fatalf("expected range 20000-20000, got %+v", errResp.Range)
+		}
+	}
+}
+
+func TestRenew(t *testing.T) {
+	srv := setup(t)
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s", TTL: "10m"})
+	req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	if w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var alloc model.Allocation
+	json.NewDecoder(w.Body).Decode(&alloc)
+	if alloc.ExpiresAt == nil {
+		t.Fatal("expected expires_at in allocate response")
+	}
+
+	body, _ = json.Marshal(model.RenewRequest{TTL: "2h"})
+	req = httptest.NewRequest("POST", "/v1/allocations/"+strconv.FormatInt(alloc.ID, 10)+"/renew", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var renewed model.Allocation
+	json.NewDecoder(w.Body).Decode(&renewed)
+	if renewed.ExpiresAt == nil || !renewed.ExpiresAt.After(*alloc.ExpiresAt) {
+		t.Fatalf("expected expiry to move forward, got %v (was %v)", renewed.ExpiresAt, alloc.ExpiresAt)
+	}
+
+	// Empty body renews with the original TTL.
+	req = httptest.NewRequest("POST", "/v1/allocations/"+strconv.FormatInt(alloc.ID, 10)+"/renew", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 for empty body, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRenewErrors(t *testing.T) {
+	srv := setup(t)
+
+	req := httptest.NewRequest("POST", "/v1/allocations/999/renew", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Fatalf("expected 404, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s"})
+	req = httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	var alloc model.Allocation
+	json.NewDecoder(w.Body).Decode(&alloc)
+
+	// Permanent allocation and no ttl in the request.
+	req = httptest.NewRequest("POST", "/v1/allocations/"+strconv.FormatInt(alloc.ID, 10)+"/renew", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAllocateInvalidTTL(t *testing.T) {
+	srv := setup(t)
+
+	for _, ttl := range []string{"soon", "-1h", "0s"} {
+		body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "s", TTL: ttl})
+		req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Fatalf("ttl=%q: expected 400, got %d: %s", ttl, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAllocateBatch(t *testing.T) {
+	srv := setup(t)
+
+	body, _ := json.Marshal(model.BatchAllocateRequest{Allocations: []model.AllocateRequest{
+		{App: "a", Instance: "i", Service: "web"},
+		{App: "a", Instance: "i", Service: "db"},
+	}})
+	req := httptest.NewRequest("POST", "/v1/allocations/batch", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	if w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var allocs []model.Allocation
+	json.NewDecoder(w.Body).Decode(&allocs)
+	if len(allocs) != 2 || allocs[0].Port == allocs[1].Port {
+		t.Fatalf("expected 2 distinct allocations, got %+v", allocs)
+	}
+}
+
+func TestAllocateBatchConflict(t *testing.T) {
+	srv := setup(t)
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "other", Instance: "i", Service: "s", Port: 5000})
+	req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	body, _ = json.Marshal(model.BatchAllocateRequest{Allocations: []model.AllocateRequest{
+		{App: "a", Instance: "i", Service: "web"},
+		{App: "a", Instance: "i", Service: "db", Port: 5000},
+	}})
+	req = httptest.NewRequest("POST", "/v1/allocations/batch", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	if w.Code != 409 {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+	var errResp model.ErrorResponse
+	json.NewDecoder(w.Body).Decode(&errResp)
+	if errResp.Index == nil || *errResp.Index != 1 {
+		t.Fatalf("expected index 1 in conflict response, got %v", errResp.Index)
+	}
+	if errResp.Holder == nil || errResp.Holder.App != "other" {
+		t.Fatal("expected holder info in conflict response")
+	}
+
+	// Nothing from the failed batch may remain.
+	req = httptest.NewRequest("GET", "/v1/allocations?app=a", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	var allocs []model.Allocation
+	json.NewDecoder(w.Body).Decode(&allocs)
+	if len(allocs) != 0 {
+		t.Fatalf("expected 0 allocations after failed batch, got %d", len(allocs))
+	}
+}
+
+func TestAllocateBatchValidation(t *testing.T) {
+	srv := setup(t)
+
+	for _, batch := range []model.BatchAllocateRequest{
+		{},
+		{Allocations: []model.AllocateRequest{{App: "a", Instance: "i"}}},
+		{Allocations: []model.AllocateRequest{
+			{App: "a", Instance: "i", Service: "web"},
+			{App: "a", Instance: "i", Service: "web"},
+		}},
+	} {
+		body, _ := json.Marshal(batch)
+		req := httptest.NewRequest("POST", "/v1/allocations/batch", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Fatalf("batch %+v: expected 400, got %d: %s", batch, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	srv := New(newStore(t), WithPortRange(20000, 29999)).Routes()
+
+	body, _ := json.Marshal(model.PortRange{Min: 40000, Max: 40999})
+	req := httptest.NewRequest("PUT", "/v1/ranges/myapp", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/v1/ranges", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	var ranges model.RangesResponse
+	json.NewDecoder(w.Body).Decode(&ranges)
+	if ranges.Default.Min != 20000 || ranges.Default.Max != 29999 {
+		t.Fatalf("expected default range 20000-29999, got %+v", ranges.Default)
+	}
+	if len(ranges.Apps) != 1 || ranges.Apps[0].App != "myapp" {
+		t.Fatalf("expected myapp range, got %+v", ranges.Apps)
+	}
+
+	for app, want := range map[string]int{"myapp": 40000, "other": 20000} {
+		body, _ = json.Marshal(model.AllocateRequest{App: app, Instance: "i", Service: "s"})
+		req = httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		var alloc model.Allocation
+		json.NewDecoder(w.Body).Decode(&alloc)
+		if alloc.Port != want {
+			t.Fatalf("app=%s: expected port %d, got %d", app, want, alloc.Port)
+		}
+	}
+
+	req = httptest.NewRequest("DELETE", "/v1/ranges/myapp", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("DELETE", "/v1/ranges/myapp", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Fatalf("expected 404, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSetRangeValidation(t *testing.T) {
+	srv := setup(t)
+
+	for _, r := range []model.PortRange{{Min: 0, Max: 100}, {Min: 5000, Max: 4000}, {Min: 1, Max: 70000}} {
+		body, _ := json.Marshal(r)
+		req := httptest.NewRequest("PUT", "/v1/ranges/myapp", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Fatalf("range %+v: expected 400, got %d: %s", r, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	srv := setup(t)
+
+	body, _ := json.Marshal(model.Exclusion{Min: 5432, Reason: "PostgreSQL"})
+	req := httptest.NewRequest("POST", "/v1/exclusions", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var excl model.Exclusion
+	json.NewDecoder(w.Body).Decode(&excl)
+	if excl.Min != 5432 || excl.Max != 5432 {
+		t.Fatalf("expected single-port exclusion 5432, got %+v", excl)
+	}
+
+	// Explicit request for an excluded port is rejected...
+	body, _ = json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "db", Port: 5432})
+	req = httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 409 {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// ...unless forced.
+	body, _ = json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "db", Port: 5432, Force: true})
+	req = httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("expected 201 with force, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/v1/exclusions", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	var list []model.Exclusion
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 1 {
+		t.Fatalf("expected 1 exclusion, got %d", len(list))
+	}
+
+	req = httptest.NewRequest("DELETE", "/v1/exclusions/"+strconv.FormatInt(excl.ID, 10), nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("DELETE", "/v1/exclusions/"+strconv.FormatInt(excl.ID, 10), nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Fatalf("expected 404, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAddExclusionValidation(t *testing.T) {
+	srv := setup(t)
+
+	for _, e := range []model.Exclusion{{Min: 0}, {Min: 5000, Max: 4000}, {Min: 1, Max: 70000}} {
+		body, _ := json.Marshal(e)
+		req := httptest.NewRequest("POST", "/v1/exclusions", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Fatalf("exclusion %+v: expected 400, got %d: %s", e, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestListLabelSelector(t *testing.T) {
+	srv := setup(t)
+
+	for svc, owner := range map[string]string{"web": "alice", "db": "bob"} {
+		body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: svc, Labels: map[string]string{"owner": owner}})
+		req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != 201 {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/v1/allocations?label=owner=alice", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var allocs []model.Allocation
+	json.NewDecoder(w.Body).Decode(&allocs)
+	if len(allocs) != 1 || allocs[0].Service != "web" || allocs[0].Labels["owner"] != "alice" {
+		t.Fatalf("expected web labeled owner=alice, got %+v", allocs)
+	}
+
+	req = httptest.NewRequest("GET", "/v1/allocations?label=owner", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("expected 400 for malformed selector, got %d", w.Code)
+	}
+}
+
+func TestListByRepo(t *testing.T) {
+	srv := setup(t)
+
+	for svc, repo := range map[string]string{"web": "/src/a/.git", "db": "/src/b/.git"} {
+		body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: svc, Git: &model.GitInfo{Repo: repo, Branch: "main"}})
+		req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != 201 {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/v1/allocations?repo=/src/a/.git", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	var allocs []model.Allocation
+	json.NewDecoder(w.Body).Decode(&allocs)
+	if len(allocs) != 1 || allocs[0].Service != "web" || allocs[0].Git == nil || allocs[0].Git.Branch != "main" {
+		t.Fatalf("expected web from /src/a/.git, got %+v", allocs)
+	}
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "a", Instance: "i", Service: "x", Git: &model.GitInfo{Branch: "main"}})
+	req = httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("expected 400 for git without repo, got %d", w.Code)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := setup(t)
+
+	body, _ := json.Marshal(model.AllocateRequest{App: "myapp", Instance: "i1", Service: "web", Port: 3000})
+	req := httptest.NewRequest("POST", "/v1/allocations", bytes.NewReader(body))
+	req.Header.Set(model.ActorHeader, "alice")
+	req.Header.Set("User-Agent", "portctl/test")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("DELETE", "/v1/allocations/1", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/v1/events?app=myapp&since=1h", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var events []model.Event
+	json.NewDecoder(w.Body).Decode(&events)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if events[0].Type != model.EventAllocate || events[0].Actor != "alice" || events[0].Source != "portctl/test" {
+		t.Errorf("unexpected allocate event: %+v", events[0])
+	}
+	if events[1].Type != model.EventRelease {
+		t.Errorf("expected release event, got %+v", events[1])
+	}
+
+	for _, q := range []string{"port=abc", "since=yesterday", "limit=-1"} {
+		req = httptest.NewRequest("GET", "/v1/events?"+q, nil)
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", q, w.Code)
+		}
+	}
+}
+
+// readSSE returns the next event from an SSE stream as its id, type and data.
+func readSSE(t *testing.T, sc *bufio.Scanner) (id, typ, data string) {
+	t.Helper()
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			return id, typ, data
+		}
+	}
+	t.Fatalf("stream ended: %v", sc.Err())
+	return
+}
+
+func TestWatch(t *testing.T) {
+	s := newStore(t)
+	srv := httptest.NewServer(New(s).Routes())
+	defer srv.Close()
+
+	// Recorded before the watch starts, so only streamed when resuming.
+	s.Allocate(model.AllocateRequest{App: "myapp", Instance: "i1", Service: "old", Port: 2999}, 1, 65535)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v1/watch?app=myapp", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	// The stream opens with the ID it starts after.
+	if sc.Scan(); sc.Text() != "id: 1" {
+		t.Fatalf("expected the stream to open with id 1, got %q", sc.Text())
+	}
+
+	s.Allocate(model.AllocateRequest{App: "other", Instance: "i1", Service: "web", Port: 3001}, 1, 65535)
+	a, _ := s.Allocate(model.AllocateRequest{App: "myapp", Instance: "i1", Service: "web", Port: 3000}, 1, 65535)
+	s.DeleteByID(a.ID)
+
+	_, typ, data := readSSE(t, sc)
+	var e model.Event
+	json.Unmarshal([]byte(data), &e)
+	if typ != model.EventAllocate || e.App != "myapp" || e.Port != 3000 {
+		t.Fatalf("expected allocate of myapp:3000, got %s %+v", typ, e)
+	}
+	id, typ, _ := readSSE(t, sc)
+	if typ != model.EventRelease {
+		t.Fatalf("expected release, got %s", typ)
+	}
+	cancel()
+
+	// Resuming from an earlier ID replays what was missed.
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	req, _ = http.NewRequestWithContext(ctx2, "GET", srv.URL+"/v1/watch?app=myapp", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	sc = bufio.NewScanner(resp2.Body)
+	_, _, data = readSSE(t, sc)
+	json.Unmarshal([]byte(data), &e)
+	if e.Service != "old" {
+		t.Fatalf("expected replay to start with the oldest event, got %+v", e)
+	}
+	readSSE(t, sc)
+	if last, _, _ := readSSE(t, sc); last != id {
+		t.Fatalf("expected replay to end at event %s, got %s", id, last)
+	}
+
+	resp3, err := http.Get(srv.URL + "/v1/watch?last_event_id=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp3.Body.Close()
+	if resp3.StatusCode != 400 {
+		t.Fatalf("expected 400 for invalid last event id, got %d", resp3.StatusCode)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := newStore(t)
+	srv := validated(t, New(s, WithAuth()).Routes())
+	_, admin, _ := s.CreateToken(model.Token{Name: "root", Scope: model.ScopeAdmin})
+	_, reader, _ := s.CreateToken(model.Token{Name: "dash", Scope: model.ScopeRead})
+	_, webOnly, _ := s.CreateToken(model.Token{Name: "web-ci", Scope: model.ScopeAdmin, AppPrefix: "web-"})
+
+	do := func(method, path, token string, body any) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/healthz", "", nil); w.Code != 200 {
+		t.Errorf("healthz should stay open, got %d", w.Code)
+	}
+	if w := do("GET", "/v1/allocations", "", nil); w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected 401 with challenge, got %d", w.Code)
+	}
+	if w := do("GET", "/v1/allocations", "bogus", nil); w.Code != 401 {
+		t.Errorf("expected 401 for unknown token, got %d", w.Code)
+	}
+	if w := do("GET", "/v1/allocations", reader, nil); w.Code != 200 {
+		t.Errorf("expected read to be allowed, got %d", w.Code)
+	}
+	if w := do("POST", "/v1/allocations", reader, model.AllocateRequest{App: "web-a", Instance: "i", Service: "s"}); w.Code != 403 {
+		t.Errorf("expected 403 for read token allocating, got %d", w.Code)
+	}
+
+	// App prefix restricts changes.
+	if w := do("POST", "/v1/allocations", webOnly, model.AllocateRequest{App: "web-a", Instance: "i", Service: "s", Port: 3000}); w.Code != 201 {
+		t.Fatalf("expected 201 within prefix, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/v1/allocations", webOnly, model.AllocateRequest{App: "api", Instance: "i", Service: "s", Port: 3001}); w.Code != 403 {
+		t.Errorf("expected 403 outside prefix, got %d", w.Code)
+	}
+	other := do("POST", "/v1/allocations", admin, model.AllocateRequest{App: "api", Instance: "i", Service: "s", Port: 3001})
+	var otherAlloc model.Allocation
+	json.NewDecoder(other.Body).Decode(&otherAlloc)
+	if w := do("DELETE", "/v1/allocations/"+strconv.FormatInt(otherAlloc.ID, 10), webOnly, nil); w.Code != 403 {
+		t.Errorf("expected 403 releasing another app by id, got %d", w.Code)
+	}
+	if w := do("DELETE", "/v1/allocations", webOnly, model.ReleaseRequest{Service: "s"}); w.Code != 403 {
+		t.Errorf("expected 403 releasing by filter without app, got %d", w.Code)
+	}
+	if w := do("PUT", "/v1/ranges/web-a", webOnly, model.PortRange{Min: 40000, Max: 40999}); w.Code != 200 {
+		t.Errorf("expected range within prefix to be allowed, got %d", w.Code)
+	}
+	if w := do("POST", "/v1/exclusions", webOnly, model.Exclusion{Min: 5000}); w.Code != 403 {
+		t.Errorf("expected 403 for global setting with prefixed token, got %d", w.Code)
+	}
+
+	// Changes are attributed to the token.
+	events, _ := s.ListEvents(store.EventFilter{App: "web-a"})
+	if len(events) == 0 || events[0].Actor != "web-ci" {
+		t.Errorf("expected actor web-ci, got %+v", events)
+	}
+
+	// App prefix restricts reads too.
+	var allocs []model.Allocation
+	json.NewDecoder(do("GET", "/v1/allocations", webOnly, nil).Body).Decode(&allocs)
+	if len(allocs) != 1 || allocs[0].App != "web-a" {
+		t.Errorf("expected only web-a's allocation, got %+v", allocs)
+	}
+	json.NewDecoder(do("GET", "/v1/allocations", reader, nil).Body).Decode(&allocs)
+	if len(allocs) != 2 {
+		t.Errorf("expected an unrestricted token to see both allocations, got %+v", allocs)
+	}
+	var history []model.Event
+	json.NewDecoder(do("GET", "/v1/events?limit=1", webOnly, nil).Body).Decode(&history)
+	if len(history) != 1 || history[0].App != "web-a" {
+		t.Errorf("expected only web-a's history, got %+v", history)
+	}
+	var status model.PortStatus
+	json.NewDecoder(do("GET", "/v1/ports/3001", webOnly, nil).Body).Decode(&status)
+	if status.Available || status.Holder != nil {
+		t.Errorf("expected port 3001 taken without its holder, got %+v", status)
+	}
+	w := do("POST", "/v1/allocations", webOnly, model.AllocateRequest{App: "web-b", Instance: "i", Service: "s", Port: 3001})
+	var conflict model.ErrorResponse
+	json.NewDecoder(w.Body).Decode(&conflict)
+	if w.Code != 409 || conflict.Code != model.CodePortTaken || conflict.Holder != nil {
+		t.Errorf("expected a port_taken conflict without the holder, got %d %+v", w.Code, conflict)
+	}
+
+	// Token management.
+	w = do("POST", "/v1/tokens", admin, model.CreateTokenRequest{Name: "new", Scope: model.ScopeAllocate})
+	if w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created model.CreateTokenResponse
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Secret == "" {
+		t.Fatal("expected secret in response")
+	}
+	if w := do("GET", "/v1/tokens", created.Secret, nil); w.Code != 403 {
+		t.Errorf("expected 403 listing tokens with allocate scope, got %d", w.Code)
+	}
+	if w := do("POST", "/v1/tokens", admin, model.CreateTokenRequest{Name: "x", Scope: "root"}); w.Code != 400 {
+		t.Errorf("expected 400 for invalid scope, got %d", w.Code)
+	}
+	if w := do("DELETE", "/v1/tokens/"+strconv.FormatInt(created.ID, 10), admin, nil); w.Code != 200 {
+		t.Errorf("expected 200 revoking, got %d", w.Code)
+	}
+	if w := do("GET", "/v1/allocations", created.Secret, nil); w.Code != 401 {
+		t.Errorf("expected revoked token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newStore(t)
+	s.AddExclusion(model.Exclusion{Min: 20005, Max: 20009})
+	s.SetRange(model.PortRange{App: "web", Min: 30000, Max: 30009})
+	srv := validated(t, New(s, WithPortRange(20000, 20099), WithMetrics(metrics.NewRegistry())).Routes())
+
+	do := func(method, path string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(data)))
+		return w
+	}
+	do("POST", "/v1/allocations", model.AllocateRequest{App: "web", Instance: "i", Service: "http"})
+	do("POST", "/v1/allocations", model.AllocateRequest{App: "api", Instance: "i", Service: "http", Port: 20001})
+	do("POST", "/v1/allocations", model.AllocateRequest{App: "api", Instance: "i", Service: "dns", Port: 20001, Proto: model.ProtoUDP})
+	do("POST", "/v1/allocations", model.AllocateRequest{App: "api", Instance: "i", Service: "syslog", Port: 20002, Proto: model.ProtoUDP})
+	if w := do("POST", "/v1/allocations", model.AllocateRequest{App: "api", Instance: "j", Service: "http", Port: 20001}); w.Code != 409 {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+	do("DELETE", "/v1/allocations/999", nil)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	out := w.Body.String()
+	for _, want := range []string{
+		`port_registry_allocations{app="api"} 3`,
+		`port_registry_allocations{app="web"} 1`,
+		`port_registry_range_ports{range="default"} 100`,
+		`port_registry_range_free_ports{range="default",proto="tcp"} 94`,
+		`port_registry_range_free_ports{range="default",proto="udp"} 93`,
+		`port_registry_range_free_ports{range="web",proto="tcp"} 9`,
+		`port_registry_range_free_ports{range="web",proto="udp"} 10`,
+		`port_registry_allocation_failures_total{reason="port_taken"} 1`,
+		`port_registry_allocation_failures_total{reason="port_busy"} 0`,
+		`port_registry_http_request_duration_seconds_count{method="POST",route="/v1/allocations",status="409"} 1`,
+		`port_registry_http_request_duration_seconds_count{method="DELETE",route="/v1/allocations/{id}",status="404"} 1`,
+		`port_registry_store_duration_seconds_count{operation="Allocate"} 5`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	// With auth, scraping needs a read token.
+	srv = New(s, WithAuth(), WithMetrics(metrics.NewRegistry())).Routes()
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 401 {
+		t.Errorf("expected 401 without token, got %d", w.Code)
+	}
+	_, webOnly, _ := s.CreateToken(model.Token{Name: "web-ci", Scope: model.ScopeRead, AppPrefix: "web"})
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+webOnly)
+	srv.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Errorf("expected 403 for a token with an app prefix, got %d", w.Code)
+	}
 }
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/n3r/port-registry/internal/procnet"
+	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// PortListener reports the processes listening on a port of the server's
+// host, and the port's allocations.
+func (h *Handler) PortListener(w http.ResponseWriter, r *http.Request) {
+	port, ok := portParam(w, r)
+	if !ok {
+		return
+	}
+
+	listeners, err := findListeners(func(s procnet.Socket) bool { return s.Port == port })
+	if err != nil {
+		writeListenerError(w, err)
+		return
+	}
+	allocs, err := h.store.List(store.Filter{Port: port})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+		return
+	}
+	allocs = slices.DeleteFunc(allocs, func(a model.Allocation) bool { return !canSee(r, a.App) })
+	if allocs == nil {
+		allocs = []model.Allocation{}
+	}
+	redactListeners(r, listeners)
+	writeJSON(w, http.StatusOK, model.PortListeners{Port: port, Listeners: listeners, Allocations: allocs})
+}
+
+// redactListeners clears the command lines and working directories of
+// listeners, which may contain secrets such as passwords in flags, unless
+// the request's token has the admin scope.
+func redactListeners(r *http.Request, listeners []model.Listener) {
+	if t := tokenFrom(r); t == nil || scopeRank[t.Scope] >= scopeRank[model.ScopeAdmin] {
+		return
+	}
+	for i := range listeners {
+		listeners[i].Cmdline, listeners[i].Cwd = nil, ""
+	}
+}
+
+// findListeners returns the sockets on the server's host that match, one
+// listener per process holding each, sorted by port and protocol.
+func findListeners(match func(procnet.Socket) bool) ([]model.Listener, error) {
+	sockets, err := procnet.Listeners(procnet.DefaultRoot)
+	if err != nil {
+		return nil, err
+	}
+	sockets = slices.DeleteFunc(sockets, func(s procnet.Socket) bool { return !match(s) })
+	inodes := make([]uint64, len(sockets))
+	for i, s := range sockets {
+		inodes[i] = s.Inode
+	}
+	owners, err := procnet.Owners(procnet.DefaultRoot, inodes)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := []model.Listener{}
+	for _, s := range sockets {
+		l := model.Listener{Proto: s.Proto, Address: s.Addr.String(), Port: s.Port}
+		if len(owners[s.Inode]) == 0 {
+			listeners = append(listeners, l)
+			continue
+		}
+		for _, p := range owners[s.Inode] {
+			l.PID, l.Process, l.Cmdline, l.Cwd, l.Container = p.PID, p.Name, p.Cmdline, p.Cwd, p.Container
+			listeners = append(listeners, l)
+		}
+	}
+	slices.SortStableFunc(listeners, func(a, b model.Listener) int {
+		return cmp.Or(cmp.Compare(a.Port, b.Port), strings.Compare(a.Proto, b.Proto), cmp.Compare(a.PID, b.PID))
+	})
+	return listeners, nil
+}
+
+func writeListenerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errors.ErrUnsupported) {
+		writeJSON(w, http.StatusNotImplemented, model.ErrorResponse{Code: model.CodeUnsupported, Error: "listing listeners needs a Linux server with /proc"})
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/n3r/port-registry/internal/metrics"
+	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// storeBuckets are upper bounds in seconds for store call latencies, which are
+// mostly well under a millisecond.
+var storeBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1}
+
+// allocationFailures maps the allocation errors counted by
+// port_registry_allocation_failures_total to their reason label, which is the
+// error code returned to clients.
+var allocationFailures = []struct {
+	err    error
+	reason string
+}{
+	{store.ErrServiceAllocated, model.CodeServiceAllocated},
+	{store.ErrPortTaken, model.CodePortTaken},
+	{store.ErrPortBusy, model.CodePortBusy},
+	{store.ErrPortExcluded, model.CodePortExcluded},
+	{store.ErrRangeExhausted, model.CodeRangeExhausted},
+}
+
+// WithMetrics records request and store metrics in reg and serves them at
+// /metrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(h *Handler) {
+		h.metrics = reg
+	}
+}
+
+type handlerMetrics struct {
+	requests *metrics.Histogram
+	store    *metrics.Histogram
+	failures *metrics.Counter
+}
+
+// instrument registers the handler's metrics and wraps its store so that
+// every call is timed.
+func (h *Handler) instrument(reg *metrics.Registry) {
+	m := &handlerMetrics{
+		requests: reg.NewHistogram("port_registry_http_request_duration_seconds",
+			"Time taken to serve API requests, by route pattern.", metrics.DefaultBuckets, "method", "route", "status"),
+		store: reg.NewHistogram("port_registry_store_duration_seconds",
+			"Time taken by database operations.", storeBuckets, "operation"),
+		failures: reg.NewCounter("port_registry_allocation_failures_total",
+			"Allocations rejected because of a conflict, a busy or excluded port, or a full range.", "reason"),
+	}
+	for _, f := range allocationFailures {
+		m.failures.Add(0, f.reason)
+	}
+	h.store = store.Instrument(h.store, m.observeStore)
+
+	reg.NewGaugeFunc("port_registry_allocations",
+		"Current allocations per app.", []string{"app"}, h.collectAllocations)
+	reg.NewGaugeFunc("port_registry_range_ports",
+		"Size of each auto-assignment range; range is the app name, or default for the global range.", []string{"range"}, h.collectRanges)
+	reg.NewGaugeFunc("port_registry_range_free_ports",
+		"Ports in each auto-assignment range that are neither allocated for the protocol nor excluded.", []string{"range", "proto"}, h.collectFreePorts)
+
+	h.stats = m
+}
+
+func (m *handlerMetrics) observeStore(op string, d time.Duration, err error) {
+	m.store.Observe(d.Seconds(), op)
+	if err == nil || (op != "Allocate" && op != "Ensure" && op != "AllocateBatch") {
+		return
+	}
+	for _, f := range allocationFailures {
+		if errors.Is(err, f.err) {
+			m.failures.Inc(f.reason)
+			return
+		}
+	}
+}
+
+// observeRequests records the latency of each request under its route pattern
+// rather than its path, so that IDs and ports do not create new series.
+func (h *Handler) observeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		switch route {
+		case "/v1/watch":
+			return // streams last as long as the client stays connected
+		case "":
+			route = "unmatched"
+		}
+		h.stats.requests.Observe(time.Since(start).Seconds(), r.Method, route, strconv.Itoa(ww.Status()))
+	})
+}
+
+func (h *Handler) collectAllocations() ([]metrics.Sample, error) {
+	allocs, err := h.store.List(store.Filter{})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, a := range allocs {
+		counts[a.App]++
+	}
+	samples := make([]metrics.Sample, 0, len(counts))
+	for app, n := range counts {
+		samples = append(samples, metrics.Sample{Labels: []string{app}, Value: float64(n)})
+	}
+	return samples, nil
+}
+
+// collectRanges reports the size of the default range and every app range.
+func (h *Handler) collectRanges() ([]metrics.Sample, error) {
+	ranges, err := h.ranges()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]metrics.Sample, 0, len(ranges))
+	for _, pr := range ranges {
+		samples = append(samples, metrics.Sample{Labels: []string{pr.App}, Value: float64(pr.Max - pr.Min + 1)})
+	}
+	return samples, nil
+}
+
+// collectFreePorts reports how many ports of each range remain for
+// auto-assignment, per protocol: a port allocated for udp only is still free
+// for tcp.
+func (h *Handler) collectFreePorts() ([]metrics.Sample, error) {
+	ranges, err := h.ranges()
+	if err != nil {
+		return nil, err
+	}
+	used, err := h.usedPorts()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]metrics.Sample, 0, 2*len(ranges))
+	for _, pr := range ranges {
+		for _, proto := range []string{model.ProtoTCP, model.ProtoUDP} {
+			n := 0
+			for p := pr.Min; p <= pr.Max; p++ {
+				if !used[proto][p] {
+					n++
+				}
+			}
+			samples = append(samples, metrics.Sample{Labels: []string{pr.App, proto}, Value: float64(n)})
+		}
+	}
+	return samples, nil
+}
+
+// ranges returns the default range, named default, and every app range.
+func (h *Handler) ranges() ([]model.PortRange, error) {
+	ranges, err := h.store.ListRanges()
+	if err != nil {
+		return nil, err
+	}
+	return append([]model.PortRange{{App: "default", Min: h.portMin, Max: h.portMax}}, ranges...), nil
+}
+
+// usedPorts marks, for tcp and udp, every port allocated for that protocol
+// or excluded.
+func (h *Handler) usedPorts() (map[string][]bool, error) {
+	allocs, err := h.store.List(store.Filter{})
+	if err != nil {
+		return nil, err
+	}
+	excl, err := h.store.ListExclusions()
+	if err != nil {
+		return nil, err
+	}
+	used := map[string][]bool{model.ProtoTCP: make([]bool, 65536), model.ProtoUDP: make([]bool, 65536)}
+	for _, a := range allocs {
+		if a.Proto != model.ProtoUDP {
+			used[model.ProtoTCP][a.Port] = true
+		}
+		if a.Proto != model.ProtoTCP {
+			used[model.ProtoUDP][a.Port] = true
+		}
+	}
+	for _, e := range excl {
+		for p := e.Min; p <= e.Max; p++ {
+			used[model.ProtoTCP][p] = true
+			used[model.ProtoUDP][p] = true
+		}
+	}
+	return used, nil
+}
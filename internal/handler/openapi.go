@@ -0,0 +1,17 @@
+package handler
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes every route served by Routes. Handler tests check
+// responses against it, so it must change along with the handlers.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func (h *Handler) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/n3r/port-registry/internal/metrics"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// apiSpec is the parsed openapi.json, with just enough of OpenAPI 3 and JSON
+// Schema implemented to check the handlers' responses against it.
+type apiSpec map[string]any
+
+func loadSpec(t *testing.T) apiSpec {
+	t.Helper()
+	var sp apiSpec
+	if err := json.Unmarshal(openAPISpec, &sp); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return sp
+}
+
+// validated wraps h so that every response it writes is checked against the
+// spec.
+func validated(t *testing.T, h http.Handler) http.Handler {
+	sp := loadSpec(t)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		for _, problem := range sp.checkResponse(r, rec) {
+			t.Errorf("%s %s -> %d: %s", r.Method, r.URL.Path, rec.Code, problem)
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+}
+
+// operation finds the spec operation for method and path, preferring the
+// template with the most literal segments, as the router does.
+func (sp apiSpec) operation(method, path string) (string, map[string]any) {
+	segs := strings.Split(path, "/")
+	best, bestScore := "", -1
+	for tmpl, item := range sp["paths"].(map[string]any) {
+		if _, ok := item.(map[string]any)[strings.ToLower(method)]; !ok {
+			continue
+		}
+		tsegs := strings.Split(tmpl, "/")
+		if len(tsegs) != len(segs) {
+			continue
+		}
+		score := 0
+		for i, ts := range tsegs {
+			if strings.HasPrefix(ts, "{") && segs[i] != "" {
+				continue
+			}
+			if ts != segs[i] {
+				score = -1
+				break
+			}
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = tmpl, score
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+	op := sp["paths"].(map[string]any)[best].(map[string]any)[strings.ToLower(method)]
+	return best, op.(map[string]any)
+}
+
+func (sp apiSpec) checkResponse(r *http.Request, rec *httptest.ResponseRecorder) []string {
+	tmpl, op := sp.operation(r.Method, r.URL.Path)
+	if op == nil {
+		return []string{"operation not in spec"}
+	}
+	resp, ok := op["responses"].(map[string]any)[strconv.Itoa(rec.Code)]
+	if !ok {
+		return []string{"status not documented for " + tmpl}
+	}
+	content, _ := sp.resolve(resp.(map[string]any))["content"].(map[string]any)
+	ct, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	media, ok := content[ct].(map[string]any)
+	if !ok {
+		return []string{"content type " + ct + " not documented for " + tmpl}
+	}
+	if ct != "application/json" {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(rec.Body.Bytes()))
+	dec.UseNumber()
+	var body any
+	if err := dec.Decode(&body); err != nil {
+		return []string{"invalid JSON: " + err.Error()}
+	}
+	return sp.validate(media["schema"].(map[string]any), body, "body")
+}
+
+// resolve follows $ref until it reaches a definition.
+func (sp apiSpec) resolve(node map[string]any) map[string]any {
+	for {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		var cur any = map[string]any(sp)
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			cur = cur.(map[string]any)[part]
+		}
+		node = cur.(map[string]any)
+	}
+}
+
+func (sp apiSpec) validate(schema map[string]any, v any, at string) []string {
+	schema = sp.resolve(schema)
+	var problems []string
+	fail := func(msg string) []string { return append(problems, at+": "+msg) }
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if e == v {
+				found = true
+			}
+		}
+		if !found {
+			return fail("not one of the enum values")
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fail("want object")
+		}
+		props, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				problems = fail("missing required " + name.(string))
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := props[k]; ok {
+				problems = append(problems, sp.validate(p.(map[string]any), obj[k], at+"."+k)...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					problems = fail("unexpected property " + k)
+				}
+			case map[string]any:
+				problems = append(problems, sp.validate(extra, obj[k], at+"."+k)...)
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fail("want array")
+		}
+		for i, item := range arr {
+			problems = append(problems, sp.validate(schema["items"].(map[string]any), item, at+"["+strconv.Itoa(i)+"]")...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fail("want string")
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return fail("want date-time")
+			}
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fail("want integer")
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return fail("want integer")
+		}
+		if min, ok := schema["minimum"].(float64); ok && float64(i) < min {
+			return fail("below minimum")
+		}
+		if max, ok := schema["maximum"].(float64); ok && float64(i) > max {
+			return fail("above maximum")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("want boolean")
+		}
+	}
+	return problems
+}
+
+// TestOpenAPICoverage checks that the spec and the router describe the same
+// set of routes.
+func TestOpenAPICoverage(t *testing.T) {
+	sp := loadSpec(t)
+	routes := New(newStore(t), WithMetrics(metrics.NewRegistry())).Routes()
+
+	served := make(map[string]bool)
+	chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = strings.TrimSuffix(route, "/")
+		served[method+" "+route] = true
+		if tmpl, _ := sp.operation(method, route); tmpl != route {
+			t.Errorf("%s %s is not in openapi.json", method, route)
+		}
+		return nil
+	})
+	for tmpl, item := range sp["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			if method == "parameters" {
+				continue
+			}
+			if !served[strings.ToUpper(method)+" "+tmpl] {
+				t.Errorf("openapi.json documents %s %s, which is not served", strings.ToUpper(method), tmpl)
+			}
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	srv := setup(t)
+	do := func(method, path string, body any) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(data)))
+		return w
+	}
+
+	w := do("GET", "/v1/openapi.json", nil)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), openAPISpec) {
+		t.Fatalf("expected the embedded spec, got %d", w.Code)
+	}
+
+	// Routes that the other tests exercise without setup's validation.
+	do("POST", "/v1/allocations", model.AllocateRequest{App: "a", Instance: "i", Service: "s", TTL: "1h", Labels: map[string]string{"k": "v"}})
+	do("GET", "/v1/events?app=a", nil)
+	do("GET", "/v1/events?limit=-1", nil)
+	do("GET", "/v1/watch?last_event_id=x", nil)
+	w = do("POST", "/v1/tokens", model.CreateTokenRequest{Name: "ci", Scope: model.ScopeRead, AppPrefix: "a"})
+	var created model.CreateTokenResponse
+	json.NewDecoder(w.Body).Decode(&created)
+	do("POST", "/v1/tokens", model.CreateTokenRequest{Name: "ci"})
+	do("GET", "/v1/tokens", nil)
+	do("DELETE", "/v1/tokens/"+strconv.FormatInt(created.ID, 10), nil)
+	do("DELETE", "/v1/tokens/"+strconv.FormatInt(created.ID, 10), nil)
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// watchKeepalive is how often an idle stream sends a comment line, so that
+// clients and proxies can tell a quiet stream from a dead one.
+const watchKeepalive = 15 * time.Second
+
+// Watch streams allocate and release events as Server-Sent Events. Each event
+// carries its history ID, so a client can resume with Last-Event-ID (or
+// ?last_event_id=) after reconnecting; without one, only new events are sent.
+// The stream opens with the ID it starts after, so a client that disconnects
+// before the first event can still resume without a gap.
+func (h *Handler) Watch(w http.ResponseWriter, r *http.Request) {
+	f := store.EventFilter{
+		App:      r.URL.Query().Get("app"),
+		Instance: r.URL.Query().Get("instance"),
+		Types:    []string{model.EventAllocate, model.EventRelease},
+	}
+	if t := tokenFrom(r); t != nil {
+		f.AppPrefix = t.AppPrefix
+	}
+
+	// Subscribe before reading the starting point so no change is missed.
+	changed, stop := h.store.Subscribe()
+	defer stop()
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID != "" {
+		id, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || id < 0 {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Code: model.CodeInvalidRequest, Error: "invalid last event id"})
+			return
+		}
+		f.AfterID = id
+	} else {
+		latest, err := h.store.ListEvents(store.EventFilter{Limit: 1})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{Code: model.CodeInternal, Error: err.Error()})
+			return
+		}
+		if len(latest) > 0 {
+			f.AfterID = latest[0].ID
+		}
+	}
+
+	// The server's write timeout is meant for ordinary requests; a stream
+	// stays open until the client goes away.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "id: %d\n\n", f.AfterID)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+	for {
+		events, err := h.store.ListEvents(f)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			rc.Flush()
+			return
+		}
+		for _, e := range events {
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			f.AfterID = e.ID
+		}
+		if len(events) > 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
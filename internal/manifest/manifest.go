@@ -0,0 +1,217 @@
+// Package manifest reads .ports.yaml, the services a repository needs ports
+// for, and compares it with the allocations of an instance.
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/n3r/port-registry/internal/config"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// FileName is the manifest's default name, at the root of a repository.
+const FileName = ".ports.yaml"
+
+// ManagedLabel marks the allocations made from a manifest. Only those are
+// released when their service is removed from it.
+const ManagedLabel = "manifest"
+
+// Manifest lists the services that need a port.
+type Manifest struct {
+	App      string              `yaml:"app"`    // default: detected from the repository
+	Labels   map[string]string   `yaml:"labels"` // set on every allocation
+	Services map[string]*Service `yaml:"services"`
+}
+
+// Service is one service's entry. Without Port or Range, its port is
+// auto-assigned from the app's range or the default one.
+type Service struct {
+	Port   int               `yaml:"port"`  // preferred port; another is assigned if it is not available
+	Range  *Range            `yaml:"range"` // auto-assign from this range, written "3000-3099"
+	Proto  string            `yaml:"proto"` // tcp, udp or both; default tcp
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Range is a first-last range of ports.
+type Range model.PortRange
+
+func (r *Range) UnmarshalYAML(n *yaml.Node) error {
+	min, max, err := config.ParsePortRange(n.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", n.Line, err)
+	}
+	*r = Range{Min: min, Max: max}
+	return nil
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Load reads the manifest at path.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// Parse decodes and checks a manifest. Unknown keys are an error, so that a
+// misspelt field is not silently ignored.
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	if len(m.Services) == 0 {
+		return nil, fmt.Errorf("no services")
+	}
+	for name, svc := range m.Services {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("empty service name")
+		}
+		if svc == nil { // "redis:" with no settings
+			m.Services[name] = &Service{}
+			continue
+		}
+		if svc.Port < 0 || svc.Port > 65535 {
+			return nil, fmt.Errorf("service %s: port must be between 1 and 65535", name)
+		}
+		switch svc.Proto {
+		case "", model.ProtoTCP, model.ProtoUDP, model.ProtoBoth:
+		default:
+			return nil, fmt.Errorf("service %s: proto must be tcp, udp or both", name)
+		}
+	}
+	return &m, nil
+}
+
+// Names returns the service names in order.
+func (m *Manifest) Names() []string {
+	return slices.Sorted(maps.Keys(m.Services))
+}
+
+// Request returns the request that allocates service for app and instance.
+// It keeps a port the service already has.
+func (m *Manifest) Request(app, instance, service string) model.AllocateRequest {
+	svc := m.Services[service]
+	req := model.AllocateRequest{
+		App:       app,
+		Instance:  instance,
+		Service:   service,
+		Port:      svc.Port,
+		Proto:     svc.Proto,
+		Preferred: svc.Port != 0,
+		Ensure:    true,
+		Labels:    m.labels(svc),
+	}
+	if svc.Range != nil {
+		req.Range = &model.PortRange{Min: svc.Range.Min, Max: svc.Range.Max}
+	}
+	return req
+}
+
+// labels returns the labels of a service's allocation.
+func (m *Manifest) labels(svc *Service) map[string]string {
+	labels := map[string]string{ManagedLabel: FileName}
+	maps.Copy(labels, m.Labels)
+	maps.Copy(labels, svc.Labels)
+	return labels
+}
+
+// Actions of a Change.
+const (
+	Add     = "add"     // allocate the service
+	Keep    = "keep"    // the allocation matches
+	Drift   = "drift"   // the allocation differs from the manifest, and is kept
+	Release = "release" // the service was removed from the manifest
+)
+
+// Change is the difference between the manifest and an instance for one service.
+type Change struct {
+	Action  string
+	Service string
+	Alloc   *model.Allocation // nil for Add
+	Detail  string
+}
+
+// Diff compares the manifest with allocs, the allocations of one instance,
+// and returns a change per service, in order. Allocations of services that
+// are not in the manifest are released only if the manifest made them.
+func (m *Manifest) Diff(allocs []model.Allocation) []Change {
+	byService := make(map[string]*model.Allocation, len(allocs))
+	for i := range allocs {
+		byService[allocs[i].Service] = &allocs[i]
+	}
+
+	var changes []Change
+	for _, name := range m.Names() {
+		a := byService[name]
+		if a == nil {
+			changes = append(changes, Change{Action: Add, Service: name, Detail: m.describe(m.Services[name])})
+			continue
+		}
+		if drift := m.drift(m.Services[name], a); len(drift) > 0 {
+			changes = append(changes, Change{Action: Drift, Service: name, Alloc: a, Detail: strings.Join(drift, ", ")})
+		} else {
+			changes = append(changes, Change{Action: Keep, Service: name, Alloc: a})
+		}
+	}
+	for i := range allocs {
+		a := &allocs[i]
+		if _, ok := m.Services[a.Service]; !ok && a.Labels[ManagedLabel] != "" {
+			changes = append(changes, Change{Action: Release, Service: a.Service, Alloc: a, Detail: "not in " + FileName})
+		}
+	}
+	slices.SortStableFunc(changes, func(a, b Change) int { return strings.Compare(a.Service, b.Service) })
+	return changes
+}
+
+// describe says where a new service's port will come from.
+func (m *Manifest) describe(svc *Service) string {
+	switch {
+	case svc.Port != 0 && svc.Range != nil:
+		return fmt.Sprintf("port %d, else from %s", svc.Port, svc.Range)
+	case svc.Port != 0:
+		return fmt.Sprintf("port %d if available", svc.Port)
+	case svc.Range != nil:
+		return "from " + svc.Range.String()
+	}
+	return "auto-assigned"
+}
+
+// drift lists how a differs from svc.
+func (m *Manifest) drift(svc *Service, a *model.Allocation) []string {
+	var drift []string
+	if svc.Port != 0 && a.Port != svc.Port {
+		drift = append(drift, fmt.Sprintf("not on preferred port %d", svc.Port))
+	}
+	if r := svc.Range; r != nil && (a.Port < r.Min || a.Port > r.Max) && a.Port != svc.Port {
+		drift = append(drift, "outside range "+r.String())
+	}
+	if svc.Proto != "" && a.Proto != svc.Proto {
+		drift = append(drift, "protocol is "+a.Proto+", not "+svc.Proto)
+	}
+	want := m.labels(svc)
+	delete(want, ManagedLabel)
+	for _, k := range slices.Sorted(maps.Keys(want)) {
+		if v, ok := a.Labels[k]; !ok || v != want[k] {
+			drift = append(drift, fmt.Sprintf("label %s=%s", k, want[k]))
+		}
+	}
+	return drift
+}
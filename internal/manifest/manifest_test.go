@@ -0,0 +1,90 @@
+package manifest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+const testManifest = `
+app: shop
+labels:
+  team: payments
+services:
+  postgres:
+    port: 5432
+  redis:
+  web:
+    range: 3000-3099
+    proto: both
+    labels:
+      role: frontend
+`
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(testManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.App != "shop" || !reflect.DeepEqual(m.Names(), []string{"postgres", "redis", "web"}) {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	req := m.Request("shop", "main", "web")
+	want := model.AllocateRequest{
+		App: "shop", Instance: "main", Service: "web", Proto: model.ProtoBoth, Ensure: true,
+		Range:  &model.PortRange{Min: 3000, Max: 3099},
+		Labels: map[string]string{ManagedLabel: FileName, "team": "payments", "role": "frontend"},
+	}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+	if req := m.Request("shop", "main", "postgres"); req.Port != 5432 || !req.Preferred {
+		t.Errorf("expected preferred port 5432, got %+v", req)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		"services: {}",
+		"services:\n  web:\n    prot: 80\n",
+		"services:\n  web:\n    range: 3099-3000\n",
+		"services:\n  web:\n    range: 3000-x\n",
+		"services:\n  web:\n    port: 70000\n",
+		"services:\n  web:\n    proto: sctp\n",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	m, err := Parse([]byte(testManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	managed := map[string]string{ManagedLabel: FileName, "team": "payments"}
+	allocs := []model.Allocation{
+		{ID: 1, Service: "postgres", Port: 5432, Labels: managed},
+		{ID: 2, Service: "web", Port: 4000, Proto: model.ProtoTCP, Labels: managed},
+		{ID: 3, Service: "worker", Port: 4001, Labels: managed},
+		{ID: 4, Service: "adminer", Port: 4002},
+	}
+
+	var got []string
+	for _, c := range m.Diff(allocs) {
+		got = append(got, c.Action+" "+c.Service+": "+c.Detail)
+	}
+	want := []string{
+		"keep postgres: ",
+		"add redis: auto-assigned",
+		"drift web: outside range 3000-3099, protocol is tcp, not both, label role=frontend",
+		"release worker: not in .ports.yaml",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
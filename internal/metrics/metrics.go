@@ -0,0 +1,275 @@
+// Package metrics implements the small subset of Prometheus instrumentation
+// the registry needs: labelled counters, histograms and gauges computed at
+// scrape time, exposed in the text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram upper bounds in seconds, suited to request
+// latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and renders them for scraping. It implements
+// http.Handler.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// WriteTo writes every metric in registration order in the Prometheus text
+// format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		if err := m.write(&buf); err != nil {
+			return 0, err
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// Counter is a monotonically increasing value per combination of label values.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+// NewCounter registers a counter. Its name should end in _total.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, series: make(map[string]*counterSeries)}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by v, which must not be negative. Adding 0 makes
+// the series visible before its first event.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labels: labelValues}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(s.labels, "", ""), formatFloat(s.value))
+	}
+	return nil
+}
+
+// Histogram counts observations into cumulative buckets per combination of
+// label values.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds, which
+// must be sorted. A +Inf bucket is implied.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(s.labels, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(s.labels, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(s.labels, "", ""), s.count)
+	}
+	return nil
+}
+
+// Sample is one value of a gauge, with its label values in the order the
+// gauge's labels were declared.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type gaugeFunc struct {
+	desc
+	collect func() ([]Sample, error)
+}
+
+// NewGaugeFunc registers a gauge whose samples are computed by collect on
+// every scrape. An error from collect fails the scrape.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func() ([]Sample, error)) {
+	r.register(&gaugeFunc{desc: desc{name, help, labels}, collect: collect})
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	samples, err := g.collect()
+	if err != nil {
+		return fmt.Errorf("collect %s: %w", g.name, err)
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+	g.header(w, "gauge")
+	for _, s := range samples {
+		g.key(s.Labels)
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(s.Labels, "", ""), formatFloat(s.Value))
+	}
+	return nil
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, typ)
+}
+
+// key identifies a series by its label values. A wrong number of values is a
+// programming error.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs renders {name="value",...}, followed by extra if it is set.
+func (d *desc) labelPairs(values []string, extra, extraValue string) string {
+	if len(values) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(d.labels[i] + `="` + escapeLabel(v) + `"`)
+	}
+	if extra != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra + `="` + escapeLabel(extraValue) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("jobs_total", "Jobs run.", "result")
+	c.Inc("ok")
+	c.Inc("ok")
+	c.Add(0, "error")
+
+	out := render(t, r)
+	for _, want := range []string{
+		"# HELP jobs_total Jobs run.\n# TYPE jobs_total counter\n",
+		`jobs_total{result="error"} 0` + "\n",
+		`jobs_total{result="ok"} 2` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.1, "/a")
+	h.Observe(5, "/a")
+
+	out := render(t, r)
+	for _, want := range []string{
+		`latency_seconds_bucket{route="/a",le="0.1"} 2`,
+		`latency_seconds_bucket{route="/a",le="1"} 2`,
+		`latency_seconds_bucket{route="/a",le="+Inf"} 3`,
+		`latency_seconds_sum{route="/a"} 5.15`,
+		`latency_seconds_count{route="/a"} 3`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("size", "Size.", []string{"name"}, func() ([]Sample, error) {
+		return []Sample{{Labels: []string{`b"\`}, Value: 2}, {Labels: []string{"a"}, Value: 1}}, nil
+	})
+	out := render(t, r)
+	want := "# HELP size Size.\n# TYPE size gauge\n" + `size{name="a"} 1` + "\n" + `size{name="b\"\\"} 2` + "\n"
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+
+	r.NewGaugeFunc("broken", "Broken.", nil, func() ([]Sample, error) {
+		return nil, errors.New("boom")
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 500 {
+		t.Errorf("expected 500 when a gauge fails, got %d", w.Code)
+	}
+}
+
+func TestLabelMismatchPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for wrong number of label values")
+		}
+	}()
+	NewRegistry().NewCounter("c_total", "C.", "a", "b").Inc("x")
+}
+
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	return w.Body.String()
+}
@@ -0,0 +1,206 @@
+// Package procnet finds what listens on ports from Linux's /proc: the sockets
+// in /proc/net/{tcp,tcp6,udp,udp6}, and the processes whose file descriptors
+// refer to them.
+package procnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultRoot is where procfs is mounted.
+const DefaultRoot = "/proc"
+
+// Socket states in /proc/net: TCP_LISTEN for TCP, and TCP_CLOSE for UDP
+// sockets that are bound but not connected.
+const (
+	stateListen = "0A"
+	stateClose  = "07"
+)
+
+// Socket is a listening TCP socket or a bound UDP one.
+type Socket struct {
+	Proto string // tcp, tcp6, udp or udp6
+	Addr  netip.Addr
+	Port  int
+	Inode uint64
+}
+
+// Process is a process holding a socket.
+type Process struct {
+	PID       int
+	Name      string
+	Cmdline   []string
+	Cwd       string // in the process's own mount namespace
+	Container string // the short container ID from its cgroup, if any
+}
+
+// Listeners returns the listening sockets of the network namespace of the
+// process reading root, normally /proc. It returns an error matching
+// errors.ErrUnsupported where there is no /proc/net, as on macOS.
+func Listeners(root string) ([]Socket, error) {
+	var sockets []Socket
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		data, err := os.ReadFile(filepath.Join(root, "net", proto))
+		if errors.Is(err, fs.ErrNotExist) {
+			if proto == "tcp" {
+				return nil, fmt.Errorf("listing sockets: %w: no %s", errors.ErrUnsupported, filepath.Join(root, "net"))
+			}
+			continue // IPv6 may be disabled
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, err := parse(proto, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(root, "net", proto), err)
+		}
+		sockets = append(sockets, s...)
+	}
+	return sockets, nil
+}
+
+// parse reads the sockets of one /proc/net file, such as
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	 0: 0100007F:1538 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 31337 ...
+func parse(proto string, data []byte) ([]Socket, error) {
+	want := stateListen
+	udp := strings.HasPrefix(proto, "udp")
+	if udp {
+		want = stateClose
+	}
+	var sockets []Socket
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if fields[3] != want {
+			continue
+		}
+		// A UDP socket with a remote address is a connected client, not a
+		// server waiting for datagrams. connect() normally also moves it to
+		// ESTABLISHED, but the remote address is what tells them apart.
+		if udp && strings.Trim(fields[2], "0:") != "" {
+			continue
+		}
+		addr, port, err := parseAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inode %q", fields[9])
+		}
+		sockets = append(sockets, Socket{Proto: proto, Addr: addr, Port: port, Inode: inode})
+	}
+	return sockets, sc.Err()
+}
+
+// parseAddr parses an address such as 0100007F:1538, which is 127.0.0.1:5432:
+// the address is in 32-bit words in host byte order, the port big-endian.
+func parseAddr(s string) (netip.Addr, int, error) {
+	host, portHex, ok := strings.Cut(s, ":")
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if !ok || err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(host)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.Addr{}, 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr, int(port), nil
+}
+
+// Owners returns the processes holding each of the socket inodes. Processes
+// whose file descriptors may not be read, such as other users' when not
+// running as root, are left out.
+func Owners(root string, inodes []uint64) (map[uint64][]Process, error) {
+	want := make(map[string]uint64, len(inodes))
+	for _, ino := range inodes {
+		want["socket:["+strconv.FormatUint(ino, 10)+"]"] = ino
+	}
+	owners := make(map[uint64][]Process)
+	if len(want) == 0 {
+		return owners, nil
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(root, e.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // exited, or not ours
+		}
+		seen := make(map[uint64]bool)
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			if ino, ok := want[target]; ok && !seen[ino] {
+				seen[ino] = true
+				owners[ino] = append(owners[ino], process(root, pid))
+			}
+		}
+	}
+	return owners, nil
+}
+
+// process describes the process pid; fields it cannot read are left empty.
+func process(root string, pid int) Process {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	p := Process{PID: pid}
+	if data, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		p.Name = strings.TrimSpace(string(data))
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(data) > 0 {
+		p.Cmdline = strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	}
+	if cwd, err := os.Readlink(filepath.Join(dir, "cwd")); err == nil {
+		p.Cwd = cwd
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		p.Container = container(data)
+	}
+	return p
+}
+
+// containerID matches the 64-hex-digit IDs that Docker, Podman and
+// containerd put in cgroup paths, e.g. /system.slice/docker-<id>.scope or
+// /docker/<id>.
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// container returns the short ID of the container a /proc/<pid>/cgroup file
+// places its process in, or "" on the host.
+func container(cgroup []byte) string {
+	if id := containerID.Find(cgroup); id != nil {
+		return string(id[:12])
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package procnet
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const header = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// fakeProc writes files under a temporary root laid out like /proc.
+func fakeProc(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestListeners(t *testing.T) {
+	root := fakeProc(t, map[string]string{
+		"net/tcp": header +
+			"   0: 0100007F:1538 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 101 1 0000000000000000 100 0 0 10 0\n" +
+			"   1: 0100007F:1538 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 102 1 0000000000000000 20 4 30 10 -1\n",
+		"net/tcp6": header +
+			"   0: 00000000000000000000000000000000:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 103 1 0000000000000000 100 0 0 10 0\n",
+		"net/udp": header +
+			"   0: 00000000:14E9 00000000:0000 07 00000000:00000000 00:00000000 00000000   100        0 104 2 0000000000000000 0\n" +
+			// Connected clients: one moved to ESTABLISHED by connect(), one
+			// with a remote address in the unconnected state.
+			"   1: 0F02000A:A3F2 08080808:0035 01 00000000:00000000 00:00000000 00000000  1000        0 105 2 0000000000000000 0\n" +
+			"   2: 0F02000A:A3F3 08080808:0035 07 00000000:00000000 00:00000000 00000000  1000        0 106 2 0000000000000000 0\n",
+		"net/udp6": header +
+			"   0: 00000000000000000000000000000000:14E9 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000   100        0 107 2 0000000000000000 0\n" +
+			"   1: 00000000000000000000000001000000:A3F4 00000000000000000000000001000000:0035 07 00000000:00000000 00:00000000 00000000  1000        0 108 2 0000000000000000 0\n",
+	})
+	got, err := Listeners(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Socket{
+		{Proto: "tcp", Addr: netip.MustParseAddr("127.0.0.1"), Port: 5432, Inode: 101},
+		{Proto: "tcp6", Addr: netip.MustParseAddr("::"), Port: 80, Inode: 103},
+		{Proto: "udp", Addr: netip.MustParseAddr("0.0.0.0"), Port: 5353, Inode: 104},
+		{Proto: "udp6", Addr: netip.MustParseAddr("::"), Port: 5353, Inode: 107},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := Listeners(t.TempDir()); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported without /proc/net, got %v", err)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	root := fakeProc(t, map[string]string{
+		"42/comm":    "postgres\n",
+		"42/cmdline": "postgres\x00-D\x00/var/lib/postgres\x00",
+		"42/cgroup":  "0::/system.slice/docker-4f6c3d2e1b0a99887766554433221100ffeeddccbbaa00112233445566778899.scope\n",
+		"43/comm":    "sleep\n",
+		"43/cgroup":  "0::/user.slice/user-1000.slice/session-2.scope\n",
+		"self/comm":  "ignored\n",
+	})
+	if err := os.Symlink("/srv/db", filepath.Join(root, "42", "cwd")); err != nil {
+		t.Fatal(err)
+	}
+	for pid, links := range map[string][]string{
+		"42": {"/dev/null", "socket:[101]", "socket:[999]"},
+		"43": {"socket:[101]", "socket:[103]"},
+	} {
+		os.MkdirAll(filepath.Join(root, pid, "fd"), 0o755)
+		for i, target := range links {
+			if err := os.Symlink(target, filepath.Join(root, pid, "fd", string(rune('0'+i)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	got, err := Owners(root, []uint64{101, 103, 104})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres := Process{PID: 42, Name: "postgres", Cmdline: []string{"postgres", "-D", "/var/lib/postgres"}, Cwd: "/srv/db", Container: "4f6c3d2e1b0a"}
+	sleep := Process{PID: 43, Name: "sleep"}
+	want := map[uint64][]Process{101: {postgres, sleep}, 103: {sleep}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
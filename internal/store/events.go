@@ -0,0 +1,160 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+const eventColumns = `id, type, allocation_id, app, instance, service, port, actor, source, detail, created_at`
+
+// notifier fans out change notifications to subscribers.
+type notifier struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{subs: make(map[chan struct{}]struct{})}
+}
+
+func (n *notifier) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.subs[ch] = struct{}{}
+	n.mu.Unlock()
+	return ch, func() {
+		n.mu.Lock()
+		delete(n.subs, ch)
+		n.mu.Unlock()
+	}
+}
+
+func (n *notifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		select {
+		case ch <- struct{}{}:
+		default: // a notification is already pending
+		}
+	}
+}
+
+func (s *SQLiteStore) Subscribe() (<-chan struct{}, func()) {
+	return s.changes.subscribe()
+}
+
+func (s *SQLiteStore) WithOrigin(o model.Origin) Store {
+	c := *s
+	c.origin = o
+	return &c
+}
+
+// recordEvent appends an event describing a to the history, attributed to the
+// store's origin.
+func (s *SQLiteStore) recordEvent(q querier, typ string, a *model.Allocation, detail string) error {
+	_, err := q.Exec(
+		`INSERT INTO allocation_events (type, allocation_id, app, instance, service, port, actor, source, detail, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		typ, a.ID, a.App, a.Instance, a.Service, a.Port, s.origin.Actor, s.origin.Source, detail,
+		time.Now().UTC().Format(time.DateTime),
+	)
+	return err
+}
+
+// recordConflict notes a rejected allocation. It runs after the allocation's
+// transaction has rolled back and is best-effort: failing to record the
+// conflict must not mask the original error.
+func (s *SQLiteStore) recordConflict(req model.AllocateRequest, holder *model.Allocation, err error) {
+	switch err {
+	case ErrServiceAllocated, ErrPortTaken, ErrPortBusy, ErrPortExcluded:
+	default:
+		if !errors.Is(err, ErrRangeExhausted) {
+			return
+		}
+	}
+	detail := err.Error()
+	if holder != nil {
+		detail += fmt.Sprintf(" (held by %s/%s/%s on port %d)", holder.App, holder.Instance, holder.Service, holder.Port)
+	}
+	err = s.recordEvent(s.db, model.EventConflict, &model.Allocation{
+		App:      req.App,
+		Instance: req.Instance,
+		Service:  req.Service,
+		Port:     req.Port,
+	}, detail)
+	if err == nil {
+		s.changes.broadcast()
+	}
+}
+
+func (s *SQLiteStore) ListEvents(f EventFilter) ([]model.Event, error) {
+	var where strings.Builder
+	args := []any{}
+
+	if f.App != "" {
+		where.WriteString(` AND app = ?`)
+		args = append(args, f.App)
+	}
+	if f.AppPrefix != "" {
+		where.WriteString(` AND substr(app, 1, length(?)) = ?`)
+		args = append(args, f.AppPrefix, f.AppPrefix)
+	}
+	if f.Instance != "" {
+		where.WriteString(` AND instance = ?`)
+		args = append(args, f.Instance)
+	}
+	if f.Service != "" {
+		where.WriteString(` AND service = ?`)
+		args = append(args, f.Service)
+	}
+	if f.Port != 0 {
+		where.WriteString(` AND port = ?`)
+		args = append(args, f.Port)
+	}
+	if len(f.Types) > 0 {
+		where.WriteString(` AND type IN (?` + strings.Repeat(`, ?`, len(f.Types)-1) + `)`)
+		for _, t := range f.Types {
+			args = append(args, t)
+		}
+	}
+	if f.AfterID > 0 {
+		where.WriteString(` AND id > ?`)
+		args = append(args, f.AfterID)
+	}
+	if !f.Since.IsZero() {
+		where.WriteString(` AND created_at >= ?`)
+		args = append(args, f.Since.UTC().Format(time.DateTime))
+	}
+
+	// Select newest first so Limit keeps the most recent events, then restore
+	// chronological order.
+	query := `SELECT ` + eventColumns + ` FROM allocation_events WHERE 1=1` + where.String() + ` ORDER BY id DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+	rows, err := s.db.Query(`SELECT * FROM (`+query+`) ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []model.Event
+	for rows.Next() {
+		var e model.Event
+		var createdAt string
+		if err := rows.Scan(&e.ID, &e.Type, &e.AllocationID, &e.App, &e.Instance, &e.Service, &e.Port,
+			&e.Actor, &e.Source, &e.Detail, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
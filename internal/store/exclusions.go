@@ -0,0 +1,63 @@
+package store
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// commonServicePorts are default ports of popular dev services. Auto-assigning
+// them would collide with the next stack that runs the service on its default.
+var commonServicePorts = []model.Exclusion{
+	{Min: 3306, Max: 3306, Reason: "MySQL"},
+	{Min: 5432, Max: 5432, Reason: "PostgreSQL"},
+	{Min: 5672, Max: 5672, Reason: "RabbitMQ"},
+	{Min: 6379, Max: 6379, Reason: "Redis"},
+	{Min: 8080, Max: 8080, Reason: "HTTP alternate"},
+	{Min: 9200, Max: 9200, Reason: "Elasticsearch"},
+	{Min: 11211, Max: 11211, Reason: "Memcached"},
+	{Min: 27017, Max: 27017, Reason: "MongoDB"},
+}
+
+// DefaultExclusions returns the exclusions seeded into a new database: the
+// well-known ports, common service ports, and the OS ephemeral port range.
+func DefaultExclusions() []model.Exclusion {
+	excl := []model.Exclusion{{Min: 1, Max: 1023, Reason: "well-known ports"}}
+	excl = append(excl, commonServicePorts...)
+	if min, max, ok := ephemeralRange(); ok {
+		excl = append(excl, model.Exclusion{Min: min, Max: max, Reason: "ephemeral ports"})
+	}
+	return excl
+}
+
+// ephemeralRange reports the range the OS uses for outgoing connections.
+func ephemeralRange() (min, max int, ok bool) {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 {
+			lo, err1 := strconv.Atoi(fields[0])
+			hi, err2 := strconv.Atoi(fields[1])
+			if err1 == nil && err2 == nil && lo <= hi {
+				return lo, hi, true
+			}
+		}
+	}
+	if runtime.GOOS == "darwin" {
+		return 49152, 65535, true // IANA dynamic range, the macOS default
+	}
+	return 0, 0, false
+}
+
+// excluded reports whether port falls inside any of excl.
+func excluded(excl []model.Exclusion, port int) bool {
+	for _, e := range excl {
+		if port >= e.Min && port <= e.Max {
+			return true
+		}
+	}
+	return false
+}
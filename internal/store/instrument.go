@@ -0,0 +1,191 @@
+package store
+
+import (
+	"time"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// Observer is called after every call on an instrumented Store with the name
+// of the method, how long it took and the error it returned.
+type Observer func(op string, d time.Duration, err error)
+
+// Instrument returns a Store that reports each call on s to observe.
+func Instrument(s Store, observe Observer) Store {
+	return &instrumented{s: s, observe: observe}
+}
+
+type instrumented struct {
+	s       Store
+	observe Observer
+}
+
+func (i *instrumented) done(op string, start time.Time, err error) {
+	i.observe(op, time.Since(start), err)
+}
+
+func (i *instrumented) Ping() error {
+	start := time.Now()
+	err := i.s.Ping()
+	i.done("Ping", start, err)
+	return err
+}
+
+func (i *instrumented) WithOrigin(o model.Origin) Store {
+	return &instrumented{s: i.s.WithOrigin(o), observe: i.observe}
+}
+
+func (i *instrumented) Allocate(req model.AllocateRequest, portMin, portMax int) (*model.Allocation, error) {
+	start := time.Now()
+	a, err := i.s.Allocate(req, portMin, portMax)
+	i.done("Allocate", start, err)
+	return a, err
+}
+
+func (i *instrumented) Ensure(req model.AllocateRequest, portMin, portMax int) (*model.Allocation, bool, error) {
+	start := time.Now()
+	a, existed, err := i.s.Ensure(req, portMin, portMax)
+	i.done("Ensure", start, err)
+	return a, existed, err
+}
+
+func (i *instrumented) AllocateBatch(reqs []model.AllocateRequest, portMin, portMax int) ([]model.Allocation, error) {
+	start := time.Now()
+	allocs, err := i.s.AllocateBatch(reqs, portMin, portMax)
+	i.done("AllocateBatch", start, err)
+	return allocs, err
+}
+
+func (i *instrumented) List(f Filter) ([]model.Allocation, error) {
+	start := time.Now()
+	allocs, err := i.s.List(f)
+	i.done("List", start, err)
+	return allocs, err
+}
+
+func (i *instrumented) GetByID(id int64) (*model.Allocation, error) {
+	start := time.Now()
+	a, err := i.s.GetByID(id)
+	i.done("GetByID", start, err)
+	return a, err
+}
+
+func (i *instrumented) GetByPort(port int, proto string) (*model.Allocation, error) {
+	start := time.Now()
+	a, err := i.s.GetByPort(port, proto)
+	i.done("GetByPort", start, err)
+	return a, err
+}
+
+func (i *instrumented) DeleteByID(id int64) error {
+	start := time.Now()
+	err := i.s.DeleteByID(id)
+	i.done("DeleteByID", start, err)
+	return err
+}
+
+func (i *instrumented) DeleteByFilter(f Filter) (int64, error) {
+	start := time.Now()
+	n, err := i.s.DeleteByFilter(f)
+	i.done("DeleteByFilter", start, err)
+	return n, err
+}
+
+func (i *instrumented) Renew(id int64, ttl time.Duration) (*model.Allocation, error) {
+	start := time.Now()
+	a, err := i.s.Renew(id, ttl)
+	i.done("Renew", start, err)
+	return a, err
+}
+
+func (i *instrumented) DeleteExpired(now time.Time) (int64, error) {
+	start := time.Now()
+	n, err := i.s.DeleteExpired(now)
+	i.done("DeleteExpired", start, err)
+	return n, err
+}
+
+func (i *instrumented) ListRanges() ([]model.PortRange, error) {
+	start := time.Now()
+	ranges, err := i.s.ListRanges()
+	i.done("ListRanges", start, err)
+	return ranges, err
+}
+
+func (i *instrumented) SetRange(r model.PortRange) error {
+	start := time.Now()
+	err := i.s.SetRange(r)
+	i.done("SetRange", start, err)
+	return err
+}
+
+func (i *instrumented) DeleteRange(app string) error {
+	start := time.Now()
+	err := i.s.DeleteRange(app)
+	i.done("DeleteRange", start, err)
+	return err
+}
+
+func (i *instrumented) ListExclusions() ([]model.Exclusion, error) {
+	start := time.Now()
+	excl, err := i.s.ListExclusions()
+	i.done("ListExclusions", start, err)
+	return excl, err
+}
+
+func (i *instrumented) AddExclusion(e model.Exclusion) (*model.Exclusion, error) {
+	start := time.Now()
+	excl, err := i.s.AddExclusion(e)
+	i.done("AddExclusion", start, err)
+	return excl, err
+}
+
+func (i *instrumented) DeleteExclusion(id int64) error {
+	start := time.Now()
+	err := i.s.DeleteExclusion(id)
+	i.done("DeleteExclusion", start, err)
+	return err
+}
+
+func (i *instrumented) ListEvents(f EventFilter) ([]model.Event, error) {
+	start := time.Now()
+	events, err := i.s.ListEvents(f)
+	i.done("ListEvents", start, err)
+	return events, err
+}
+
+func (i *instrumented) Subscribe() (<-chan struct{}, func()) {
+	return i.s.Subscribe()
+}
+
+func (i *instrumented) CreateToken(t model.Token) (*model.Token, string, error) {
+	start := time.Now()
+	tok, secret, err := i.s.CreateToken(t)
+	i.done("CreateToken", start, err)
+	return tok, secret, err
+}
+
+func (i *instrumented) LookupToken(secret string) (*model.Token, error) {
+	start := time.Now()
+	t, err := i.s.LookupToken(secret)
+	i.done("LookupToken", start, err)
+	return t, err
+}
+
+func (i *instrumented) ListTokens() ([]model.Token, error) {
+	start := time.Now()
+	tokens, err := i.s.ListTokens()
+	i.done("ListTokens", start, err)
+	return tokens, err
+}
+
+func (i *instrumented) DeleteToken(id int64) error {
+	start := time.Now()
+	err := i.s.DeleteToken(id)
+	i.done("DeleteToken", start, err)
+	return err
+}
+
+func (i *instrumented) Close() error {
+	return i.s.Close()
+}
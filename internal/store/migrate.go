@@ -0,0 +1,357 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a single numbered schema change. Steps must be idempotent:
+// databases created before schema_version existed already contain some of
+// the objects a migration creates, and the migration is recorded as applied
+// only once all of its steps succeed.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Append new migrations to the
+// end; never renumber or edit one that has shipped.
+var migrations = []migration{
+	{1, "create allocations", migrateAllocations},
+	{2, "add allocation leases", migrateLeases},
+	{3, "create ranges", migrateRanges},
+	{4, "create exclusions", migrateExclusions},
+	{5, "create allocation labels", migrateLabels},
+	{6, "create allocation events", migrateEvents},
+	{7, "create tokens", migrateTokens},
+	{8, "add allocation git metadata", migrateGit},
+	{9, "make port uniqueness protocol-aware", migrateProto},
+}
+
+// MigrationStatus reports one known migration and when it was applied.
+// AppliedAt is nil for migrations that have not run yet.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// LatestVersion is the schema version this binary migrates to by default.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func migrateAllocations(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS allocations (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			app         TEXT    NOT NULL,
+			instance    TEXT    NOT NULL,
+			service     TEXT    NOT NULL,
+			port        INTEGER NOT NULL UNIQUE,
+			created_at  TEXT    NOT NULL DEFAULT (datetime('now')),
+			UNIQUE(app, instance, service)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	// The earliest databases were created without UNIQUE(app, instance, service).
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_alloc_app_instance_service ON allocations(app, instance, service)`)
+	if err != nil {
+		return fmt.Errorf("add unique (app, instance, service) index (remove duplicate allocations first): %w", err)
+	}
+	return nil
+}
+
+func migrateLeases(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "allocations", "expires_at", "TEXT"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "allocations", "ttl_seconds", "INTEGER NOT NULL DEFAULT 0")
+}
+
+func migrateRanges(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS ranges (
+			app      TEXT    PRIMARY KEY,
+			port_min INTEGER NOT NULL,
+			port_max INTEGER NOT NULL
+		)
+	`)
+	return err
+}
+
+func migrateExclusions(tx *sql.Tx) error {
+	exists, err := tableExists(tx, "exclusions")
+	if err != nil {
+		return err
+	}
+	// Seed default exclusions only when the table is first created, so that
+	// exclusions the user removed stay removed.
+	if exists {
+		return nil
+	}
+	_, err = tx.Exec(`
+		CREATE TABLE exclusions (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			port_min INTEGER NOT NULL,
+			port_max INTEGER NOT NULL,
+			reason   TEXT    NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	for _, e := range DefaultExclusions() {
+		if _, err := tx.Exec(`INSERT INTO exclusions (port_min, port_max, reason) VALUES (?, ?, ?)`, e.Min, e.Max, e.Reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateLabels(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS allocation_labels (
+			allocation_id INTEGER NOT NULL,
+			key           TEXT    NOT NULL,
+			value         TEXT    NOT NULL,
+			PRIMARY KEY (allocation_id, key)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_labels_key_value ON allocation_labels(key, value)`)
+	return err
+}
+
+func migrateEvents(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS allocation_events (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			type          TEXT    NOT NULL,
+			allocation_id INTEGER NOT NULL DEFAULT 0,
+			app           TEXT    NOT NULL,
+			instance      TEXT    NOT NULL,
+			service       TEXT    NOT NULL,
+			port          INTEGER NOT NULL DEFAULT 0,
+			actor         TEXT    NOT NULL DEFAULT '',
+			source        TEXT    NOT NULL DEFAULT '',
+			detail        TEXT    NOT NULL DEFAULT '',
+			created_at    TEXT    NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_events_app_created ON allocation_events(app, created_at)`)
+	return err
+}
+
+func migrateTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS tokens (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			name       TEXT    NOT NULL,
+			hash       TEXT    NOT NULL UNIQUE,
+			scope      TEXT    NOT NULL,
+			app_prefix TEXT    NOT NULL DEFAULT '',
+			created_at TEXT    NOT NULL
+		)
+	`)
+	return err
+}
+
+func migrateGit(tx *sql.Tx) error {
+	for _, col := range []string{"git_repo", "git_worktree", "git_branch", "git_commit"} {
+		if err := addColumnIfMissing(tx, "allocations", col, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_alloc_git_repo ON allocations(git_repo)`)
+	return err
+}
+
+// migrateProto adds the protocol column and replaces the port's UNIQUE
+// constraint, which SQLite can only drop by rebuilding the table, with one
+// unique index per protocol.
+func migrateProto(tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_alloc_port_tcp'`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	// Keep the ID sequence, so IDs of released allocations, which the
+	// history still refers to, are not handed out again.
+	var seq sql.NullInt64
+	if err := tx.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = 'allocations'`).Scan(&seq); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	const columns = `id, app, instance, service, port, created_at, expires_at, ttl_seconds, git_repo, git_worktree, git_branch, git_commit`
+	for _, stmt := range []string{
+		`CREATE TABLE allocations_new (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			app          TEXT    NOT NULL,
+			instance     TEXT    NOT NULL,
+			service      TEXT    NOT NULL,
+			port         INTEGER NOT NULL,
+			proto        TEXT    NOT NULL DEFAULT 'tcp',
+			created_at   TEXT    NOT NULL DEFAULT (datetime('now')),
+			expires_at   TEXT,
+			ttl_seconds  INTEGER NOT NULL DEFAULT 0,
+			git_repo     TEXT    NOT NULL DEFAULT '',
+			git_worktree TEXT    NOT NULL DEFAULT '',
+			git_branch   TEXT    NOT NULL DEFAULT '',
+			git_commit   TEXT    NOT NULL DEFAULT '',
+			UNIQUE(app, instance, service)
+		)`,
+		`INSERT INTO allocations_new (` + columns + `) SELECT ` + columns + ` FROM allocations`,
+		`DROP TABLE allocations`,
+		`ALTER TABLE allocations_new RENAME TO allocations`,
+		`CREATE INDEX idx_alloc_git_repo ON allocations(git_repo)`,
+		`CREATE UNIQUE INDEX idx_alloc_port_tcp ON allocations(port) WHERE proto IN ('tcp', 'both')`,
+		`CREATE UNIQUE INDEX idx_alloc_port_udp ON allocations(port) WHERE proto IN ('udp', 'both')`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if !seq.Valid {
+		return nil
+	}
+	if _, err := tx.Exec(`DELETE FROM sqlite_sequence WHERE name = 'allocations'`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('allocations', ?)`, seq.Int64)
+	return err
+}
+
+func tableExists(q querier, table string) (bool, error) {
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&n)
+	return n > 0, err
+}
+
+func addColumnIfMissing(q querier, table, column, decl string) error {
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err = q.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
+func ensureVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT    NOT NULL,
+			applied_at TEXT    NOT NULL
+		)
+	`)
+	return err
+}
+
+// SchemaVersion returns the highest applied migration, or 0 for a database
+// that has never been migrated.
+func (s *SQLiteStore) SchemaVersion() (int, error) {
+	if err := ensureVersionTable(s.db); err != nil {
+		return 0, err
+	}
+	var v int
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&v)
+	return v, err
+}
+
+// MigrationStatus lists every migration known to this binary along with
+// when it was applied.
+func (s *SQLiteStore) MigrationStatus() ([]MigrationStatus, error) {
+	if err := ensureVersionTable(s.db); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var at string
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.DateTime, at)
+		if err != nil {
+			return nil, err
+		}
+		applied[v] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = MigrationStatus{Version: m.version, Name: m.name}
+		if t, ok := applied[m.version]; ok {
+			status[i].AppliedAt = &t
+		}
+	}
+	return status, nil
+}
+
+// MigrateTo applies pending migrations up to and including version, each in
+// its own transaction. Downgrades are not supported.
+func (s *SQLiteStore) MigrateTo(version int) error {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	latest := LatestVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade port-registry", current, latest)
+	}
+	if version < 0 || version > latest {
+		return fmt.Errorf("unknown schema version %d (latest is %d)", version, latest)
+	}
+	if version < current {
+		return fmt.Errorf("database is at schema version %d; downgrading to %d is not supported", current, version)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > version {
+			continue
+		}
+		if err := s.apply(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) apply(m migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// fixtureDB writes testdata/<name> into a fresh database file and returns its path.
+func fixtureDB(t *testing.T, name string) string {
+	t.Helper()
+	schema, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "registry.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("load %s: %v", name, err)
+	}
+	return path
+}
+
+func openFixture(t *testing.T, name string) *SQLiteStore {
+	t.Helper()
+	s, err := NewSQLite(fixtureDB(t, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PortChecker = nil
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMigrateFresh(t *testing.T) {
+	s := newTestStore(t)
+
+	v, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != LatestVersion() {
+		t.Errorf("expected version %d, got %d", LatestVersion(), v)
+	}
+
+	status, err := s.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("expected %d migrations, got %d", len(migrations), len(status))
+	}
+	for _, m := range status {
+		if m.AppliedAt == nil {
+			t.Errorf("migration %d not applied", m.Version)
+		}
+	}
+}
+
+func TestMigrateFromUnversionedNoUnique(t *testing.T) {
+	s := openFixture(t, "unversioned-no-unique.sql")
+
+	allocs, err := s.List(Filter{App: "myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 2 {
+		t.Fatalf("expected 2 preserved allocations, got %d", len(allocs))
+	}
+
+	// The unique index now guards (app, instance, service).
+	_, err = s.Allocate(model.AllocateRequest{App: "myapp", Instance: "main", Service: "web", Port: 3005}, 1, 65535)
+	if err != ErrServiceAllocated {
+		t.Errorf("expected ErrServiceAllocated, got %v", err)
+	}
+
+	// Lease columns were added.
+	_, err = s.Allocate(model.AllocateRequest{App: "myapp", Instance: "main", Service: "cache", Port: 3006, TTL: "1h"}, 1, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The exclusions table was created and seeded.
+	excl, err := s.ListExclusions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(excl) == 0 {
+		t.Error("expected default exclusions to be seeded")
+	}
+}
+
+func TestMigrateFromUnversionedLatestSchema(t *testing.T) {
+	s := openFixture(t, "unversioned-labels.sql")
+
+	v, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != LatestVersion() {
+		t.Errorf("expected version %d, got %d", LatestVersion(), v)
+	}
+
+	allocs, err := s.List(Filter{Labels: map[string]string{"owner": "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 1 || allocs[0].ExpiresAt == nil {
+		t.Fatalf("expected preserved labelled lease, got %+v", allocs)
+	}
+
+	// An existing exclusions table is left alone rather than reseeded.
+	excl, err := s.ListExclusions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(excl) != 1 || excl[0].Min != 6379 {
+		t.Errorf("expected the single existing exclusion, got %+v", excl)
+	}
+
+	r, err := s.ListRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0].Min != 40000 {
+		t.Errorf("expected preserved range, got %+v", r)
+	}
+}
+
+func TestMigrateDuplicatesFails(t *testing.T) {
+	_, err := NewSQLite(fixtureDB(t, "unversioned-duplicates.sql"))
+	if err == nil {
+		t.Fatal("expected migration error")
+	}
+	if !strings.Contains(err.Error(), "migration 1") {
+		t.Errorf("expected error to name the migration, got %v", err)
+	}
+}
+
+func TestMigrateTo(t *testing.T) {
+	path := fixtureDB(t, "unversioned-no-unique.sql")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.MigrateTo(2); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+	if ok, _ := tableExists(s.db, "ranges"); ok {
+		t.Error("ranges table should not exist at version 2")
+	}
+
+	if err := s.MigrateTo(1); err == nil || !strings.Contains(err.Error(), "downgrading") {
+		t.Errorf("expected downgrade error, got %v", err)
+	}
+	if err := s.MigrateTo(LatestVersion() + 1); err == nil {
+		t.Error("expected error for unknown version")
+	}
+
+	if err := s.MigrateTo(LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := tableExists(s.db, "ranges"); !ok {
+		t.Error("ranges table missing after full migration")
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	path := fixtureDB(t, "unversioned-no-unique.sql")
+	s, err := NewSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, 'from the future', '2099-01-01 00:00:00')`, LatestVersion()+1)
+	s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewSQLite(path)
+	if err == nil || !strings.Contains(err.Error(), "newer than this binary") {
+		t.Errorf("expected newer-schema error, got %v", err)
+	}
+}
+
+func TestMigrateProto(t *testing.T) {
+	path := fixtureDB(t, "unversioned-no-unique.sql")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.PortChecker = nil
+	if err := s.MigrateTo(8); err != nil {
+		t.Fatal(err)
+	}
+	// A released allocation's ID must not be reused after the table is rebuilt.
+	if _, err := s.db.Exec(`DELETE FROM allocations WHERE service = 'db'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MigrateTo(LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	web, err := s.GetByPort(3000, model.ProtoTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web.ID != 1 || web.Proto != model.ProtoTCP {
+		t.Fatalf("expected web preserved as tcp, got %+v", web)
+	}
+	dns, err := s.Allocate(model.AllocateRequest{App: "myapp", Instance: "main", Service: "dns", Port: 3000, Proto: model.ProtoUDP}, 1, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dns.ID != 3 {
+		t.Errorf("expected ID 3 after the released ID 2, got %d", dns.ID)
+	}
+	_, err = s.Allocate(model.AllocateRequest{App: "myapp", Instance: "main", Service: "other", Port: 3000}, 1, 65535)
+	if err != ErrPortTaken {
+		t.Errorf("expected ErrPortTaken for tcp on 3000, got %v", err)
+	}
+}
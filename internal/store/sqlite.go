@@ -2,68 +2,141 @@ package store
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/n3r/port-registry/internal/model"
+	"github.com/n3r/port-registry/pkg/model"
 	_ "modernc.org/sqlite"
 )
 
 type SQLiteStore struct {
 	db          *sql.DB
-	PortChecker func(port int) bool // returns true if port is free on the system; nil = skip check
+	PortChecker func(port int, proto string) bool // returns true if port is free for proto on the system; nil = skip check
+	origin      model.Origin                      // attributed to events recorded by this store; see WithOrigin
+	changes     *notifier                         // shared with copies made by WithOrigin
 }
 
-// CheckPortAvailable probes whether a TCP port is free on localhost.
-func CheckPortAvailable(port int) bool {
-	ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
-	if err != nil {
-		return false
+// probeHosts are the addresses CheckPortAvailable binds: services listen on
+// loopback or, like Docker's published ports, on the wildcards, and some
+// systems let a loopback bind succeed while the wildcard is taken.
+var probeHosts = []string{"127.0.0.1", "0.0.0.0", "::1", "::"}
+
+// CheckPortAvailable probes whether port is free for proto (tcp, udp or both)
+// on the IPv4 and IPv6 loopback and wildcard addresses. IPv6 addresses the
+// host cannot bind, e.g. with IPv6 disabled, only count if they are in use.
+func CheckPortAvailable(port int, proto string) bool {
+	var networks []string
+	switch proto {
+	case model.ProtoUDP:
+		networks = []string{"udp"}
+	case model.ProtoBoth:
+		networks = []string{"tcp", "udp"}
+	default:
+		networks = []string{"tcp"}
+	}
+	for _, network := range networks {
+		for _, host := range probeHosts {
+			ipv6 := strings.Contains(host, ":")
+			if err := probe(network, host, port, ipv6); err != nil && (!ipv6 || errors.Is(err, syscall.EADDRINUSE)) {
+				return false
+			}
+		}
 	}
-	ln.Close()
 	return true
 }
 
+// probe binds and releases port on host.
+func probe(network, host string, port int, ipv6 bool) error {
+	if ipv6 {
+		network += "6"
+	} else {
+		network += "4"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if strings.HasPrefix(network, "udp") {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// NewSQLite opens the database and applies any pending schema migrations.
 func NewSQLite(dsn string) (*SQLiteStore, error) {
-	db, err := sql.Open("sqlite", dsn)
+	s, err := OpenSQLite(dsn)
 	if err != nil {
 		return nil, err
 	}
+	if err := s.MigrateTo(LatestVersion()); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
 
-	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
-		db.Close()
+// OpenSQLite opens the database without touching its schema. Use it to
+// inspect or control migrations; everything else should use NewSQLite.
+func OpenSQLite(dsn string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := migrate(db); err != nil {
+	// SQLite allows a single writer; funnel everything through one connection so
+	// transactions never contend with the pool (and ":memory:" stays one database).
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
 		db.Close()
 		return nil, err
 	}
 
-	return &SQLiteStore{db: db, PortChecker: CheckPortAvailable}, nil
+	return &SQLiteStore{db: db, PortChecker: CheckPortAvailable, changes: newNotifier()}, nil
 }
 
-func migrate(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS allocations (
-			id          INTEGER PRIMARY KEY AUTOINCREMENT,
-			app         TEXT    NOT NULL,
-			instance    TEXT    NOT NULL,
-			service     TEXT    NOT NULL,
-			port        INTEGER NOT NULL UNIQUE,
-			created_at  TEXT    NOT NULL DEFAULT (datetime('now')),
-			UNIQUE(app, instance, service)
-		)
-	`)
-	if err != nil {
-		return err
+const allocColumns = `id, app, instance, service, port, proto, created_at, expires_at, git_repo, git_worktree, git_branch, git_commit`
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAllocation(row rowScanner) (*model.Allocation, error) {
+	var a model.Allocation
+	var createdAt string
+	var expiresAt sql.NullString
+	var git model.GitInfo
+	if err := row.Scan(&a.ID, &a.App, &a.Instance, &a.Service, &a.Port, &a.Proto, &createdAt, &expiresAt,
+		&git.Repo, &git.Worktree, &git.Branch, &git.Commit); err != nil {
+		return nil, err
 	}
-	// Migration for existing databases: add the uniqueness constraint on (app, instance, service).
-	// Fails silently if the index already exists or if the table was just created with UNIQUE above.
-	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_alloc_app_instance_service ON allocations(app, instance, service)`)
-	return nil
+	if git.Repo != "" {
+		a.Git = &git
+	}
+	a.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+	if expiresAt.Valid {
+		t, _ := time.Parse(time.DateTime, expiresAt.String)
+		a.ExpiresAt = &t
+	}
+	return &a, nil
 }
 
 func (s *SQLiteStore) Ping() error {
@@ -71,30 +144,153 @@ func (s *SQLiteStore) Ping() error {
 }
 
 func (s *SQLiteStore) Allocate(req model.AllocateRequest, portMin, portMax int) (*model.Allocation, error) {
+	alloc, _, err := s.allocateOne(req, portMin, portMax)
+	return alloc, err
+}
+
+func (s *SQLiteStore) Ensure(req model.AllocateRequest, portMin, portMax int) (*model.Allocation, bool, error) {
+	req.Ensure = true
+	return s.allocateOne(req, portMin, portMax)
+}
+
+func (s *SQLiteStore) allocateOne(req model.AllocateRequest, portMin, portMax int) (*model.Allocation, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	if existing := ensured(tx, req); existing != nil {
+		return existing, true, nil
+	}
+	alloc, err := s.allocate(tx, req, portMin, portMax)
+	if err != nil {
+		tx.Rollback()
+		s.recordConflict(req, alloc, err)
+		return alloc, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	s.changes.broadcast()
+	return alloc, false, nil
+}
+
+func (s *SQLiteStore) AllocateBatch(reqs []model.AllocateRequest, portMin, portMax int) ([]model.Allocation, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	allocs := make([]model.Allocation, 0, len(reqs))
+	for i, req := range reqs {
+		if existing := ensured(tx, req); existing != nil {
+			allocs = append(allocs, *existing)
+			continue
+		}
+		alloc, err := s.allocate(tx, req, portMin, portMax)
+		if err != nil {
+			tx.Rollback()
+			s.recordConflict(req, alloc, err)
+			return nil, &BatchError{Index: i, Holder: alloc, Err: err}
+		}
+		allocs = append(allocs, *alloc)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.changes.broadcast()
+	return allocs, nil
+}
+
+// ensured returns the allocation that satisfies req without a change: the
+// one its service already holds, if req.Ensure is set, the port matches or is
+// only preferred, and the protocol matches if given.
+func ensured(q querier, req model.AllocateRequest) *model.Allocation {
+	if !req.Ensure {
+		return nil
+	}
+	existing := getByService(q, req.App, req.Instance, req.Service)
+	if existing == nil || (req.Port != 0 && !req.Preferred && req.Port != existing.Port) {
+		return nil
+	}
+	if req.Proto != "" && req.Proto != existing.Proto {
+		return nil
+	}
+	return existing
+}
+
+func (s *SQLiteStore) allocate(q querier, req model.AllocateRequest, portMin, portMax int) (*model.Allocation, error) {
 	port := req.Port
+	proto := req.Proto
+	if proto == "" {
+		proto = model.ProtoTCP
+	}
 
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl: %w", err)
+		}
+	}
+
+	excl, err := listExclusions(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if port != 0 && req.Preferred && !s.available(q, port, proto, req.Force, excl) {
+		port = 0
+	}
 	if port == 0 {
+		if req.Range != nil {
+			portMin, portMax = req.Range.Min, req.Range.Max
+		} else if r, err := getRange(q, req.App); err != nil {
+			return nil, err
+		} else if r != nil {
+			portMin, portMax = r.Min, r.Max
+		}
 		var err error
-		port, err = s.findFreePort(portMin, portMax)
+		port, err = s.findFreePort(q, portMin, portMax, proto, excl)
 		if err != nil {
+			// A service that already holds a port is a duplicate, not a victim of a full range.
+			if existing := getByService(q, req.App, req.Instance, req.Service); existing != nil {
+				return existing, ErrServiceAllocated
+			}
 			return nil, err
 		}
-	} else if s.PortChecker != nil && !s.PortChecker(port) {
+	} else if !req.Force && excluded(excl, port) {
+		return nil, ErrPortExcluded
+	} else if s.PortChecker != nil && !s.PortChecker(port, proto) {
 		return nil, ErrPortBusy
 	}
 
 	now := time.Now().UTC()
-	res, err := s.db.Exec(
-		`INSERT INTO allocations (app, instance, service, port, created_at) VALUES (?, ?, ?, ?, ?)`,
-		req.App, req.Instance, req.Service, port, now.Format(time.DateTime),
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := now.Add(ttl).Truncate(time.Second)
+		expiresAt = &t
+	}
+	var git model.GitInfo
+	if req.Git != nil {
+		git = *req.Git
+	}
+	res, err := q.Exec(
+		`INSERT INTO allocations (app, instance, service, port, proto, created_at, expires_at, ttl_seconds, git_repo, git_worktree, git_branch, git_commit)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		req.App, req.Instance, req.Service, port, proto, now.Format(time.DateTime), formatTime(expiresAt), int64(ttl/time.Second),
+		git.Repo, git.Worktree, git.Branch, git.Commit,
 	)
 	if err != nil {
 		// Check if the service triple already exists.
-		if existing := s.getByService(req.App, req.Instance, req.Service); existing != nil {
+		if existing := getByService(q, req.App, req.Instance, req.Service); existing != nil {
 			return existing, ErrServiceAllocated
 		}
 		// Check if port is taken by trying to look it up.
-		existing, lookupErr := s.GetByPort(port)
+		existing, lookupErr := getByPort(q, port, proto)
 		if lookupErr == nil && existing != nil {
 			return existing, ErrPortTaken
 		}
@@ -102,34 +298,85 @@ func (s *SQLiteStore) Allocate(req model.AllocateRequest, portMin, portMax int)
 	}
 
 	id, _ := res.LastInsertId()
-	return &model.Allocation{
+	for k, v := range req.Labels {
+		if _, err := q.Exec(`INSERT INTO allocation_labels (allocation_id, key, value) VALUES (?, ?, ?)`, id, k, v); err != nil {
+			return nil, err
+		}
+	}
+	alloc := &model.Allocation{
 		ID:        id,
 		App:       req.App,
 		Instance:  req.Instance,
 		Service:   req.Service,
 		Port:      port,
+		Proto:     proto,
 		CreatedAt: now,
-	}, nil
+		ExpiresAt: expiresAt,
+		Labels:    req.Labels,
+		Git:       req.Git,
+	}
+	var detail string
+	if ttl > 0 {
+		detail = "lease " + ttl.String()
+	}
+	if err := s.recordEvent(q, model.EventAllocate, alloc, detail); err != nil {
+		return nil, err
+	}
+	return alloc, nil
 }
 
-func (s *SQLiteStore) getByService(app, instance, service string) *model.Allocation {
-	var a model.Allocation
-	var createdAt string
-	err := s.db.QueryRow(
-		`SELECT id, app, instance, service, port, created_at FROM allocations WHERE app = ? AND instance = ? AND service = ?`,
+// available reports whether an explicit port can be allocated for proto: it
+// is free, not in use on the system, and not excluded unless force is set.
+func (s *SQLiteStore) available(q querier, port int, proto string, force bool, excl []model.Exclusion) bool {
+	if !force && excluded(excl, port) {
+		return false
+	}
+	if a, _ := getByPort(q, port, proto); a != nil {
+		return false
+	}
+	return s.PortChecker == nil || s.PortChecker(port, proto)
+}
+
+// protoClause returns the SQL condition (prefixed with " AND ") and
+// arguments selecting the allocations whose protocol conflicts with proto.
+func protoClause(proto string) (string, []any) {
+	switch proto {
+	case model.ProtoBoth:
+		return "", nil
+	case model.ProtoUDP:
+		return ` AND proto != ?`, []any{model.ProtoTCP}
+	default:
+		return ` AND proto != ?`, []any{model.ProtoUDP}
+	}
+}
+
+// formatTime returns t in the stored timestamp format, or nil for a NULL column.
+func formatTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.DateTime)
+}
+
+func getByService(q querier, app, instance, service string) *model.Allocation {
+	a, err := scanAllocation(q.QueryRow(
+		`SELECT `+allocColumns+` FROM allocations WHERE app = ? AND instance = ? AND service = ?`,
 		app, instance, service,
-	).Scan(&a.ID, &a.App, &a.Instance, &a.Service, &a.Port, &createdAt)
+	))
 	if err != nil {
 		return nil
 	}
-	a.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
-	return &a
+	if err := loadLabels(q, []*model.Allocation{a}); err != nil {
+		return nil
+	}
+	return a
 }
 
-func (s *SQLiteStore) findFreePort(portMin, portMax int) (int, error) {
-	rows, err := s.db.Query(
-		`SELECT port FROM allocations WHERE port >= ? AND port <= ? ORDER BY port`,
-		portMin, portMax,
+func (s *SQLiteStore) findFreePort(q querier, portMin, portMax int, proto string, excl []model.Exclusion) (int, error) {
+	where, args := protoClause(proto)
+	rows, err := q.Query(
+		`SELECT port FROM allocations WHERE port >= ? AND port <= ?`+where+` ORDER BY port`,
+		append([]any{portMin, portMax}, args...)...,
 	)
 	if err != nil {
 		return 0, err
@@ -146,76 +393,160 @@ func (s *SQLiteStore) findFreePort(portMin, portMax int) (int, error) {
 	}
 
 	for p := portMin; p <= portMax; p++ {
-		if !used[p] && (s.PortChecker == nil || s.PortChecker(p)) {
+		if !used[p] && !excluded(excl, p) && (s.PortChecker == nil || s.PortChecker(p, proto)) {
 			return p, nil
 		}
 	}
-	return 0, fmt.Errorf("no free ports in range %d-%d", portMin, portMax)
+	return 0, &RangeExhaustedError{Min: portMin, Max: portMax}
 }
 
 func (s *SQLiteStore) List(f Filter) ([]model.Allocation, error) {
-	query := `SELECT id, app, instance, service, port, created_at FROM allocations WHERE 1=1`
+	where, args := filterClause(f)
+	rows, err := s.db.Query(`SELECT `+allocColumns+` FROM allocations WHERE 1=1`+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var allocs []model.Allocation
+	for rows.Next() {
+		a, err := scanAllocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		allocs = append(allocs, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ptrs := make([]*model.Allocation, len(allocs))
+	for i := range allocs {
+		ptrs[i] = &allocs[i]
+	}
+	if err := loadLabels(s.db, ptrs); err != nil {
+		return nil, err
+	}
+	return allocs, nil
+}
+
+// filterClause returns the SQL conditions (each prefixed with " AND ") and
+// arguments selecting the allocations that match f.
+func filterClause(f Filter) (string, []any) {
+	var where strings.Builder
 	args := []any{}
 
 	if f.App != "" {
-		query += ` AND app = ?`
+		where.WriteString(` AND app = ?`)
 		args = append(args, f.App)
 	}
 	if f.Instance != "" {
-		query += ` AND instance = ?`
+		where.WriteString(` AND instance = ?`)
 		args = append(args, f.Instance)
 	}
 	if f.Service != "" {
-		query += ` AND service = ?`
+		where.WriteString(` AND service = ?`)
 		args = append(args, f.Service)
 	}
 	if f.Port != 0 {
-		query += ` AND port = ?`
+		where.WriteString(` AND port = ?`)
 		args = append(args, f.Port)
 	}
-	query += ` ORDER BY id`
+	if f.Repo != "" {
+		where.WriteString(` AND git_repo = ?`)
+		args = append(args, f.Repo)
+	}
+	keys := make([]string, 0, len(f.Labels))
+	for k := range f.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		where.WriteString(` AND id IN (SELECT allocation_id FROM allocation_labels WHERE key = ? AND value = ?)`)
+		args = append(args, k, f.Labels[k])
+	}
+	return where.String(), args
+}
+
+// loadLabels fills in the labels of allocs.
+func loadLabels(q querier, allocs []*model.Allocation) error {
+	if len(allocs) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*model.Allocation, len(allocs))
+	placeholders := make([]string, len(allocs))
+	args := make([]any, len(allocs))
+	for i, a := range allocs {
+		byID[a.ID] = a
+		placeholders[i] = "?"
+		args[i] = a.ID
+	}
 
-	rows, err := s.db.Query(query, args...)
+	rows, err := q.Query(
+		`SELECT allocation_id, key, value FROM allocation_labels WHERE allocation_id IN (`+strings.Join(placeholders, ", ")+`)`,
+		args...,
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var allocs []model.Allocation
 	for rows.Next() {
-		var a model.Allocation
-		var createdAt string
-		if err := rows.Scan(&a.ID, &a.App, &a.Instance, &a.Service, &a.Port, &createdAt); err != nil {
-			return nil, err
+		var id int64
+		var k, v string
+		if err := rows.Scan(&id, &k, &v); err != nil {
+			return err
 		}
-		a.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
-		allocs = append(allocs, a)
+		a := byID[id]
+		if a.Labels == nil {
+			a.Labels = make(map[string]string)
+		}
+		a.Labels[k] = v
 	}
-	return allocs, nil
+	return rows.Err()
 }
 
-func (s *SQLiteStore) GetByPort(port int) (*model.Allocation, error) {
-	var a model.Allocation
-	var createdAt string
-	err := s.db.QueryRow(
-		`SELECT id, app, instance, service, port, created_at FROM allocations WHERE port = ?`, port,
-	).Scan(&a.ID, &a.App, &a.Instance, &a.Service, &a.Port, &createdAt)
+func (s *SQLiteStore) GetByPort(port int, proto string) (*model.Allocation, error) {
+	return getByPort(s.db, port, proto)
+}
+
+func getByPort(q querier, port int, proto string) (*model.Allocation, error) {
+	where, args := protoClause(proto)
+	a, err := scanAllocation(q.QueryRow(
+		`SELECT `+allocColumns+` FROM allocations WHERE port = ?`+where+` ORDER BY id`, append([]any{port}, args...)...,
+	))
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
 	}
 	if err != nil {
 		return nil, err
 	}
-	a.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
-	return &a, nil
+	return a, loadLabels(q, []*model.Allocation{a})
+}
+
+func (s *SQLiteStore) GetByID(id int64) (*model.Allocation, error) {
+	return getByID(s.db, id)
+}
+
+func getByID(q querier, id int64) (*model.Allocation, error) {
+	a, err := scanAllocation(q.QueryRow(
+		`SELECT `+allocColumns+` FROM allocations WHERE id = ?`, id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, loadLabels(q, []*model.Allocation{a})
 }
 
 func (s *SQLiteStore) DeleteByID(id int64) error {
-	res, err := s.db.Exec(`DELETE FROM allocations WHERE id = ?`, id)
+	n, err := s.deleteWhere(` AND id = ?`, []any{id}, "")
 	if err != nil {
 		return err
 	}
-	n, _ := res.RowsAffected()
 	if n == 0 {
 		return ErrNotFound
 	}
@@ -223,36 +554,213 @@ func (s *SQLiteStore) DeleteByID(id int64) error {
 }
 
 func (s *SQLiteStore) DeleteByFilter(f Filter) (int64, error) {
-	query := `DELETE FROM allocations WHERE 1=1`
-	args := []any{}
+	where, args := filterClause(f)
 
-	if f.App != "" {
-		query += ` AND app = ?`
-		args = append(args, f.App)
+	// Safety: require at least one filter
+	if len(args) == 0 {
+		return 0, ErrFilterRequired
 	}
-	if f.Instance != "" {
-		query += ` AND instance = ?`
-		args = append(args, f.Instance)
+
+	return s.deleteWhere(where, args, "")
+}
+
+// deleteWhere deletes the allocations matching the conditions in where, along
+// with their labels, records a release event with detail for each, and returns
+// how many allocations were deleted.
+func (s *SQLiteStore) deleteWhere(where string, args []any, detail string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
 	}
-	if f.Service != "" {
-		query += ` AND service = ?`
-		args = append(args, f.Service)
+	defer tx.Rollback()
+
+	// Resolve the rows first: the conditions may select on labels, which are deleted before the rows.
+	rows, err := tx.Query(`SELECT `+allocColumns+` FROM allocations WHERE 1=1`+where, args...)
+	if err != nil {
+		return 0, err
 	}
-	if f.Port != 0 {
-		query += ` AND port = ?`
-		args = append(args, f.Port)
+	var allocs []*model.Allocation
+	for rows.Next() {
+		a, err := scanAllocation(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		allocs = append(allocs, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
 	}
 
-	// Safety: require at least one filter
-	if len(args) == 0 {
-		return 0, ErrFilterRequired
+	for _, a := range allocs {
+		if _, err := tx.Exec(`DELETE FROM allocation_labels WHERE allocation_id = ?`, a.ID); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM allocations WHERE id = ?`, a.ID); err != nil {
+			return 0, err
+		}
+		if err := s.recordEvent(tx, model.EventRelease, a, detail); err != nil {
+			return 0, err
+		}
 	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(allocs) > 0 {
+		s.changes.broadcast()
+	}
+	return int64(len(allocs)), nil
+}
 
-	res, err := s.db.Exec(query, args...)
+func (s *SQLiteStore) Renew(id int64, ttl time.Duration) (*model.Allocation, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if ttl == 0 {
+		var seconds int64
+		err := tx.QueryRow(`SELECT ttl_seconds FROM allocations WHERE id = ?`, id).Scan(&seconds)
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if seconds == 0 {
+			return nil, ErrNoLease
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	expiresAt := time.Now().UTC().Add(ttl).Truncate(time.Second)
+	res, err := tx.Exec(
+		`UPDATE allocations SET expires_at = ?, ttl_seconds = ? WHERE id = ?`,
+		formatTime(&expiresAt), int64(ttl/time.Second), id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+	alloc, err := getByID(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recordEvent(tx, model.EventRenew, alloc, "lease "+ttl.String()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.changes.broadcast()
+	return alloc, nil
+}
+
+func (s *SQLiteStore) DeleteExpired(now time.Time) (int64, error) {
+	return s.deleteWhere(` AND expires_at IS NOT NULL AND expires_at <= ?`, []any{now.UTC().Format(time.DateTime)}, "lease expired")
+}
+
+func (s *SQLiteStore) ListRanges() ([]model.PortRange, error) {
+	rows, err := s.db.Query(`SELECT app, port_min, port_max FROM ranges ORDER BY app`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ranges []model.PortRange
+	for rows.Next() {
+		var r model.PortRange
+		if err := rows.Scan(&r.App, &r.Min, &r.Max); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, rows.Err()
+}
+
+func (s *SQLiteStore) SetRange(r model.PortRange) error {
+	_, err := s.db.Exec(
+		`INSERT INTO ranges (app, port_min, port_max) VALUES (?, ?, ?)
+		 ON CONFLICT(app) DO UPDATE SET port_min = excluded.port_min, port_max = excluded.port_max`,
+		r.App, r.Min, r.Max,
+	)
+	return err
+}
+
+func (s *SQLiteStore) DeleteRange(app string) error {
+	res, err := s.db.Exec(`DELETE FROM ranges WHERE app = ?`, app)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ListExclusions() ([]model.Exclusion, error) {
+	return listExclusions(s.db)
+}
+
+func listExclusions(q querier) ([]model.Exclusion, error) {
+	rows, err := q.Query(`SELECT id, port_min, port_max, reason FROM exclusions ORDER BY port_min, port_max`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var excl []model.Exclusion
+	for rows.Next() {
+		var e model.Exclusion
+		if err := rows.Scan(&e.ID, &e.Min, &e.Max, &e.Reason); err != nil {
+			return nil, err
+		}
+		excl = append(excl, e)
+	}
+	return excl, rows.Err()
+}
+
+func (s *SQLiteStore) AddExclusion(e model.Exclusion) (*model.Exclusion, error) {
+	res, err := s.db.Exec(
+		`INSERT INTO exclusions (port_min, port_max, reason) VALUES (?, ?, ?)`,
+		e.Min, e.Max, e.Reason,
+	)
+	if err != nil {
+		return nil, err
+	}
+	e.ID, _ = res.LastInsertId()
+	return &e, nil
+}
+
+func (s *SQLiteStore) DeleteExclusion(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM exclusions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// getRange returns the app's auto-assignment range, or nil if it has none.
+func getRange(q querier, app string) (*model.PortRange, error) {
+	r := model.PortRange{App: app}
+	err := q.QueryRow(`SELECT port_min, port_max FROM ranges WHERE app = ?`, app).Scan(&r.Min, &r.Max)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
-	return res.RowsAffected()
+	return &r, nil
 }
 
 func (s *SQLiteStore) Close() error {
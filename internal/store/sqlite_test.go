@@ -1,9 +1,13 @@
 package store
 
 import (
+	"errors"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 
-	"github.com/n3r/port-registry/internal/model"
+	"github.com/n3r/port-registry/pkg/model"
 )
 
 func newTestStore(t *testing.T) *SQLiteStore {
@@ -14,6 +18,10 @@ func newTestStore(t *testing.T) *SQLiteStore {
 	}
 	s.PortChecker = nil // skip real system checks in tests
 	t.Cleanup(func() { s.Close() })
+	// Start without the seeded exclusions, which depend on the host.
+	if _, err := s.db.Exec(`DELETE FROM exclusions`); err != nil {
+		t.Fatal(err)
+	}
 	return s
 }
 
@@ -97,6 +105,53 @@ func TestAllocateDuplicateService(t *testing.T) {
 	}
 }
 
+func TestAllocateProto(t *testing.T) {
+	s := newTestStore(t)
+
+	tcp, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "web", Port: 5000}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp.Proto != model.ProtoTCP {
+		t.Fatalf("expected tcp by default, got %q", tcp.Proto)
+	}
+	udp, err := s.Allocate(model.AllocateRequest{App: "b", Instance: "i", Service: "dns", Port: 5000, Proto: model.ProtoUDP}, 3000, 9999)
+	if err != nil {
+		t.Fatalf("expected udp on a tcp port to succeed, got %v", err)
+	}
+	if _, err := s.Allocate(model.AllocateRequest{App: "c", Instance: "i", Service: "s", Port: 5000, Proto: model.ProtoBoth}, 3000, 9999); err != ErrPortTaken {
+		t.Fatalf("expected ErrPortTaken for both, got %v", err)
+	}
+	if a, err := s.GetByPort(5000, model.ProtoUDP); err != nil || a.ID != udp.ID {
+		t.Fatalf("expected the udp allocation, got %+v, %v", a, err)
+	}
+	if a, err := s.GetByPort(5000, model.ProtoBoth); err != nil || a.ID != tcp.ID {
+		t.Fatalf("expected the first allocation for both, got %+v, %v", a, err)
+	}
+
+	// Ensure only matches an allocation of the same protocol.
+	if a, err := s.Allocate(model.AllocateRequest{App: "b", Instance: "i", Service: "dns", Ensure: true}, 3000, 9999); err != nil || a.ID != udp.ID {
+		t.Fatalf("expected ensure to return the udp allocation, got %+v, %v", a, err)
+	}
+	if _, err := s.Allocate(model.AllocateRequest{App: "b", Instance: "i", Service: "dns", Proto: model.ProtoTCP, Ensure: true}, 3000, 9999); err != ErrServiceAllocated {
+		t.Fatalf("expected ErrServiceAllocated for another protocol, got %v", err)
+	}
+
+	// Auto-assignment probes the requested protocol.
+	var probed []string
+	s.PortChecker = func(port int, proto string) bool {
+		probed = append(probed, proto)
+		return port != 3000
+	}
+	a, err := s.Allocate(model.AllocateRequest{App: "d", Instance: "i", Service: "s", Proto: model.ProtoUDP}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Port != 3001 || a.Proto != model.ProtoUDP || probed[0] != model.ProtoUDP {
+		t.Fatalf("expected udp on 3001 after probing udp, got %+v, probed %v", a, probed)
+	}
+}
+
 func TestList(t *testing.T) {
 	s := newTestStore(t)
 
@@ -121,12 +176,42 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestGitMetadata(t *testing.T) {
+	s := newTestStore(t)
+
+	git := &model.GitInfo{Repo: "/src/api/.git", Worktree: "/src/api-feature", Branch: "feature", Commit: "abc123"}
+	if _, err := s.Allocate(model.AllocateRequest{App: "api", Instance: "feature", Service: "web", Git: git}, 3000, 9999); err != nil {
+		t.Fatal(err)
+	}
+	// Another repository with the same name.
+	other := &model.GitInfo{Repo: "/work/api/.git"}
+	if _, err := s.Allocate(model.AllocateRequest{App: "api", Instance: "feature", Service: "db", Git: other}, 3000, 9999); err != nil {
+		t.Fatal(err)
+	}
+	s.Allocate(model.AllocateRequest{App: "api", Instance: "feature", Service: "cache"}, 3000, 9999)
+
+	allocs, err := s.List(Filter{Repo: "/src/api/.git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 1 || allocs[0].Service != "web" || *allocs[0].Git != *git {
+		t.Fatalf("expected web with %+v, got %+v", git, allocs)
+	}
+	cache, err := s.GetByPort(3002, model.ProtoTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Git != nil {
+		t.Fatalf("expected no git metadata, got %+v", cache.Git)
+	}
+}
+
 func TestGetByPort(t *testing.T) {
 	s := newTestStore(t)
 
 	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: 4000}, 3000, 9999)
 
-	a, err := s.GetByPort(4000)
+	a, err := s.GetByPort(4000, model.ProtoTCP)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,7 +219,7 @@ func TestGetByPort(t *testing.T) {
 		t.Fatalf("expected app=a, got %s", a.App)
 	}
 
-	_, err = s.GetByPort(9999)
+	_, err = s.GetByPort(9999, model.ProtoTCP)
 	if err != ErrNotFound {
 		t.Fatalf("expected ErrNotFound, got %v", err)
 	}
@@ -149,7 +234,7 @@ func TestDeleteByID(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err := s.GetByPort(4000)
+	_, err := s.GetByPort(4000, model.ProtoTCP)
 	if err != ErrNotFound {
 		t.Fatalf("expected ErrNotFound after delete, got %v", err)
 	}
@@ -191,7 +276,7 @@ func TestDeleteByFilterRequiresFilter(t *testing.T) {
 
 func TestAllocatePortBusy(t *testing.T) {
 	s := newTestStore(t)
-	s.PortChecker = func(port int) bool { return port != 5000 }
+	s.PortChecker = func(port int, _ string) bool { return port != 5000 }
 
 	_, err := s.Allocate(model.AllocateRequest{
 		App: "a", Instance: "i", Service: "s", Port: 5000,
@@ -203,7 +288,7 @@ func TestAllocatePortBusy(t *testing.T) {
 
 func TestAllocateAutoAssignSkipsBusy(t *testing.T) {
 	s := newTestStore(t)
-	s.PortChecker = func(port int) bool { return port != 3000 }
+	s.PortChecker = func(port int, _ string) bool { return port != 3000 }
 
 	a, err := s.Allocate(model.AllocateRequest{
 		App: "a", Instance: "i", Service: "s",
@@ -215,3 +300,601 @@ func TestAllocateAutoAssignSkipsBusy(t *testing.T) {
 		t.Fatalf("expected auto-assigned port 3001 (3000 busy), got %d", a.Port)
 	}
 }
+
+func TestAllocateWithTTL(t *testing.T) {
+	s := newTestStore(t)
+
+	a, err := s.Allocate(model.AllocateRequest{
+		App: "a", Instance: "i", Service: "s", TTL: "2h",
+	}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ExpiresAt == nil {
+		t.Fatal("expected expires_at on lease")
+	}
+	if d := time.Until(*a.ExpiresAt); d < 119*time.Minute || d > 2*time.Hour {
+		t.Fatalf("expected expiry ~2h from now, got %v", d)
+	}
+
+	got, err := s.GetByPort(a.Port, model.ProtoTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(*a.ExpiresAt) {
+		t.Fatalf("expected stored expires_at %v, got %v", a.ExpiresAt, got.ExpiresAt)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	s := newTestStore(t)
+
+	a, _ := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "s", TTL: "1m"}, 3000, 9999)
+
+	// Renew without a TTL reuses the original one.
+	renewed, err := s.Renew(a.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.ExpiresAt == nil || time.Until(*renewed.ExpiresAt) > time.Minute {
+		t.Fatalf("expected expiry within 1m, got %v", renewed.ExpiresAt)
+	}
+
+	renewed, err = s.Renew(a.ID, 3*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(*renewed.ExpiresAt) < 2*time.Hour {
+		t.Fatalf("expected expiry ~3h from now, got %v", renewed.ExpiresAt)
+	}
+
+	if _, err := s.Renew(9999, time.Hour); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRenewWithoutLease(t *testing.T) {
+	s := newTestStore(t)
+
+	a, _ := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "s"}, 3000, 9999)
+
+	if _, err := s.Renew(a.ID, 0); err != ErrNoLease {
+		t.Fatalf("expected ErrNoLease, got %v", err)
+	}
+
+	// An explicit TTL turns a permanent allocation into a lease.
+	renewed, err := s.Renew(a.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.ExpiresAt == nil {
+		t.Fatal("expected expires_at after renew with ttl")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s := newTestStore(t)
+
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "lease", Port: 3000, TTL: "1h"}, 3000, 9999)
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "forever", Port: 3001}, 3000, 9999)
+
+	n, err := s.DeleteExpired(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing expired yet, got %d", n)
+	}
+
+	n, err = s.DeleteExpired(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 expired, got %d", n)
+	}
+
+	all, _ := s.List(Filter{})
+	if len(all) != 1 || all[0].Service != "forever" {
+		t.Fatalf("expected only the permanent allocation to remain, got %+v", all)
+	}
+}
+
+func TestEnsure(t *testing.T) {
+	s := newTestStore(t)
+	s.PortChecker = func(int, string) bool { return false } // the service's own port is in use
+
+	_, _, err := s.Ensure(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: 5000}, 3000, 9999)
+	if err != ErrPortBusy {
+		t.Fatalf("expected ErrPortBusy for a new allocation, got %v", err)
+	}
+	s.PortChecker = nil
+	first, existed, err := s.Ensure(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: 5000}, 3000, 9999)
+	if err != nil || existed {
+		t.Fatalf("expected a new allocation, got existed=%v, %v", existed, err)
+	}
+
+	s.PortChecker = func(int, string) bool { return false }
+	for _, port := range []int{0, 5000} {
+		a, existed, err := s.Ensure(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: port}, 3000, 9999)
+		if err != nil || !existed || a.ID != first.ID {
+			t.Fatalf("port %d: expected existing allocation %d, got %+v, existed=%v, %v", port, first.ID, a, existed, err)
+		}
+	}
+	a, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Ensure: true}, 3000, 9999)
+	if err != nil || a.ID != first.ID {
+		t.Fatalf("expected Allocate to honor Ensure, got %+v, %v", a, err)
+	}
+
+	s.PortChecker = nil
+	if _, _, err := s.Ensure(model.AllocateRequest{App: "a", Instance: "i", Service: "s", Port: 5001}, 3000, 9999); err != ErrServiceAllocated {
+		t.Fatalf("expected ErrServiceAllocated for a different port, got %v", err)
+	}
+
+	allocs, err := s.AllocateBatch([]model.AllocateRequest{
+		{App: "a", Instance: "i", Service: "s", Ensure: true},
+		{App: "a", Instance: "i", Service: "t", Ensure: true},
+	}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocs[0].ID != first.ID || allocs[1].Port != 3000 {
+		t.Fatalf("unexpected batch result: %+v", allocs)
+	}
+
+	events, err := s.ListEvents(EventFilter{Types: []string{model.EventAllocate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 allocate events, got %d", len(events))
+	}
+}
+
+func TestAllocateBatch(t *testing.T) {
+	s := newTestStore(t)
+
+	allocs, err := s.AllocateBatch([]model.AllocateRequest{
+		{App: "a", Instance: "i", Service: "web"},
+		{App: "a", Instance: "i", Service: "db"},
+		{App: "a", Instance: "i", Service: "redis", Port: 6000},
+	}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 3 {
+		t.Fatalf("expected 3 allocations, got %d", len(allocs))
+	}
+	if allocs[0].Port != 3000 || allocs[1].Port != 3001 || allocs[2].Port != 6000 {
+		t.Fatalf("unexpected ports: %d, %d, %d", allocs[0].Port, allocs[1].Port, allocs[2].Port)
+	}
+}
+
+func TestAllocateBatchRollsBack(t *testing.T) {
+	s := newTestStore(t)
+
+	s.Allocate(model.AllocateRequest{App: "other", Instance: "i", Service: "db", Port: 5000}, 3000, 9999)
+
+	_, err := s.AllocateBatch([]model.AllocateRequest{
+		{App: "a", Instance: "i", Service: "web"},
+		{App: "a", Instance: "i", Service: "db", Port: 5000},
+		{App: "a", Instance: "i", Service: "redis"},
+	}, 3000, 9999)
+
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("expected *BatchError, got %v", err)
+	}
+	if batchErr.Index != 1 || batchErr.Err != ErrPortTaken {
+		t.Fatalf("expected ErrPortTaken at index 1, got %v at %d", batchErr.Err, batchErr.Index)
+	}
+	if batchErr.Holder == nil || batchErr.Holder.App != "other" {
+		t.Fatal("expected holder info on batch conflict")
+	}
+
+	all, _ := s.List(Filter{App: "a"})
+	if len(all) != 0 {
+		t.Fatalf("expected no allocations after rollback, got %d", len(all))
+	}
+}
+
+func TestAllocateHonorsAppRange(t *testing.T) {
+	s := newTestStore(t)
+
+	if err := s.SetRange(model.PortRange{App: "a", Min: 40000, Max: 40001}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "web"}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Port != 40000 {
+		t.Fatalf("expected port from app range 40000, got %d", a.Port)
+	}
+
+	// Other apps keep using the default range.
+	b, err := s.Allocate(model.AllocateRequest{App: "b", Instance: "i", Service: "web"}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Port != 3000 {
+		t.Fatalf("expected port from default range 3000, got %d", b.Port)
+	}
+
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "db"}, 3000, 9999)
+	_, err = s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "redis"}, 3000, 9999)
+	var exhausted *RangeExhaustedError
+	if !errors.As(err, &exhausted) || !errors.Is(err, ErrRangeExhausted) {
+		t.Fatalf("expected RangeExhaustedError, got %v", err)
+	}
+	if exhausted.Min != 40000 || exhausted.Max != 40001 {
+		t.Fatalf("expected exhausted range 40000-40001, got %d-%d", exhausted.Min, exhausted.Max)
+	}
+	if _, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "web"}, 3000, 9999); err != ErrServiceAllocated {
+		t.Fatalf("expected ErrServiceAllocated for an existing service in a full range, got %v", err)
+	}
+}
+
+func TestAllocatePreferred(t *testing.T) {
+	s := newTestStore(t)
+
+	a, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "db", Port: 5000, Preferred: true}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Port != 5000 {
+		t.Fatalf("expected the preferred port 5000, got %d", a.Port)
+	}
+
+	// Taken: fall back to the request's range.
+	req := model.AllocateRequest{App: "b", Instance: "i", Service: "db", Port: 5000, Preferred: true, Range: &model.PortRange{Min: 6000, Max: 6009}}
+	b, err := s.Allocate(req, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Port != 6000 {
+		t.Fatalf("expected 6000 from the request range, got %d", b.Port)
+	}
+
+	// Ensure keeps the service's port even though another one is preferred.
+	req.Ensure = true
+	c, existed, err := s.Ensure(req, 3000, 9999)
+	if err != nil || !existed || c.ID != b.ID {
+		t.Fatalf("expected the existing allocation %d, got %+v, %v, %v", b.ID, c, existed, err)
+	}
+
+	// Busy on the system: fall back too.
+	s.PortChecker = func(port int, _ string) bool { return port != 7000 }
+	d, err := s.Allocate(model.AllocateRequest{App: "c", Instance: "i", Service: "db", Port: 7000, Preferred: true}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Port == 7000 {
+		t.Fatal("expected a port other than the busy 7000")
+	}
+}
+
+func TestRanges(t *testing.T) {
+	s := newTestStore(t)
+
+	s.SetRange(model.PortRange{App: "b", Min: 5000, Max: 5999})
+	s.SetRange(model.PortRange{App: "a", Min: 4000, Max: 4999})
+	s.SetRange(model.PortRange{App: "a", Min: 4100, Max: 4199})
+
+	ranges, err := s.ListRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 {
+		t.Fatalf("expected 2 ranges, got %d", len(ranges))
+	}
+	if ranges[0].App != "a" || ranges[0].Min != 4100 || ranges[0].Max != 4199 {
+		t.Fatalf("expected updated range for a, got %+v", ranges[0])
+	}
+
+	if err := s.DeleteRange("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRange("a"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDefaultExclusionsSeeded(t *testing.T) {
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	excl, err := s.ListExclusions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(excl) < len(commonServicePorts)+1 {
+		t.Fatalf("expected default exclusions to be seeded, got %d", len(excl))
+	}
+	if excl[0].Min != 1 || excl[0].Max != 1023 {
+		t.Fatalf("expected well-known ports first, got %+v", excl[0])
+	}
+}
+
+func TestAllocateExcludedPort(t *testing.T) {
+	s := newTestStore(t)
+
+	if _, err := s.AddExclusion(model.Exclusion{Min: 5432, Max: 5432, Reason: "PostgreSQL"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "db", Port: 5432}, 3000, 9999)
+	if err != ErrPortExcluded {
+		t.Fatalf("expected ErrPortExcluded, got %v", err)
+	}
+
+	a, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "db", Port: 5432, Force: true}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Port != 5432 {
+		t.Fatalf("expected forced port 5432, got %d", a.Port)
+	}
+}
+
+func TestAllocateAutoAssignSkipsExcluded(t *testing.T) {
+	s := newTestStore(t)
+
+	s.AddExclusion(model.Exclusion{Min: 3000, Max: 3002})
+	s.AddExclusion(model.Exclusion{Min: 3004, Max: 3004})
+
+	for _, want := range []int{3003, 3005} {
+		a, err := s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: strconv.Itoa(want)}, 3000, 9999)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Port != want {
+			t.Fatalf("expected auto-assigned port %d, got %d", want, a.Port)
+		}
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	s := newTestStore(t)
+
+	e, err := s.AddExclusion(model.Exclusion{Min: 6000, Max: 6100, Reason: "X11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID == 0 {
+		t.Fatal("expected exclusion ID")
+	}
+
+	excl, _ := s.ListExclusions()
+	if len(excl) != 1 || excl[0].Reason != "X11" {
+		t.Fatalf("expected 1 exclusion, got %+v", excl)
+	}
+
+	if err := s.DeleteExclusion(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteExclusion(e.ID); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	s := newTestStore(t)
+
+	a, err := s.Allocate(model.AllocateRequest{
+		App: "a", Instance: "i", Service: "web", Port: 3000,
+		Labels: map[string]string{"owner": "alice", "proto": "http"},
+	}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Labels["owner"] != "alice" {
+		t.Fatalf("expected labels on allocation, got %v", a.Labels)
+	}
+	s.Allocate(model.AllocateRequest{
+		App: "a", Instance: "i", Service: "db", Port: 3001,
+		Labels: map[string]string{"owner": "bob"},
+	}, 3000, 9999)
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "cache", Port: 3002}, 3000, 9999)
+
+	got, err := s.GetByPort(3000, model.ProtoTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Labels) != 2 || got.Labels["proto"] != "http" {
+		t.Fatalf("expected stored labels, got %v", got.Labels)
+	}
+
+	filtered, err := s.List(Filter{Labels: map[string]string{"owner": "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || filtered[0].Service != "web" {
+		t.Fatalf("expected only web for owner=alice, got %+v", filtered)
+	}
+
+	filtered, _ = s.List(Filter{Labels: map[string]string{"owner": "alice", "proto": "udp"}})
+	if len(filtered) != 0 {
+		t.Fatalf("expected no match when any selector differs, got %+v", filtered)
+	}
+
+	all, _ := s.List(Filter{App: "a"})
+	if len(all) != 3 || all[2].Labels != nil {
+		t.Fatalf("expected 3 allocations with unlabeled cache last, got %+v", all)
+	}
+}
+
+func TestDeleteByFilterLabels(t *testing.T) {
+	s := newTestStore(t)
+
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "web", Port: 3000, Labels: map[string]string{"owner": "alice"}}, 3000, 9999)
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "db", Port: 3001, Labels: map[string]string{"owner": "bob"}}, 3000, 9999)
+
+	n, err := s.DeleteByFilter(Filter{Labels: map[string]string{"owner": "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 deleted, got %d", n)
+	}
+
+	var orphans int
+	s.db.QueryRow(`SELECT COUNT(*) FROM allocation_labels WHERE allocation_id NOT IN (SELECT id FROM allocations)`).Scan(&orphans)
+	if orphans != 0 {
+		t.Fatalf("expected labels to be deleted with their allocation, got %d orphans", orphans)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := newTestStore(t)
+	alice := s.WithOrigin(model.Origin{Actor: "alice", Source: "portctl/test"})
+
+	a, err := alice.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "web", Port: 3000, TTL: "1h"}, 3000, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Allocate(model.AllocateRequest{App: "b", Instance: "i", Service: "web", Port: 3000}, 3000, 9999); err != ErrPortTaken {
+		t.Fatalf("expected ErrPortTaken, got %v", err)
+	}
+	if _, err := alice.Renew(a.ID, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WithOrigin(model.Origin{Actor: "bob"}).DeleteByID(a.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// History survives the release of the allocation.
+	events, err := s.ListEvents(EventFilter{Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{model.EventAllocate, model.EventConflict, model.EventRenew, model.EventRelease}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, e := range events {
+		if e.Type != want[i] {
+			t.Errorf("event %d: expected %s, got %s", i, want[i], e.Type)
+		}
+	}
+	if events[0].Actor != "alice" || events[0].Source != "portctl/test" || events[0].AllocationID != a.ID {
+		t.Errorf("unexpected allocate event: %+v", events[0])
+	}
+	if events[1].App != "b" || events[1].Detail == "" {
+		t.Errorf("expected conflict for app b with detail, got %+v", events[1])
+	}
+	if events[3].Actor != "bob" {
+		t.Errorf("expected release by bob, got %+v", events[3])
+	}
+
+	byApp, _ := s.ListEvents(EventFilter{App: "b"})
+	if len(byApp) != 1 {
+		t.Errorf("expected 1 event for app b, got %d", len(byApp))
+	}
+	recent, _ := s.ListEvents(EventFilter{Limit: 2})
+	if len(recent) != 2 || recent[1].Type != model.EventRelease {
+		t.Errorf("expected the 2 most recent events oldest first, got %+v", recent)
+	}
+	future, _ := s.ListEvents(EventFilter{Since: time.Now().Add(time.Hour)})
+	if len(future) != 0 {
+		t.Errorf("expected no events in the future, got %d", len(future))
+	}
+}
+
+func TestEventsBatchRollback(t *testing.T) {
+	s := newTestStore(t)
+
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "db", Port: 3001}, 3000, 9999)
+	_, err := s.AllocateBatch([]model.AllocateRequest{
+		{App: "b", Instance: "i", Service: "web", Port: 3000},
+		{App: "b", Instance: "i", Service: "db", Port: 3001},
+	}, 3000, 9999)
+	if err == nil {
+		t.Fatal("expected batch conflict")
+	}
+
+	events, _ := s.ListEvents(EventFilter{App: "b"})
+	if len(events) != 1 || events[0].Type != model.EventConflict || events[0].Service != "db" {
+		t.Fatalf("expected only the conflict for b/db, got %+v", events)
+	}
+}
+
+func TestEventsReaper(t *testing.T) {
+	s := newTestStore(t)
+
+	s.Allocate(model.AllocateRequest{App: "a", Instance: "i", Service: "web", Port: 3000, TTL: "1m"}, 3000, 9999)
+	if _, err := s.WithOrigin(model.Origin{Source: "reaper"}).DeleteExpired(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	events, _ := s.ListEvents(EventFilter{App: "a"})
+	last := events[len(events)-1]
+	if last.Type != model.EventRelease || last.Source != "reaper" || last.Detail != "lease expired" {
+		t.Fatalf("expected reaper release, got %+v", last)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	s := newTestStore(t)
+
+	tok, secret, err := s.CreateToken(model.Token{Name: "ci", Scope: model.ScopeRead, AppPrefix: "web-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.ID == 0 || secret == "" {
+		t.Fatalf("expected ID and secret, got %+v %q", tok, secret)
+	}
+
+	var stored string
+	s.db.QueryRow(`SELECT hash FROM tokens WHERE id = ?`, tok.ID).Scan(&stored)
+	if stored == secret || stored != hashToken(secret) {
+		t.Fatalf("expected only the hash to be stored, got %q", stored)
+	}
+
+	got, err := s.LookupToken(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "ci" || got.Scope != model.ScopeRead || got.AppPrefix != "web-" {
+		t.Fatalf("unexpected token: %+v", got)
+	}
+	if _, err := s.LookupToken(secret + "x"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for wrong secret, got %v", err)
+	}
+
+	if err := s.DeleteToken(tok.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LookupToken(secret); err != ErrNotFound {
+		t.Fatalf("expected revoked token to be rejected, got %v", err)
+	}
+	if err := s.DeleteToken(tok.ID); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCheckPortAvailable(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Skip("cannot bind udp:", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if CheckPortAvailable(port, model.ProtoUDP) || CheckPortAvailable(port, model.ProtoBoth) {
+		t.Errorf("expected udp port %d on the wildcard address to be unavailable", port)
+	}
+
+	ln, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Skip("cannot bind tcp:", err)
+	}
+	defer ln.Close()
+	port = ln.Addr().(*net.TCPAddr).Port
+	if CheckPortAvailable(port, model.ProtoTCP) {
+		t.Errorf("expected tcp port %d on the wildcard address to be unavailable", port)
+	}
+}
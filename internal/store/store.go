@@ -2,8 +2,10 @@ package store
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
-	"github.com/n3r/port-registry/internal/model"
+	"github.com/n3r/port-registry/pkg/model"
 )
 
 var (
@@ -12,21 +14,111 @@ var (
 	ErrServiceAllocated = errors.New("service already allocated")
 	ErrNotFound         = errors.New("allocation not found")
 	ErrFilterRequired   = errors.New("at least one filter is required for delete")
+	ErrNoLease          = errors.New("allocation has no lease to renew")
+	ErrPortExcluded     = errors.New("port is excluded")
+	ErrRangeExhausted   = errors.New("no free ports in range")
 )
 
+// RangeExhaustedError reports the range in which auto-assignment found no
+// free port. It matches ErrRangeExhausted.
+type RangeExhaustedError struct {
+	Min, Max int
+}
+
+func (e *RangeExhaustedError) Error() string {
+	return fmt.Sprintf("no free ports in range %d-%d", e.Min, e.Max)
+}
+
+func (e *RangeExhaustedError) Is(target error) bool {
+	return target == ErrRangeExhausted
+}
+
+// BatchError reports which request of an AllocateBatch call failed. Holder is
+// set for conflicts, as with Allocate.
+type BatchError struct {
+	Index  int
+	Holder *model.Allocation
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("allocation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
 type Filter struct {
 	App      string
 	Instance string
 	Service  string
 	Port     int
+	Repo     string            // the git repository the allocation was made from
+	Labels   map[string]string // every key must be present with the given value
+}
+
+// EventFilter selects allocation history entries. Zero fields match everything.
+type EventFilter struct {
+	App       string
+	AppPrefix string // only apps whose name starts with it
+	Instance  string
+	Service   string
+	Port      int
+	Types     []string // event types to include; empty = all
+	Since     time.Time
+	AfterID   int64 // only events with a greater ID, for resuming a stream
+	Limit     int   // keep only the most recent Limit events; 0 = no limit
 }
 
 type Store interface {
 	Ping() error
+	// WithOrigin returns a Store that attributes the changes it makes to o in
+	// the event history. The returned Store shares the underlying database.
+	WithOrigin(o model.Origin) Store
+	// Allocate assigns a port to req. Auto-assignment searches the app's own range
+	// if one is set, and portMin-portMax otherwise, skipping excluded ports.
+	// An explicit excluded port fails with ErrPortExcluded unless req.Force is set.
+	// If req.Ensure is set and the service already holds a port (req.Port, if
+	// given), that allocation is returned unchanged instead of ErrServiceAllocated.
 	Allocate(req model.AllocateRequest, portMin, portMax int) (*model.Allocation, error)
+	// Ensure is Allocate with req.Ensure set, and also reports whether the
+	// returned allocation already existed.
+	Ensure(req model.AllocateRequest, portMin, portMax int) (alloc *model.Allocation, existed bool, err error)
+	// AllocateBatch allocates every request in a single transaction, or none of them.
+	// On failure it returns a *BatchError identifying the offending request.
+	AllocateBatch(reqs []model.AllocateRequest, portMin, portMax int) ([]model.Allocation, error)
 	List(f Filter) ([]model.Allocation, error)
-	GetByPort(port int) (*model.Allocation, error)
+	GetByID(id int64) (*model.Allocation, error)
+	// GetByPort returns the allocation of port whose protocol conflicts with
+	// proto; ProtoBoth finds either.
+	GetByPort(port int, proto string) (*model.Allocation, error)
 	DeleteByID(id int64) error
 	DeleteByFilter(f Filter) (int64, error)
+	// Renew extends a lease by ttl from now; ttl 0 reuses the lease's original TTL.
+	Renew(id int64, ttl time.Duration) (*model.Allocation, error)
+	// DeleteExpired removes all leases that expired at or before now.
+	DeleteExpired(now time.Time) (int64, error)
+	// ListRanges returns the per-app auto-assignment ranges.
+	ListRanges() ([]model.PortRange, error)
+	// SetRange creates or replaces the auto-assignment range for r.App.
+	SetRange(r model.PortRange) error
+	DeleteRange(app string) error
+	ListExclusions() ([]model.Exclusion, error)
+	AddExclusion(e model.Exclusion) (*model.Exclusion, error)
+	DeleteExclusion(id int64) error
+	// ListEvents returns matching history entries, oldest first.
+	ListEvents(f EventFilter) ([]model.Event, error)
+	// Subscribe returns a channel that receives a value whenever new events may
+	// have been recorded, and a function that ends the subscription. Bursts of
+	// changes are coalesced, so subscribers should re-read with ListEvents.
+	Subscribe() (<-chan struct{}, func())
+	// CreateToken stores a new API token and returns it with its secret, which
+	// is not retrievable afterwards: only a hash is kept.
+	CreateToken(t model.Token) (*model.Token, string, error)
+	// LookupToken returns the token with the given secret, or ErrNotFound.
+	LookupToken(secret string) (*model.Token, error)
+	ListTokens() ([]model.Token, error)
+	DeleteToken(id int64) error
 	Close() error
 }
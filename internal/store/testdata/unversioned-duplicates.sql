@@ -0,0 +1,11 @@
+-- Earliest schema with rows that violate (app, instance, service) uniqueness.
+CREATE TABLE allocations (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	app         TEXT    NOT NULL,
+	instance    TEXT    NOT NULL,
+	service     TEXT    NOT NULL,
+	port        INTEGER NOT NULL UNIQUE,
+	created_at  TEXT    NOT NULL DEFAULT (datetime('now'))
+);
+INSERT INTO allocations (app, instance, service, port) VALUES ('myapp', 'main', 'web', 3000);
+INSERT INTO allocations (app, instance, service, port) VALUES ('myapp', 'main', 'web', 3001);
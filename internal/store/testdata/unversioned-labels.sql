@@ -0,0 +1,36 @@
+-- Schema created by the last release before schema_version existed.
+CREATE TABLE allocations (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	app         TEXT    NOT NULL,
+	instance    TEXT    NOT NULL,
+	service     TEXT    NOT NULL,
+	port        INTEGER NOT NULL UNIQUE,
+	created_at  TEXT    NOT NULL DEFAULT (datetime('now')),
+	expires_at  TEXT,
+	ttl_seconds INTEGER NOT NULL DEFAULT 0,
+	UNIQUE(app, instance, service)
+);
+CREATE UNIQUE INDEX idx_alloc_app_instance_service ON allocations(app, instance, service);
+CREATE TABLE ranges (
+	app      TEXT    PRIMARY KEY,
+	port_min INTEGER NOT NULL,
+	port_max INTEGER NOT NULL
+);
+CREATE TABLE allocation_labels (
+	allocation_id INTEGER NOT NULL,
+	key           TEXT    NOT NULL,
+	value         TEXT    NOT NULL,
+	PRIMARY KEY (allocation_id, key)
+);
+CREATE INDEX idx_labels_key_value ON allocation_labels(key, value);
+CREATE TABLE exclusions (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	port_min INTEGER NOT NULL,
+	port_max INTEGER NOT NULL,
+	reason   TEXT    NOT NULL DEFAULT ''
+);
+INSERT INTO exclusions (port_min, port_max, reason) VALUES (6379, 6379, 'Redis');
+INSERT INTO ranges (app, port_min, port_max) VALUES ('myapp', 40000, 40999);
+INSERT INTO allocations (app, instance, service, port, created_at, expires_at, ttl_seconds)
+	VALUES ('myapp', 'main', 'web', 40000, '2024-01-02 03:04:05', '2099-01-01 00:00:00', 3600);
+INSERT INTO allocation_labels (allocation_id, key, value) VALUES (1, 'owner', 'alice');
@@ -0,0 +1,11 @@
+-- Earliest schema: no uniqueness on (app, instance, service).
+CREATE TABLE allocations (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	app         TEXT    NOT NULL,
+	instance    TEXT    NOT NULL,
+	service     TEXT    NOT NULL,
+	port        INTEGER NOT NULL UNIQUE,
+	created_at  TEXT    NOT NULL DEFAULT (datetime('now'))
+);
+INSERT INTO allocations (app, instance, service, port, created_at) VALUES ('myapp', 'main', 'web', 3000, '2024-01-02 03:04:05');
+INSERT INTO allocations (app, instance, service, port, created_at) VALUES ('myapp', 'main', 'db', 5433, '2024-01-02 03:04:05');
@@ -0,0 +1,222 @@
+// Package model defines the request and response types of the port-registry
+// HTTP API, which are documented at /v1/openapi.json. The server, portctl and
+// package portregistry share them, and they are covered by the compatibility
+// promise of package portregistry.
+package model
+
+import "time"
+
+type Allocation struct {
+	ID        int64             `json:"id"`
+	App       string            `json:"app"`
+	Instance  string            `json:"instance"`
+	Service   string            `json:"service"`
+	Port      int               `json:"port"`
+	Proto     string            `json:"proto"` // tcp, udp or both
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Git       *GitInfo          `json:"git,omitempty"`
+}
+
+// Protocols an allocation reserves its port for. A tcp and a udp allocation
+// may share a port; both conflicts with either.
+const (
+	ProtoTCP  = "tcp"
+	ProtoUDP  = "udp"
+	ProtoBoth = "both"
+)
+
+// GitInfo records the git checkout an allocation was made from.
+type GitInfo struct {
+	Repo     string `json:"repo"`               // absolute common git dir, e.g. /src/api/.git
+	Worktree string `json:"worktree,omitempty"` // absolute root of the worktree
+	Branch   string `json:"branch,omitempty"`   // empty on a detached HEAD
+	Commit   string `json:"commit,omitempty"`
+}
+
+type AllocateRequest struct {
+	App      string `json:"app"`
+	Instance string `json:"instance"`
+	Service  string `json:"service"`
+	Port     int    `json:"port,omitempty"`
+	Proto    string `json:"proto,omitempty"`  // tcp (the default), udp or both
+	TTL      string `json:"ttl,omitempty"`    // Go duration, e.g. "2h"; empty = no expiry
+	Force    bool   `json:"force,omitempty"`  // allow an explicit port that is on the exclusion list
+	Ensure   bool   `json:"ensure,omitempty"` // return the service's existing allocation instead of a conflict
+	// Preferred makes Port a preference: if it is taken, busy or excluded,
+	// a port is auto-assigned instead.
+	Preferred bool              `json:"preferred,omitempty"`
+	Range     *PortRange        `json:"range,omitempty"` // auto-assign from this range instead of the app's or the default
+	Labels    map[string]string `json:"labels,omitempty"`
+	Git       *GitInfo          `json:"git,omitempty"`
+}
+
+type BatchAllocateRequest struct {
+	Allocations []AllocateRequest `json:"allocations"`
+}
+
+type RenewRequest struct {
+	TTL string `json:"ttl,omitempty"` // empty = reuse the lease's original TTL
+}
+
+type ReleaseRequest struct {
+	App      string            `json:"app,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Service  string            `json:"service,omitempty"`
+	Port     int               `json:"port,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type PortStatus struct {
+	Port      int         `json:"port"`
+	Available bool        `json:"available"`
+	Holder    *Allocation `json:"holder,omitempty"`
+}
+
+// Listener is a socket listening on a port of the server's host, and the
+// process holding it. The process is unknown when the server may not inspect
+// it, e.g. another user's when not running as root.
+type Listener struct {
+	Proto     string   `json:"proto"` // tcp, tcp6, udp or udp6
+	Address   string   `json:"address"`
+	Port      int      `json:"port"`
+	PID       int      `json:"pid,omitempty"`
+	Process   string   `json:"process,omitempty"`
+	Cmdline   []string `json:"cmdline,omitempty"`
+	Cwd       string   `json:"cwd,omitempty"`
+	Container string   `json:"container,omitempty"` // short container ID
+}
+
+// PortListeners is what listens on a port, and the port's allocations: one,
+// or a tcp and a udp one.
+type PortListeners struct {
+	Port        int          `json:"port"`
+	Listeners   []Listener   `json:"listeners"`
+	Allocations []Allocation `json:"allocations"`
+}
+
+// Audit finding kinds.
+const (
+	AuditNotListening = "not_listening" // allocated, but nothing listens on the port
+	AuditUnregistered = "unregistered"  // listening inside the managed range, but not allocated
+	AuditRepoMismatch = "repo_mismatch" // the listener runs from another repository than the allocation's
+)
+
+// AuditFinding is a difference between the allocations and what listens on
+// the server's host.
+type AuditFinding struct {
+	Kind       string      `json:"kind"`
+	Port       int         `json:"port"`
+	Allocation *Allocation `json:"allocation,omitempty"`
+	Listeners  []Listener  `json:"listeners,omitempty"`
+	Repo       string      `json:"repo,omitempty"` // the listeners' repository, for repo_mismatch
+}
+
+// PortRange bounds auto-assignment. App is empty for the global default range.
+type PortRange struct {
+	App string `json:"app,omitempty"`
+	Min int    `json:"min"`
+	Max int    `json:"max"`
+}
+
+type RangesResponse struct {
+	Default PortRange   `json:"default"`
+	Apps    []PortRange `json:"apps"`
+}
+
+// Exclusion is a port or port range that auto-assignment never hands out.
+type Exclusion struct {
+	ID     int64  `json:"id"`
+	Min    int    `json:"min"`
+	Max    int    `json:"max"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Event types recorded in the allocation history.
+const (
+	EventAllocate = "allocate"
+	EventRelease  = "release"
+	EventRenew    = "renew"
+	EventConflict = "conflict"
+)
+
+// ActorHeader carries the client-supplied identity recorded in the event history.
+const ActorHeader = "X-Port-Registry-Actor"
+
+// Origin identifies who made a change and through what.
+type Origin struct {
+	Actor  string // e.g. the OS user running portctl
+	Source string // e.g. the client's User-Agent, or "reaper"
+}
+
+// Event is an entry in the allocation history. Events are kept after the
+// allocation they describe is released.
+type Event struct {
+	ID           int64     `json:"id"`
+	Type         string    `json:"type"`
+	AllocationID int64     `json:"allocation_id,omitempty"`
+	App          string    `json:"app"`
+	Instance     string    `json:"instance"`
+	Service      string    `json:"service"`
+	Port         int       `json:"port,omitempty"`
+	Actor        string    `json:"actor,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	Detail       string    `json:"detail,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Token scopes. Each scope includes the ones before it.
+const (
+	ScopeRead     = "read"     // list and inspect
+	ScopeAllocate = "allocate" // allocate, release and renew
+	ScopeAdmin    = "admin"    // manage ranges, exclusions and tokens
+)
+
+// Token is an API credential. The secret itself is only returned once, when
+// the token is created.
+type Token struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Scope     string    `json:"scope"`
+	AppPrefix string    `json:"app_prefix,omitempty"` // restricts changes to apps with this prefix
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateTokenRequest struct {
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	AppPrefix string `json:"app_prefix,omitempty"`
+}
+
+type CreateTokenResponse struct {
+	Token
+	Secret string `json:"secret"`
+}
+
+// Error codes returned in ErrorResponse.Code. Clients should switch on these
+// rather than on the message, which may be reworded.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeServiceAllocated = "service_allocated"
+	CodePortTaken        = "port_taken"
+	CodePortBusy         = "port_busy"
+	CodePortExcluded     = "port_excluded"
+	CodeRangeExhausted   = "range_exhausted"
+	CodeFilterRequired   = "filter_required"
+	CodeNoLease          = "no_lease"
+	CodeUnsupported      = "unsupported"
+	CodeInternal         = "internal"
+)
+
+type ErrorResponse struct {
+	Error  string      `json:"error"`
+	Code   string      `json:"code"`
+	Port   int         `json:"port,omitempty"`  // the port in conflict
+	Range  *PortRange  `json:"range,omitempty"` // the range with no free ports
+	Holder *Allocation `json:"holder,omitempty"`
+	Index  *int        `json:"index,omitempty"` // failing entry of a batch request
+}
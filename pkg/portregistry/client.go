@@ -0,0 +1,456 @@
+package portregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/n3r/port-registry/internal/version"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// Defaults for the corresponding options.
+const (
+	DefaultTimeout    = 10 * time.Second
+	DefaultRetries    = 2
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+// Client calls a port-registry server. It is safe for concurrent use.
+type Client struct {
+	base       string
+	http       *http.Client
+	transport  http.RoundTripper
+	token      string
+	actor      string
+	userAgent  string
+	timeout    time.Duration
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithTransport sets the transport used to reach the server, replacing the
+// default one (or the Unix socket dialer for unix:// addresses).
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.transport = rt
+	}
+}
+
+// WithToken authenticates requests with a bearer token, for servers running
+// with -auth.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithActor names who is making changes, for the server's history. Servers
+// with -auth record the token's name instead.
+func WithActor(actor string) Option {
+	return func(c *Client) {
+		c.actor = actor
+	}
+}
+
+// WithUserAgent sets the User-Agent header, which the server records as the
+// source of changes.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) {
+		c.userAgent = ua
+	}
+}
+
+// WithTimeout bounds each attempt of a request; 0 disables the limit. It does
+// not apply to Watch.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithRetries sets how many times a failed request is retried; 0 disables
+// retries.
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.retries = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry and the cap it doubles up
+// to. Each delay is randomized by up to half to spread out retrying clients.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New returns a client for the server at addr, either host:port or
+// unix:///path/to/socket.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{
+		base:       "http://" + addr,
+		transport:  http.DefaultTransport,
+		userAgent:  "portregistry-go/" + version.Version,
+		timeout:    DefaultTimeout,
+		retries:    DefaultRetries,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+	}
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		// The host is ignored; every connection goes to the socket.
+		c.base = "http://unix"
+		c.transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.http = &http.Client{Transport: headerTransport{c}}
+	return c
+}
+
+// headerTransport adds the client's identifying headers to every request.
+type headerTransport struct {
+	c *Client
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.c
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.actor != "" {
+		req.Header.Set(model.ActorHeader, c.actor)
+	}
+	return c.transport.RoundTrip(req)
+}
+
+// do sends a request with a JSON body (if in is non-nil), retrying as
+// configured, and decodes a response with status want into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in any, want int, out any) error {
+	_, err := c.send(ctx, method, path, query, in, out, want)
+	return err
+}
+
+// send is do for requests that may succeed with more than one status. It
+// returns the status of the successful response.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, in, out any, want ...int) (int, error) {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, fmt.Errorf("marshal request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		status, retry, err := c.try(ctx, method, u, body, want, out)
+		if !retry || attempt >= c.retries || ctx.Err() != nil {
+			return status, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, err
+		case <-time.After(c.backoff(attempt)):
+		}
+	}
+}
+
+// try makes one attempt at a request and reports whether a failure may be
+// retried.
+func (c *Client) try(ctx context.Context, method, u string, body []byte, want []int, out any) (status int, retry bool, err error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return 0, false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// A refused connection never reached the server, so even a
+		// non-idempotent request can safely be sent again.
+		return 0, idempotent(method) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT), err
+	}
+	defer resp.Body.Close()
+
+	if !slices.Contains(want, resp.StatusCode) {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			retry = idempotent(method)
+		}
+		return 0, retry, readError(resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return 0, false, fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return resp.StatusCode, false, nil
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before retry number attempt+1.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff << attempt
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Health returns nil if the server and its database are up.
+func (c *Client) Health(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/healthz", nil, nil, http.StatusOK, nil)
+}
+
+// Allocate assigns a port. If it is taken, the error matches ErrPortTaken or
+// ErrServiceAllocated, and its *Error has the current holder. With
+// req.Ensure set, it behaves like Ensure.
+func (c *Client) Allocate(ctx context.Context, req AllocateRequest) (*Allocation, error) {
+	var a Allocation
+	if _, err := c.send(ctx, http.MethodPost, "/v1/allocations", nil, req, &a, http.StatusCreated, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Ensure returns the port held by req's service, allocating one if there is
+// none, and reports whether it already existed. If req.Port is set, the
+// service must hold that port, or the error matches ErrServiceAllocated.
+func (c *Client) Ensure(ctx context.Context, req AllocateRequest) (a *Allocation, existed bool, err error) {
+	req.Ensure = true
+	a = new(Allocation)
+	status, err := c.send(ctx, http.MethodPost, "/v1/allocations", nil, req, a, http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return nil, false, err
+	}
+	return a, status == http.StatusOK, nil
+}
+
+// AllocateBatch allocates all requests atomically. If any fails, nothing is
+// allocated and the *Error's Index names the failing request.
+func (c *Client) AllocateBatch(ctx context.Context, reqs []AllocateRequest) ([]Allocation, error) {
+	var allocs []Allocation
+	in := model.BatchAllocateRequest{Allocations: reqs}
+	if err := c.do(ctx, http.MethodPost, "/v1/allocations/batch", nil, in, http.StatusCreated, &allocs); err != nil {
+		return nil, err
+	}
+	return allocs, nil
+}
+
+func (c *Client) List(ctx context.Context, f Filter) ([]Allocation, error) {
+	q := url.Values{}
+	setQuery(q, "app", f.App)
+	setQuery(q, "instance", f.Instance)
+	setQuery(q, "service", f.Service)
+	setQuery(q, "repo", f.Repo)
+	for k, v := range f.Labels {
+		q.Add("label", k+"="+v)
+	}
+	var allocs []Allocation
+	if err := c.do(ctx, http.MethodGet, "/v1/allocations", q, nil, http.StatusOK, &allocs); err != nil {
+		return nil, err
+	}
+	return allocs, nil
+}
+
+// ListEvents returns the allocation history matching f, oldest first.
+func (c *Client) ListEvents(ctx context.Context, f EventFilter) ([]Event, error) {
+	q := url.Values{}
+	setQuery(q, "app", f.App)
+	setQuery(q, "instance", f.Instance)
+	setQuery(q, "service", f.Service)
+	if f.Port != 0 {
+		q.Set("port", strconv.Itoa(f.Port))
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	var events []Event
+	if err := c.do(ctx, http.MethodGet, "/v1/events", q, nil, http.StatusOK, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (c *Client) ReleaseByID(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/v1/allocations/"+strconv.FormatInt(id, 10), nil, nil, http.StatusOK, nil)
+}
+
+// ReleaseByFilter releases every matching allocation and returns how many
+// there were. At least one field of rel must be set.
+func (c *Client) ReleaseByFilter(ctx context.Context, rel ReleaseRequest) (int64, error) {
+	var result struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/v1/allocations", nil, rel, http.StatusOK, &result); err != nil {
+		return 0, err
+	}
+	return result.Deleted, nil
+}
+
+// Renew extends a lease by ttl from now; ttl 0 reuses the lease's original TTL.
+func (c *Client) Renew(ctx context.Context, id int64, ttl time.Duration) (*Allocation, error) {
+	var in model.RenewRequest
+	if ttl > 0 {
+		in.TTL = ttl.String()
+	}
+	var a Allocation
+	if err := c.do(ctx, http.MethodPost, "/v1/allocations/"+strconv.FormatInt(id, 10)+"/renew", nil, in, http.StatusOK, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// CheckPort reports whether port is allocated for TCP.
+func (c *Client) CheckPort(ctx context.Context, port int) (*PortStatus, error) {
+	return c.CheckPortProto(ctx, port, ProtoTCP)
+}
+
+// CheckPortProto reports whether port is allocated for proto: ProtoTCP,
+// ProtoUDP, or ProtoBoth to find an allocation for either.
+func (c *Client) CheckPortProto(ctx context.Context, port int, proto string) (*PortStatus, error) {
+	var status PortStatus
+	query := url.Values{"proto": {proto}}
+	if err := c.do(ctx, http.MethodGet, "/v1/ports/"+strconv.Itoa(port), query, nil, http.StatusOK, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// PortListeners returns the processes listening on port on the server's host.
+// It fails with ErrUnsupported unless the server runs on Linux.
+func (c *Client) PortListeners(ctx context.Context, port int) (*PortListeners, error) {
+	var pl PortListeners
+	if err := c.do(ctx, http.MethodGet, "/v1/ports/"+strconv.Itoa(port)+"/listener", nil, nil, http.StatusOK, &pl); err != nil {
+		return nil, err
+	}
+	return &pl, nil
+}
+
+// Audit compares every allocation with the ports listening on the server's
+// host. It fails with ErrUnsupported unless the server runs on Linux.
+func (c *Client) Audit(ctx context.Context) ([]AuditFinding, error) {
+	var findings []AuditFinding
+	if err := c.do(ctx, http.MethodGet, "/v1/audit", nil, nil, http.StatusOK, &findings); err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+func (c *Client) ListRanges(ctx context.Context) (*RangesResponse, error) {
+	var ranges RangesResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/ranges", nil, nil, http.StatusOK, &ranges); err != nil {
+		return nil, err
+	}
+	return &ranges, nil
+}
+
+// SetRange creates or replaces the auto-assignment range for r.App.
+func (c *Client) SetRange(ctx context.Context, r PortRange) error {
+	return c.do(ctx, http.MethodPut, "/v1/ranges/"+url.PathEscape(r.App), nil, r, http.StatusOK, nil)
+}
+
+func (c *Client) DeleteRange(ctx context.Context, app string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/ranges/"+url.PathEscape(app), nil, nil, http.StatusOK, nil)
+}
+
+func (c *Client) ListExclusions(ctx context.Context) ([]Exclusion, error) {
+	var excl []Exclusion
+	if err := c.do(ctx, http.MethodGet, "/v1/exclusions", nil, nil, http.StatusOK, &excl); err != nil {
+		return nil, err
+	}
+	return excl, nil
+}
+
+func (c *Client) AddExclusion(ctx context.Context, e Exclusion) (*Exclusion, error) {
+	var excl Exclusion
+	if err := c.do(ctx, http.MethodPost, "/v1/exclusions", nil, e, http.StatusCreated, &excl); err != nil {
+		return nil, err
+	}
+	return &excl, nil
+}
+
+func (c *Client) DeleteExclusion(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/v1/exclusions/"+strconv.FormatInt(id, 10), nil, nil, http.StatusOK, nil)
+}
+
+func (c *Client) ListTokens(ctx context.Context) ([]Token, error) {
+	var tokens []Token
+	if err := c.do(ctx, http.MethodGet, "/v1/tokens", nil, nil, http.StatusOK, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CreateToken creates an API token. The returned secret cannot be retrieved later.
+func (c *Client) CreateToken(ctx context.Context, req CreateTokenRequest) (*CreateTokenResponse, error) {
+	var created CreateTokenResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/tokens", nil, req, http.StatusCreated, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *Client) DeleteToken(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/v1/tokens/"+strconv.FormatInt(id, 10), nil, nil, http.StatusOK, nil)
+}
+
+func setQuery(q url.Values, key, value string) {
+	if value != "" {
+		q.Set(key, value)
+	}
+}
@@ -0,0 +1,204 @@
+package portregistry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/n3r/port-registry/internal/handler"
+	"github.com/n3r/port-registry/internal/store"
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+func newServer(t *testing.T, opts ...handler.Option) (*store.SQLiteStore, *httptest.Server) {
+	t.Helper()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PortChecker = nil
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(handler.New(s, opts...).Routes())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func addr(srv *httptest.Server) string {
+	return srv.Listener.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	_, srv := newServer(t)
+	c := New(addr(srv))
+	ctx := context.Background()
+
+	if err := c.Health(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a, err := c.Allocate(ctx, AllocateRequest{App: "web", Instance: "main", Service: "http", Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, existed, err := c.Ensure(ctx, AllocateRequest{App: "web", Instance: "main", Service: "http"})
+	if err != nil || !existed || e.ID != a.ID {
+		t.Fatalf("expected Ensure to return allocation %d, got %+v, existed=%v, %v", a.ID, e, existed, err)
+	}
+
+	_, err = c.Allocate(ctx, AllocateRequest{App: "api", Instance: "main", Service: "http", Port: 3000})
+	var apiErr *Error
+	if !errors.Is(err, ErrPortTaken) || !errors.As(err, &apiErr) {
+		t.Fatalf("expected ErrPortTaken, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusConflict || apiErr.Code != CodePortTaken || apiErr.Port != 3000 {
+		t.Errorf("expected %s conflict on port 3000, got %+v", CodePortTaken, apiErr)
+	}
+	if apiErr.Holder == nil || apiErr.Holder.ID != a.ID {
+		t.Errorf("expected holder %d, got %+v", a.ID, apiErr.Holder)
+	}
+
+	_, err = c.AllocateBatch(ctx, []AllocateRequest{
+		{App: "api", Instance: "main", Service: "grpc"},
+		{App: "web", Instance: "main", Service: "http"},
+	})
+	if !errors.Is(err, ErrServiceAllocated) || !errors.As(err, &apiErr) || apiErr.Index == nil || *apiErr.Index != 1 {
+		t.Fatalf("expected ErrServiceAllocated at index 1, got %v", err)
+	}
+
+	allocs, err := c.List(ctx, Filter{App: "web"})
+	if err != nil || len(allocs) != 1 {
+		t.Fatalf("expected 1 allocation, got %v, %v", allocs, err)
+	}
+	if _, err := c.Renew(ctx, a.ID, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReleaseByID(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReleaseByID(ctx, a.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := c.ReleaseByFilter(ctx, ReleaseRequest{}); !errors.Is(err, ErrFilterRequired) || !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrFilterRequired and ErrInvalidRequest, got %v", err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	s, srv := newServer(t, handler.WithAuth())
+	_, secret, _ := s.CreateToken(model.Token{Name: "ci", Scope: model.ScopeRead})
+	ctx := context.Background()
+
+	if _, err := New(addr(srv)).List(ctx, Filter{}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized, got %v", err)
+	}
+	c := New(addr(srv), WithToken(secret))
+	if _, err := c.List(ctx, Filter{}); err != nil {
+		t.Errorf("expected token to be accepted, got %v", err)
+	}
+	if _, err := c.Allocate(ctx, AllocateRequest{App: "a", Instance: "i", Service: "s"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected ErrForbidden, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, srv := newServer(t, handler.WithAuth())
+	tok, secret, _ := s.CreateToken(model.Token{Name: "ci", Scope: model.ScopeRead})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := New(addr(srv), WithToken(secret)).Watch(ctx, EventFilter{App: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Allocate(model.AllocateRequest{App: "web", Instance: "main", Service: "http"}, 3000, 3999)
+	if e := <-stream.Events; e.Type != EventAllocate || e.Service != "http" {
+		t.Fatalf("expected the allocate event, got %+v", e)
+	}
+
+	// A stream dropped before its first event resumes from where it started.
+	stream2, err := New(addr(srv), WithToken(secret)).Watch(ctx, EventFilter{App: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.CloseClientConnections()
+	s.Allocate(model.AllocateRequest{App: "web", Instance: "main", Service: "db"}, 3000, 3999)
+	if e := <-stream2.Events; e.Type != EventAllocate || e.Service != "db" {
+		t.Fatalf("expected the allocate event made while disconnected, got %+v", e)
+	}
+	if e := <-stream.Events; e.Service != "db" {
+		t.Fatalf("expected the first stream to resume too, got %+v", e)
+	}
+
+	// Once the token is revoked, reconnecting fails for good.
+	if err := s.DeleteToken(tok.ID); err != nil {
+		t.Fatal(err)
+	}
+	srv.CloseClientConnections()
+	for e := range stream.Events {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if !errors.Is(stream.Err(), ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized, got %v", stream.Err())
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c := New(addr(srv), WithBackoff(time.Millisecond, 5*time.Millisecond))
+	if _, err := c.List(ctx, Filter{}); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+
+	// Allocations are not repeated once they may have reached the server.
+	calls.Store(0)
+	if _, err := c.Allocate(ctx, AllocateRequest{}); err == nil {
+		t.Error("expected error")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+
+	calls.Store(0)
+	if _, err := New(addr(srv), WithRetries(0)).List(ctx, Filter{}); err == nil {
+		t.Error("expected error without retries")
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	path := filepath.Join(t.TempDir(), "registry.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler.New(s).Routes()}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	if err := New("unix://" + path).Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
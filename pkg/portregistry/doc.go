@@ -0,0 +1,32 @@
+// Package portregistry is the Go client for the port-registry server.
+//
+// Create a client with the server's address, either host:port or
+// unix:///path/to/socket, and call its methods:
+//
+//	c := portregistry.New("127.0.0.1:51234", portregistry.WithToken(os.Getenv("PORT_REGISTRY_TOKEN")))
+//	a, err := c.Allocate(ctx, portregistry.AllocateRequest{App: "web", Instance: "main", Service: "http"})
+//	if errors.Is(err, portregistry.ErrServiceAllocated) {
+//		var apiErr *portregistry.Error
+//		errors.As(err, &apiErr)
+//		fmt.Println("already on port", apiErr.Holder.Port)
+//	}
+//
+// Every method takes a context, which bounds the call including its retries.
+// Requests that are safe to repeat are retried with exponential backoff when
+// the server cannot be reached or answers 502, 503 or 504; see WithRetries.
+// Allocations are only retried when the connection was refused, since the
+// server cannot have acted on them.
+//
+// Errors returned by the server are *Error values, which match the sentinel
+// errors of this package with errors.Is.
+//
+// # Compatibility
+//
+// This package follows the Go 1 compatibility guidelines within major version
+// 1 of the module: exported names are not removed or changed incompatibly,
+// and sentinel errors keep matching the conditions they describe. New methods,
+// options, struct fields and error values may be added. Struct types should be
+// created with field names rather than positionally. The same applies to
+// package model, which defines the request and response types this package
+// refers to through type aliases.
+package portregistry
@@ -0,0 +1,125 @@
+package portregistry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+var (
+	ErrPortTaken        = errors.New("port already allocated")
+	ErrPortBusy         = errors.New("port in use on system")
+	ErrServiceAllocated = errors.New("service already allocated")
+	ErrPortExcluded     = errors.New("port is excluded")
+	ErrRangeExhausted   = errors.New("no free ports in range")
+	ErrNotFound         = errors.New("not found")
+	ErrInvalidRequest   = errors.New("invalid request")
+	ErrFilterRequired   = errors.New("at least one filter is required")
+	ErrNoLease          = errors.New("allocation has no lease")
+	ErrUnauthorized     = errors.New("missing or invalid token")
+	ErrForbidden        = errors.New("token not permitted")
+	ErrUnsupported      = errors.New("not supported on the server's platform")
+)
+
+// Error codes reported in Error.Code.
+const (
+	CodeInvalidRequest   = model.CodeInvalidRequest
+	CodeUnauthorized     = model.CodeUnauthorized
+	CodeForbidden        = model.CodeForbidden
+	CodeNotFound         = model.CodeNotFound
+	CodeServiceAllocated = model.CodeServiceAllocated
+	CodePortTaken        = model.CodePortTaken
+	CodePortBusy         = model.CodePortBusy
+	CodePortExcluded     = model.CodePortExcluded
+	CodeRangeExhausted   = model.CodeRangeExhausted
+	CodeFilterRequired   = model.CodeFilterRequired
+	CodeNoLease          = model.CodeNoLease
+	CodeUnsupported      = model.CodeUnsupported
+	CodeInternal         = model.CodeInternal
+)
+
+// codeErrors maps error codes to the sentinel errors they match.
+var codeErrors = map[string]error{
+	CodeInvalidRequest:   ErrInvalidRequest,
+	CodeUnauthorized:     ErrUnauthorized,
+	CodeForbidden:        ErrForbidden,
+	CodeNotFound:         ErrNotFound,
+	CodeServiceAllocated: ErrServiceAllocated,
+	CodePortTaken:        ErrPortTaken,
+	CodePortBusy:         ErrPortBusy,
+	CodePortExcluded:     ErrPortExcluded,
+	CodeRangeExhausted:   ErrRangeExhausted,
+	CodeFilterRequired:   ErrFilterRequired,
+	CodeNoLease:          ErrNoLease,
+	CodeUnsupported:      ErrUnsupported,
+}
+
+// statusErrors maps statuses to the sentinel errors that every response
+// with that status matches, whatever its code.
+var statusErrors = map[int]error{
+	http.StatusBadRequest:   ErrInvalidRequest,
+	http.StatusUnauthorized: ErrUnauthorized,
+	http.StatusForbidden:    ErrForbidden,
+	http.StatusNotFound:     ErrNotFound,
+}
+
+// Error is an error response from the server. It matches the sentinel error
+// for its Code with errors.Is, and for 4xx statuses the general one as well:
+// a filter_required error matches both ErrFilterRequired and
+// ErrInvalidRequest.
+type Error struct {
+	StatusCode int
+	Code       string // e.g. CodePortTaken; empty if the server sent none
+	Message    string
+	Port       int         // the port in conflict
+	Range      *PortRange  // the range with no free ports, for ErrRangeExhausted
+	Holder     *Allocation // the current holder, for ErrPortTaken and ErrServiceAllocated
+	Index      *int        // the failing entry of an AllocateBatch request
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.Index != nil {
+		return fmt.Sprintf("allocation %d: %s", *e.Index, msg)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() []error {
+	var errs []error
+	if err, ok := codeErrors[e.Code]; ok {
+		errs = append(errs, err)
+	}
+	if err, ok := statusErrors[e.StatusCode]; ok && (len(errs) == 0 || errs[0] != err) {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// readError builds an *Error from a response with an unexpected status.
+func readError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body model.ErrorResponse
+	if json.Unmarshal(data, &body) != nil || body.Error == "" {
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("server error (status %d): %s", resp.StatusCode, data),
+		}
+	}
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Code:       body.Code,
+		Message:    body.Error,
+		Port:       body.Port,
+		Range:      body.Range,
+		Holder:     body.Holder,
+		Index:      body.Index,
+	}
+}
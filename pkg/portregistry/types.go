@@ -0,0 +1,75 @@
+package portregistry
+
+import (
+	"time"
+
+	"github.com/n3r/port-registry/pkg/model"
+)
+
+// The request and response types of the HTTP API, defined in package model.
+type (
+	Allocation          = model.Allocation
+	GitInfo             = model.GitInfo
+	AllocateRequest     = model.AllocateRequest
+	ReleaseRequest      = model.ReleaseRequest
+	PortStatus          = model.PortStatus
+	Listener            = model.Listener
+	PortListeners       = model.PortListeners
+	AuditFinding        = model.AuditFinding
+	PortRange           = model.PortRange
+	RangesResponse      = model.RangesResponse
+	Exclusion           = model.Exclusion
+	Event               = model.Event
+	Token               = model.Token
+	CreateTokenRequest  = model.CreateTokenRequest
+	CreateTokenResponse = model.CreateTokenResponse
+)
+
+// Event types.
+const (
+	EventAllocate = model.EventAllocate
+	EventRelease  = model.EventRelease
+	EventRenew    = model.EventRenew
+	EventConflict = model.EventConflict
+)
+
+// Protocols an allocation reserves its port for.
+const (
+	ProtoTCP  = model.ProtoTCP
+	ProtoUDP  = model.ProtoUDP
+	ProtoBoth = model.ProtoBoth
+)
+
+// Audit finding kinds.
+const (
+	AuditNotListening = model.AuditNotListening
+	AuditUnregistered = model.AuditUnregistered
+	AuditRepoMismatch = model.AuditRepoMismatch
+)
+
+// Token scopes. Each scope includes the ones before it.
+const (
+	ScopeRead     = model.ScopeRead
+	ScopeAllocate = model.ScopeAllocate
+	ScopeAdmin    = model.ScopeAdmin
+)
+
+// Filter selects allocations. Zero fields match everything.
+type Filter struct {
+	App      string
+	Instance string
+	Service  string
+	Repo     string            // the git repository (GitInfo.Repo) the allocation was made from
+	Labels   map[string]string // every key must be present with the given value
+}
+
+// EventFilter selects history entries. Zero fields match everything. Watch
+// only uses App and Instance.
+type EventFilter struct {
+	App      string
+	Instance string
+	Service  string
+	Port     int
+	Since    time.Time
+	Limit    int // keep only the most recent Limit events; 0 = no limit
+}
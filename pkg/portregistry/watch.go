@@ -0,0 +1,153 @@
+package portregistry
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchRetryDelay is how long Watch waits before reconnecting a dropped stream.
+const watchRetryDelay = time.Second
+
+// EventStream is a stream of events returned by Watch.
+type EventStream struct {
+	// Events delivers the events in order. It is closed when the context is
+	// done or the server refuses to reconnect the stream.
+	Events <-chan Event
+	err    error
+}
+
+// Err returns why the stream ended: nil if its context is done, or the error
+// that stopped reconnecting. It must only be called after Events is closed.
+func (s *EventStream) Err() error {
+	return s.err
+}
+
+// Watch streams allocate and release events for f.App and f.Instance (empty
+// matches all). The first connection is made before Watch returns; after
+// that, dropped connections are retried and resume from the last event
+// received. Retrying stops if the server rejects the request with a client
+// error, such as ErrUnauthorized, which Err then returns.
+func (c *Client) Watch(ctx context.Context, f EventFilter) (*EventStream, error) {
+	resp, err := c.openWatch(ctx, f, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	s := &EventStream{Events: events}
+	go func() {
+		defer close(events)
+		lastID := int64(-1)
+		for {
+			lastID = readEvents(ctx, resp, events, lastID)
+			resp.Body.Close()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchRetryDelay):
+				}
+				if resp, err = c.openWatch(ctx, f, lastID); err == nil {
+					break
+				}
+				if permanent(err) {
+					s.err = err
+					return
+				}
+			}
+		}
+	}()
+	return s, nil
+}
+
+// permanent reports whether err is a client error that retrying cannot fix,
+// such as a revoked token.
+func permanent(err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code := apiErr.StatusCode
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+// openWatch connects a stream resuming after lastID, or from new events if
+// lastID is negative.
+func (c *Client) openWatch(ctx context.Context, f EventFilter, lastID int64) (*http.Response, error) {
+	q := url.Values{}
+	setQuery(q, "app", f.App)
+	setQuery(q, "instance", f.Instance)
+	u := c.base + "/v1/watch"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastID >= 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(lastID, 10))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+// readEvents forwards the events of an SSE stream until it ends, returning
+// the last ID read. The server sends an ID without data when the stream
+// opens, which records where to resume even if no event follows.
+func readEvents(ctx context.Context, resp *http.Response, events chan<- Event, lastID int64) int64 {
+	var typ, data, id string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		field, value, _ := strings.Cut(sc.Text(), ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			typ = value
+		case "data":
+			data = value
+		case "id":
+			id = value
+		case "":
+			// A blank line dispatches the event; a leading colon is a comment.
+			if sc.Text() != "" {
+				continue
+			}
+			if data == "" {
+				if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+					lastID = n
+				}
+				typ, id = "", ""
+				continue
+			}
+			var e Event
+			if typ != "error" && json.Unmarshal([]byte(data), &e) == nil {
+				select {
+				case events <- e:
+					lastID = e.ID
+				case <-ctx.Done():
+					return lastID
+				}
+			}
+			typ, data, id = "", "", ""
+		}
+	}
+	return lastID
+}